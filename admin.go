@@ -0,0 +1,229 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+	"github.com/UKHomeOffice/keto-tokens/pkg/server"
+
+	"github.com/urfave/cli"
+)
+
+// adminServerOptions are the server options used by the tokens commands, the interval
+// being carried so a configuration is validated as it would be by the server
+var adminServerOptions = []string{
+	"audit-log",
+	"ca-hash-tag-name",
+	"event-namespace",
+	"filter",
+	"interval",
+	"kube-token",
+	"kubeconfig",
+	"master",
+	"record-events",
+	"tag-name",
+	"token-description",
+	"token-extra-group",
+	"token-namespace",
+	"token-ttl",
+	"token-usage",
+}
+
+// newTokensCommand returns the commands used to administer the issued tokens
+func newTokensCommand() cli.Command {
+	return cli.Command{
+		Name:  "tokens",
+		Usage: "lists, revokes and issues the registration tokens made by the server",
+		Subcommands: []cli.Command{
+			{
+				Name:  "list",
+				Usage: "lists the tokens along with their node, pool, expiry and state",
+				Flags: getTokensFlags(),
+				Action: func(cx *cli.Context) error {
+					return handleCommand(cx, runTokensListCommand)
+				},
+			},
+			{
+				Name:      "revoke",
+				Usage:     "deletes the tokens of a node, or a single token, and marks the instance tag revoked",
+				ArgsUsage: "NODE|TOKEN-ID",
+				Flags: append(getTokensFlags(),
+					cli.BoolFlag{
+						Name:  "skip",
+						Usage: "opt the instance out of token issuance first, tagging it to be skipped",
+					},
+					cli.BoolFlag{
+						Name:  "reissue",
+						Usage: "reset the instance tag to request a new token, rather than marking it revoked",
+					},
+				),
+				Action: func(cx *cli.Context) error {
+					return handleCommand(cx, runTokensRevokeCommand)
+				},
+			},
+			{
+				Name:      "issue",
+				Usage:     "creates a token for the node and writes it to the instance tag, whatever it holds",
+				ArgsUsage: "NODE",
+				Flags:     getTokensFlags(),
+				Action: func(cx *cli.Context) error {
+					return handleCommand(cx, runTokensIssueCommand)
+				},
+			},
+		},
+	}
+}
+
+// getTokensFlags returns the flags of the tokens commands, sharing the options of the server
+func getTokensFlags() []cli.Flag {
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "optional yaml or json configuration file, the server section being used `PATH`",
+			EnvVar: "CONFIG_FILE",
+		},
+		cli.StringFlag{
+			Name:  "profile",
+			Usage: "the cluster profile in the configuration file to use `NAME`",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "write the tokens as json rather than a table",
+		},
+	}
+	for _, x := range newServiceCommand().Flags {
+		if containedIn(getFlagName(x), adminServerOptions) {
+			flags = append(flags, x)
+		}
+	}
+
+	return flags
+}
+
+// runTokensListCommand lists the tokens issued by the server
+func runTokensListCommand(cx *cli.Context) error {
+	if cx.NArg() != 0 {
+		return errors.New("the list command takes no arguments")
+	}
+	admin, err := getTokensAdmin(cx)
+	if err != nil {
+		return err
+	}
+	list, err := admin.List(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return writeTokens(cx, list)
+}
+
+// runTokensRevokeCommand revokes the tokens of the node or the token id
+func runTokensRevokeCommand(cx *cli.Context) error {
+	if cx.NArg() != 1 {
+		return errors.New("you must specify the node or token id to revoke")
+	}
+	admin, err := getTokensAdmin(cx)
+	if err != nil {
+		return err
+	}
+	list, err := admin.Revoke(context.Background(), cx.Args().First(), cx.Bool("skip"), cx.Bool("reissue"))
+	if err != nil {
+		return err
+	}
+
+	return writeTokens(cx, list)
+}
+
+// runTokensIssueCommand issues a token to the node
+func runTokensIssueCommand(cx *cli.Context) error {
+	if cx.NArg() != 1 {
+		return errors.New("you must specify the node to issue a token to")
+	}
+	admin, err := getTokensAdmin(cx)
+	if err != nil {
+		return err
+	}
+	info, err := admin.Issue(context.Background(), cloud.NodeID(cx.Args().First()))
+	if err != nil {
+		return err
+	}
+
+	return writeTokens(cx, []server.TokenInfo{info})
+}
+
+// getTokensAdmin creates the admin from the server section of the configuration file, using
+// the cluster profile when the file has them
+func getTokensAdmin(cx *cli.Context) (*server.Admin, error) {
+	values, err := loadConfigSection(cx, "server", newServiceCommand())
+	if err != nil {
+		return nil, err
+	}
+	name := cx.String("profile")
+	if profiles := values.Profiles(); len(profiles) > 0 && name == "" {
+		return nil, fmt.Errorf("you must specify a --profile, one of: %s", strings.Join(profiles, ", "))
+	}
+	cfg, err := getProfileConfig(values, name)
+	if err != nil {
+		return nil, err
+	}
+	tp, err := server.NewTokenProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	return server.NewAdmin(cfg, handleCloudProvider(cx), tp)
+}
+
+// writeTokens writes the tokens to stdout as a table or json
+func writeTokens(cx *cli.Context, list []server.TokenInfo) error {
+	if cx.Bool("json") {
+		if list == nil {
+			list = []server.TokenInfo{}
+		}
+		content, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(os.Stdout, string(content))
+
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tPOOL\tTOKEN-ID\tEXPIRES\tSTATE")
+	for _, x := range list {
+		pool, expires := "-", "never"
+		if x.Pool != "" {
+			pool = x.Pool
+		}
+		if x.Expires != nil {
+			expires = x.Expires.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", x.Node, pool, x.TokenID, expires, x.State)
+	}
+
+	return w.Flush()
+}
@@ -17,9 +17,11 @@ limitations under the License.
 package main
 
 import (
-	"io/ioutil"
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
-	"path"
+	"strconv"
 	"time"
 
 	"github.com/UKHomeOffice/keto-tokens/pkg/client"
@@ -34,6 +36,11 @@ func newClientCommand() cli.Command {
 		Usage: "retrieves a kubenetes registration tokens for compute kubelets",
 		Name:  "client",
 		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "config",
+				Usage:  "optional yaml or json configuration file, the command line taking precedence `PATH`",
+				EnvVar: "CONFIG_FILE",
+			},
 			cli.StringFlag{
 				Name:   "master",
 				Usage:  "url for the kubernetes API `URL`",
@@ -42,27 +49,151 @@ func newClientCommand() cli.Command {
 			},
 			cli.StringFlag{
 				Name:   "kubeconfig",
-				Usage:  "path to write out the kubeconfig `PATH`",
+				Usage:  "path to write out the kubeconfig when no --output is given `PATH`",
 				Value:  "kubeconfig-bootstrap",
 				EnvVar: "KUBECONFIG",
 			},
+			cli.StringSliceFlag{
+				Name:   "output",
+				Usage:  "an output for the token, kubeconfig=PATH, kubeadm=PATH, token=PATH, env=PATH, json[=PATH] or template=TEMPLATE[:PATH], defaults to the kubeconfig `SPEC`",
+				EnvVar: "OUTPUT",
+			},
+			cli.StringFlag{
+				Name:   "output-mode",
+				Usage:  "the octal file mode of the files written, defaults to 0640 for the kubeconfig and 0600 otherwise `MODE`",
+				EnvVar: "OUTPUT_MODE",
+			},
+			cli.StringFlag{
+				Name:   "output-owner",
+				Usage:  "the user name or uid which owns the files written `USER`",
+				EnvVar: "OUTPUT_OWNER",
+			},
+			cli.StringFlag{
+				Name:   "output-group",
+				Usage:  "the group name or gid which owns the files written `GROUP`",
+				EnvVar: "OUTPUT_GROUP",
+			},
 			cli.StringFlag{
 				Name:   "tag-name",
 				Usage:  "tag used to pass the kubelet registration `NAME`",
 				Value:  "KubeletToken",
 				EnvVar: "TAG_NAME",
 			},
+			cli.StringFlag{
+				Name:   "ca-hash-tag-name",
+				Usage:  "tag holding the cluster ca hash published by the server, used for ca discovery, disabled if empty `NAME`",
+				EnvVar: "CA_HASH_TAG_NAME",
+			},
 			cli.StringFlag{
 				Name:   "ca-path",
-				Usage:  "path to file containing kubeapi ca certificate (otherwise skip-tls-verify is used)",
+				Usage:  "path to file containing kubeapi ca certificate (otherwise discovery or skip-tls-verify is used)",
 				EnvVar: "CA_PATH",
 			},
+			cli.StringSliceFlag{
+				Name:   "discovery-token-ca-cert-hash",
+				Usage:  "discover the ca from cluster-info and verify it against the pin (sha256:<hex>) `HASH`",
+				EnvVar: "DISCOVERY_TOKEN_CA_CERT_HASH",
+			},
+			cli.BoolFlag{
+				Name:   "discovery-token-unsafe-skip-ca-verification",
+				Usage:  "discover the ca from cluster-info without verifying it against a pin",
+				EnvVar: "DISCOVERY_TOKEN_UNSAFE_SKIP_CA_VERIFICATION",
+			},
+			cli.BoolFlag{
+				Name:   "embed-ca",
+				Usage:  "embed the content of the ca certificate in the kubeconfig rather than the path",
+				EnvVar: "EMBED_CA",
+			},
+			cli.StringFlag{
+				Name:   "kubeconfig-format",
+				Usage:  "the format of the kubeconfig written, json or yaml `FORMAT`",
+				Value:  client.FormatJSON,
+				EnvVar: "KUBECONFIG_FORMAT",
+			},
+			cli.StringFlag{
+				Name:   "cluster-name",
+				Usage:  "the name of the cluster in the kubeconfig `NAME`",
+				Value:  "cluster",
+				EnvVar: "CLUSTER_NAME",
+			},
+			cli.StringFlag{
+				Name:   "context-name",
+				Usage:  "the name of the context in the kubeconfig `NAME`",
+				Value:  "bootstrap-context",
+				EnvVar: "CONTEXT_NAME",
+			},
+			cli.StringFlag{
+				Name:   "user-name",
+				Usage:  "the name of the user in the kubeconfig, defaults to the context name `NAME`",
+				EnvVar: "USER_NAME",
+			},
+			cli.StringFlag{
+				Name:   "kubeadm-config",
+				Usage:  "optionally write a kubeadm join configuration to the `PATH`",
+				EnvVar: "KUBEADM_CONFIG",
+			},
+			cli.StringFlag{
+				Name:   "kubeadm-api-version",
+				Usage:  "the api version of the kubeadm join configuration `VERSION`",
+				Value:  client.KubeadmAPIVersion,
+				EnvVar: "KUBEADM_API_VERSION",
+			},
+			cli.StringFlag{
+				Name:   "node-name",
+				Usage:  "the node name placed in the kubeadm join configuration, defaults to the hostname `NAME`",
+				EnvVar: "NODE_NAME",
+			},
+			cli.BoolFlag{
+				Name:   "daemon",
+				Usage:  "keep running, requesting a new token when the kubelet credentials expire",
+				EnvVar: "DAEMON",
+			},
+			cli.StringFlag{
+				Name:   "kubelet-credentials",
+				Usage:  "the kubelet client certificate or kubeconfig watched in daemon mode `PATH`",
+				Value:  "/var/lib/kubelet/pki/kubelet-client-current.pem",
+				EnvVar: "KUBELET_CREDENTIALS",
+			},
+			cli.DurationFlag{
+				Name:   "renew-before",
+				Usage:  "in daemon mode, bootstrap again this long before the credentials expire `DURATION`",
+				EnvVar: "RENEW_BEFORE",
+			},
+			cli.DurationFlag{
+				Name:   "daemon-interval",
+				Usage:  "interval for checking the kubelet credentials in daemon mode `DURATION`",
+				Value:  time.Duration(1) * time.Minute,
+				EnvVar: "DAEMON_INTERVAL",
+			},
 			cli.DurationFlag{
 				Name:   "interval",
-				Usage:  "interval for checking for resource tags `DURATION`",
+				Usage:  "initial interval for checking for resource tags `DURATION`",
 				Value:  time.Duration(5) * time.Second,
 				EnvVar: "INTERVAL",
 			},
+			cli.DurationFlag{
+				Name:   "max-interval",
+				Usage:  "the maximum interval the checks back off to `DURATION`",
+				Value:  time.Duration(2) * time.Minute,
+				EnvVar: "MAX_INTERVAL",
+			},
+			cli.Float64Flag{
+				Name:   "backoff",
+				Usage:  "the multiplier applied to the interval after each check `FACTOR`",
+				Value:  2,
+				EnvVar: "BACKOFF",
+			},
+			cli.Float64Flag{
+				Name:   "jitter",
+				Usage:  "the fraction (0-1) each interval is randomly varied by `FRACTION`",
+				Value:  0.2,
+				EnvVar: "JITTER",
+			},
+			cli.DurationFlag{
+				Name:   "throttle-interval",
+				Usage:  "the minimum wait after being throttled by the provider, defaults to the max interval `DURATION`",
+				EnvVar: "THROTTLE_INTERVAL",
+			},
 			cli.DurationFlag{
 				Name:   "timeout",
 				Usage:  "optional timeout for the operation `DURATION`",
@@ -77,47 +208,265 @@ func newClientCommand() cli.Command {
 
 // runClientAction performs the client mode operation
 func runClientAction(cx *cli.Context) error {
+	values, err := loadConfigValues(cx, "client")
+	if err != nil {
+		return err
+	}
 	p := handleCloudProvider(cx)
 	// step: create a new client
 	cfg := client.Config{
-		Interval: cx.Duration("interval"),
-		TagName:  cx.String("tag-name"),
-		Timeout:  cx.Duration("timeout"),
+		Backoff:          values.Float64("backoff"),
+		CAHashTagName:    values.String("ca-hash-tag-name"),
+		Interval:         values.Duration("interval"),
+		Jitter:           values.Float64("jitter"),
+		MaxInterval:      values.Duration("max-interval"),
+		TagName:          values.String("tag-name"),
+		ThrottleInterval: values.Duration("throttle-interval"),
+		Timeout:          values.Duration("timeout"),
 	}
 	c, err := client.New(cfg, p)
 	if err != nil {
 		return err
 	}
 
+	if values.Bool("daemon") && values.Duration("daemon-interval") <= 0 {
+		return errors.New("the daemon interval must be positive")
+	}
+
+	// step: build the outputs before consuming the token
+	options := client.KubeconfigOptions{
+		ClusterName: values.String("cluster-name"),
+		ContextName: values.String("context-name"),
+		EmbedCA:     values.Bool("embed-ca"),
+		Format:      values.String("kubeconfig-format"),
+		UserName:    values.String("user-name"),
+	}
+	file := client.FileOptions{
+		Group: values.String("output-group"),
+		Owner: values.String("output-owner"),
+	}
+	if mode := values.String("output-mode"); mode != "" {
+		v, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || v > 0777 {
+			return fmt.Errorf("invalid output mode: %s", mode)
+		}
+		file.Mode = os.FileMode(v)
+	}
+	outputs, err := getClientOutputs(values, client.OutputOptions{
+		File:       file,
+		Kubeconfig: options,
+		Join: client.JoinOptions{
+			APIVersion:               values.String("kubeadm-api-version"),
+			CACertHashes:             values.StringSlice("discovery-token-ca-cert-hash"),
+			CAPath:                   values.String("ca-path"),
+			Master:                   values.String("master"),
+			PublishedCAHash:          values.String("ca-hash-tag-name") != "",
+			UnsafeSkipCAVerification: values.Bool("discovery-token-unsafe-skip-ca-verification"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// step: check the ca options too, any failure once the token is consumed strands the node
+	discovery := len(values.StringSlice("discovery-token-ca-cert-hash")) > 0 || values.Bool("discovery-token-unsafe-skip-ca-verification")
+	if values.String("ca-path") != "" && discovery {
+		return errors.New("you cannot use --ca-path with ca discovery")
+	}
+
 	// step: attempt to consume the client token
 	log.Infof("attempting to get registration token, timeout: %s, tag: %s", cfg.Timeout, cfg.TagName)
 	token, err := c.Start()
-	if err != nil {
-		if err != client.ErrConsumedToken {
-			return err
+	switch err {
+	case nil:
+		if err := writeClientOutputs(values, c, token, outputs); err != nil {
+			return releaseClientToken(c, err)
 		}
-		log.Warn("kubelet registration token already consumed, skipping kubeconfig")
-		return nil
+	case client.ErrConsumedToken:
+		log.Warn("kubelet registration token already consumed, skipping outputs")
+	default:
+		return err
+	}
+
+	if values.Bool("daemon") {
+		return runClientDaemon(values, c, outputs)
 	}
 
-	// step: get the inputs
-	masterURL := cx.String("master")
-	caPath := cx.String("ca-path")
-	kubeConfig := cx.String("kubeconfig")
+	return nil
+}
 
-	// step: ensure any directory structure for kube config
-	if err = os.MkdirAll(path.Dir(kubeConfig), os.FileMode(0775)); err != nil {
-		return err
+// runClientDaemon watches the kubelet credentials, requesting a new token and rewriting
+// the outputs once they have expired. We do not watch the node itself: should it be deleted
+// or its credentials refused, an administrator issues it a new token, which we pick up
+func runClientDaemon(values optionValues, c *client.Client, outputs []clientOutput) error {
+	filename := values.String("kubelet-credentials")
+	renewBefore := values.Duration("renew-before")
+	log.WithFields(log.Fields{
+		"credentials":  filename,
+		"interval":     values.Duration("daemon-interval").String(),
+		"renew-before": renewBefore.String(),
+	}).Info("running as a daemon, watching the kubelet credentials")
+
+	// step: we keep the certificate we last bootstrapped on, the kubelet has to pick up
+	// the new token before it changes
+	var bootstrapped []byte
+	for range time.Tick(values.Duration("daemon-interval")) {
+		// step: a token waiting in the tag has been issued to us, whatever our credentials
+		issued, err := c.Issued()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("unable to check for an issued registration token")
+			continue
+		}
+		if issued {
+			log.Warn("a registration token has been issued to the node, rewriting the outputs")
+			if err := renewClientOutputs(values, c, outputs); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Error("unable to renew the registration token")
+				continue
+			}
+			if certificate, err := client.ReadClientCertificate(filename); err == nil {
+				bootstrapped = certificate.Raw
+			}
+			continue
+		}
+
+		certificate, err := client.ReadClientCertificate(filename)
+		if err != nil {
+			if err != client.ErrNoCredentials {
+				log.WithFields(log.Fields{
+					"credentials": filename,
+					"error":       err.Error(),
+				}).Error("unable to read the kubelet credentials")
+			}
+			continue
+		}
+		if !client.NeedsBootstrap(certificate, renewBefore, time.Now()) || bytes.Equal(certificate.Raw, bootstrapped) {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"credentials": filename,
+			"expires":     certificate.NotAfter.String(),
+		}).Warn("kubelet credentials have expired, requesting a new registration token")
+
+		if err := c.Request(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("unable to request a new registration token")
+			continue
+		}
+		if err := renewClientOutputs(values, c, outputs); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("unable to renew the registration token")
+			continue
+		}
+		bootstrapped = certificate.Raw
 	}
 
-	// step: are we writing out a kube config?
-	log.Infof("retrieved registration token, writing kubeconfig: %s", kubeConfig)
-	content, err := client.GenerateKubeconfig(token, masterURL, caPath)
-	if err == nil {
-		if err = ioutil.WriteFile(kubeConfig, content, os.FileMode(0640)); err != nil {
+	return nil
+}
+
+// renewClientOutputs consumes the token waiting in the tag and rewrites the outputs with it
+func renewClientOutputs(values optionValues, c *client.Client, outputs []clientOutput) error {
+	token, err := c.Start()
+	if err != nil {
+		return fmt.Errorf("unable to retrieve a new registration token: %s", err)
+	}
+	if err := writeClientOutputs(values, c, token, outputs); err != nil {
+		return fmt.Errorf("unable to write the outputs: %s", err)
+	}
+
+	return nil
+}
+
+// writeClientOutputs resolves the cluster ca and hands the token to the outputs
+func writeClientOutputs(values optionValues, c *client.Client, token string, outputs []clientOutput) error {
+	var err error
+	result := client.Result{
+		CAPath:   values.String("ca-path"),
+		Master:   values.String("master"),
+		NodeName: values.String("node-name"),
+		Token:    token,
+	}
+
+	// step: are we discovering the ca from the cluster?
+	hashes := values.StringSlice("discovery-token-ca-cert-hash")
+	unsafeSkip := values.Bool("discovery-token-unsafe-skip-ca-verification")
+	if len(hashes) <= 0 && result.CAPath == "" && c.CACertHash() != "" {
+		log.Infof("using the ca hash published by the server: %s", c.CACertHash())
+		hashes = []string{c.CACertHash()}
+	}
+	if len(hashes) > 0 || unsafeSkip {
+		log.Infof("discovering the cluster ca from cluster-info: %s", result.Master)
+		result.CAData, err = c.DiscoverCA(client.DiscoveryOptions{
+			CACertHashes:             hashes,
+			Master:                   result.Master,
+			Token:                    token,
+			UnsafeSkipCAVerification: unsafeSkip,
+		})
+		if err != nil {
 			return err
 		}
+		result.CACertHashes = hashes
+	} else if result.CAPath == "" {
+		log.Warn("no ca path given and the server has not published a ca hash, the kubeconfig will skip tls verification")
+	}
+
+	// step: hand the token to the outputs
+	for i, x := range outputs {
+		log.Infof("retrieved registration token, writing output: %s", x.spec)
+		if err := x.output.Write(result); err != nil {
+			return fmt.Errorf("output %d (%s) failed: %s", i, x.spec, err)
+		}
 	}
 
 	return nil
 }
+
+// releaseClientToken asks the server for a new token once the outputs have failed, rather than
+// leaving the node with a consumed token it never used and a rerun finding nothing to do
+func releaseClientToken(c *client.Client, err error) error {
+	log.WithFields(log.Fields{
+		"error": err.Error(),
+	}).Error("unable to write the outputs, requesting a new registration token")
+
+	if rerr := c.Request(); rerr != nil {
+		log.WithFields(log.Fields{
+			"error": rerr.Error(),
+		}).Error("unable to request a new registration token")
+	}
+
+	return err
+}
+
+// clientOutput is an output and the specification it was built from
+type clientOutput struct {
+	spec   string
+	output client.Output
+}
+
+// getClientOutputs builds the outputs, defaulting to the kubeconfig
+func getClientOutputs(values optionValues, options client.OutputOptions) ([]clientOutput, error) {
+	specs := values.StringSlice("output")
+	if len(specs) <= 0 {
+		specs = []string{client.OutputKubeconfig + "=" + values.String("kubeconfig")}
+	}
+	if filename := values.String("kubeadm-config"); filename != "" {
+		specs = append(specs, client.OutputKubeadm+"="+filename)
+	}
+
+	var list []clientOutput
+	for _, x := range specs {
+		output, err := client.NewOutput(x, options)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, clientOutput{spec: x, output: output})
+	}
+
+	return list, nil
+}
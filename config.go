@@ -0,0 +1,437 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ghodss/yaml"
+	"github.com/urfave/cli"
+)
+
+var (
+	// configSections are the sections of the configuration file, named after the commands
+	configSections = []string{"client", "server"}
+	// sharedServerOptions are the server options which apply to the process, rather than a profile
+	sharedServerOptions = []string{"cache-negative-ttl", "cache-pools-ttl", "cache-tags-ttl", "metrics-listen", "once"}
+)
+
+// optionValues are the values of the command options, satisfied by the cli context itself
+type optionValues interface {
+	Bool(string) bool
+	Duration(string) time.Duration
+	Float64(string) float64
+	Int(string) int
+	String(string) string
+	StringSlice(string) []string
+}
+
+// configValues resolves the command options from the command line, falling back to the
+// configuration file and then the flag defaults
+type configValues struct {
+	cx *cli.Context
+	// profile are the options of the cluster profile, taking precedence over all others
+	profile map[string]interface{}
+	// profiles are the cluster profiles given in the server section
+	profiles []configProfile
+	// values are the options from the configuration file, converted to the flag types
+	values map[string]interface{}
+}
+
+// configProfile is a named set of options for a cluster, overriding the shared options
+type configProfile struct {
+	name   string
+	values map[string]interface{}
+}
+
+// loadConfigValues reads the section of the configuration file given by --config, the keys
+// being the option names of the command. The file is validated against the flags of the
+// command; unknown options and values of the wrong type are rejected
+func loadConfigValues(cx *cli.Context, section string) (*configValues, error) {
+	return loadConfigSection(cx, section, cx.Command)
+}
+
+// loadConfigSection reads the section of the configuration file, validated against the flags
+// of the command owning the section rather than the one running
+func loadConfigSection(cx *cli.Context, section string, command cli.Command) (*configValues, error) {
+	c := &configValues{cx: cx, values: make(map[string]interface{}, 0)}
+	filename := cx.String("config")
+	if filename == "" {
+		return c, nil
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	// step: the file may be either yaml or json
+	file := make(map[string]map[string]interface{}, 0)
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("config: unable to parse %s, error: %s", filename, err)
+	}
+	for name := range file {
+		if !containedIn(name, configSections) {
+			return nil, fmt.Errorf("config: unknown section: %s, expected one of: %s", name, strings.Join(configSections, ", "))
+		}
+	}
+
+	options := file[section]
+	if section == "server" {
+		if c.profiles, err = convertConfigProfiles(command, options["profiles"]); err != nil {
+			return nil, err
+		}
+		delete(options, "profiles")
+	}
+	if c.values, err = convertConfigOptions(command, section, options); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Profiles returns the names of the cluster profiles, in the order given
+func (c *configValues) Profiles() []string {
+	var list []string
+	for _, x := range c.profiles {
+		list = append(list, x.name)
+	}
+
+	return list
+}
+
+// Profile returns the values for the cluster profile
+func (c *configValues) Profile(name string) (*configValues, bool) {
+	for _, x := range c.profiles {
+		if x.name == name {
+			return &configValues{cx: c.cx, profile: x.values, values: c.values}, true
+		}
+	}
+
+	return nil, false
+}
+
+// convertConfigProfiles validates and converts the cluster profiles, each being a list of
+// server options with a unique name
+func convertConfigProfiles(command cli.Command, value interface{}) ([]configProfile, error) {
+	if value == nil {
+		return nil, nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config: server.profiles must be a list")
+	}
+	var list []configProfile
+	for i, x := range items {
+		options, ok := x.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("config: server.profiles[%d] must be a map of options", i)
+		}
+		name, ok := options["name"].(string)
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("config: server.profiles[%d] must have a name", i)
+		}
+		for _, p := range list {
+			if p.name == name {
+				return nil, fmt.Errorf("config: server.profiles[%d] duplicate profile name: %s", i, name)
+			}
+		}
+		delete(options, "name")
+		for k := range options {
+			if containedIn(k, sharedServerOptions) {
+				return nil, fmt.Errorf("config: server.profiles[%d].%s is shared by the profiles, set it in the server section", i, k)
+			}
+		}
+		values, err := convertConfigOptions(command, fmt.Sprintf("server.profiles[%d]", i), options)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, configProfile{name: name, values: values})
+	}
+
+	return list, nil
+}
+
+// convertConfigOptions validates and converts the options against the flags of the command
+func convertConfigOptions(command cli.Command, path string, options map[string]interface{}) (map[string]interface{}, error) {
+	flags := make(map[string]cli.Flag, 0)
+	for _, x := range command.Flags {
+		flags[getFlagName(x)] = x
+	}
+	var keys []string
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make(map[string]interface{}, 0)
+	for _, k := range keys {
+		flag, found := flags[k]
+		if !found || k == "config" {
+			return nil, fmt.Errorf("config: %s.%s is not a %s option", path, k, command.Name)
+		}
+		v, err := convertConfigValue(flag, options[k])
+		if err != nil {
+			return nil, fmt.Errorf("config: %s.%s %s", path, k, err)
+		}
+		values[k] = v
+	}
+
+	return values, nil
+}
+
+// Bool returns the value of the option
+func (c *configValues) Bool(name string) bool {
+	if v, found := c.lookup(name); found {
+		return v.(bool)
+	}
+
+	return c.cx.Bool(name)
+}
+
+// Duration returns the value of the option
+func (c *configValues) Duration(name string) time.Duration {
+	if v, found := c.lookup(name); found {
+		return v.(time.Duration)
+	}
+
+	return c.cx.Duration(name)
+}
+
+// Float64 returns the value of the option
+func (c *configValues) Float64(name string) float64 {
+	if v, found := c.lookup(name); found {
+		return v.(float64)
+	}
+
+	return c.cx.Float64(name)
+}
+
+// Int returns the value of the option
+func (c *configValues) Int(name string) int {
+	if v, found := c.lookup(name); found {
+		return v.(int)
+	}
+
+	return c.cx.Int(name)
+}
+
+// String returns the value of the option
+func (c *configValues) String(name string) string {
+	if v, found := c.lookup(name); found {
+		return v.(string)
+	}
+
+	return c.cx.String(name)
+}
+
+// StringSlice returns the value of the option
+func (c *configValues) StringSlice(name string) []string {
+	if v, found := c.lookup(name); found {
+		return v.([]string)
+	}
+
+	return c.cx.StringSlice(name)
+}
+
+// lookup returns the value of the option from the configuration, in order of precedence the
+// cluster profile, the command line or environment (reported as not found, leaving them to the
+// cli) and then the rest of the configuration file. A profile names the cluster it manages, so
+// an ambient environment variable must not point it elsewhere; checkProfile refuses a command
+// line which contradicts it
+func (c *configValues) lookup(name string) (interface{}, bool) {
+	if v, found := c.profile[name]; found {
+		return v, true
+	}
+	if c.cx.IsSet(name) || c.isEnvSet(name) {
+		return nil, false
+	}
+	v, found := c.values[name]
+
+	return v, found
+}
+
+// checkProfile refuses options given on the command line which contradict the cluster profile,
+// logging those from the environment which the profile overrides
+func (c *configValues) checkProfile() error {
+	var keys []string
+	for k := range c.profile {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !c.cx.IsSet(k) || reflect.DeepEqual(c.profile[k], c.cliValue(k)) {
+			continue
+		}
+		if c.isEnvSet(k) {
+			log.WithFields(log.Fields{
+				"option": k,
+			}).Warn("ignoring the environment, the option is set by the cluster profile")
+			continue
+		}
+
+		return fmt.Errorf("option: %s given on the command line conflicts with the cluster profile", k)
+	}
+
+	return nil
+}
+
+// cliValue returns the value of the option from the command line, environment or defaults
+func (c *configValues) cliValue(name string) interface{} {
+	for _, x := range c.cx.Command.Flags {
+		if getFlagName(x) != name {
+			continue
+		}
+		switch x.(type) {
+		case cli.BoolFlag:
+			return c.cx.Bool(name)
+		case cli.DurationFlag:
+			return c.cx.Duration(name)
+		case cli.Float64Flag:
+			return c.cx.Float64(name)
+		case cli.IntFlag:
+			return c.cx.Int(name)
+		case cli.StringFlag:
+			return c.cx.String(name)
+		case cli.StringSliceFlag:
+			return c.cx.StringSlice(name)
+		}
+	}
+
+	return nil
+}
+
+// isEnvSet checks if the option has been given by the environment
+func (c *configValues) isEnvSet(name string) bool {
+	for _, x := range c.cx.Command.Flags {
+		if getFlagName(x) == name && isEnvSet(getFlagEnvVar(x)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// convertConfigValue converts the value from the configuration file to the type of the flag
+func convertConfigValue(flag cli.Flag, value interface{}) (interface{}, error) {
+	switch flag.(type) {
+	case cli.BoolFlag:
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("must be a boolean")
+	case cli.DurationFlag:
+		v, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a duration i.e. 30s")
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("must be a duration i.e. 30s, error: %s", err)
+		}
+		return d, nil
+	case cli.Float64Flag:
+		if v, ok := value.(float64); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("must be a number")
+	case cli.IntFlag:
+		if v, ok := value.(float64); ok && v == math.Trunc(v) {
+			return int(v), nil
+		}
+		return nil, fmt.Errorf("must be an integer")
+	case cli.StringFlag:
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("must be a string")
+	case cli.StringSliceFlag:
+		switch v := value.(type) {
+		case string:
+			return []string{v}, nil
+		case []interface{}:
+			var list []string
+			for _, x := range v {
+				s, ok := x.(string)
+				if !ok {
+					return nil, fmt.Errorf("must be a list of strings")
+				}
+				list = append(list, s)
+			}
+			return list, nil
+		}
+		return nil, fmt.Errorf("must be a string or a list of strings")
+	}
+
+	return nil, fmt.Errorf("cannot be set in the configuration file")
+}
+
+// getFlagName returns the long name of the flag
+func getFlagName(flag cli.Flag) string {
+	names := strings.Split(flag.GetName(), ",")
+
+	return strings.TrimSpace(names[len(names)-1])
+}
+
+// getFlagEnvVar returns the environment variables of the flag
+func getFlagEnvVar(flag cli.Flag) string {
+	switch f := flag.(type) {
+	case cli.BoolFlag:
+		return f.EnvVar
+	case cli.DurationFlag:
+		return f.EnvVar
+	case cli.Float64Flag:
+		return f.EnvVar
+	case cli.IntFlag:
+		return f.EnvVar
+	case cli.StringFlag:
+		return f.EnvVar
+	case cli.StringSliceFlag:
+		return f.EnvVar
+	}
+
+	return ""
+}
+
+// isEnvSet checks if any of the comma separated environment variables are set
+func isEnvSet(names string) bool {
+	for _, x := range strings.Split(names, ",") {
+		if x = strings.TrimSpace(x); x != "" && os.Getenv(x) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containedIn checks if the value is in the list
+func containedIn(value string, list []string) bool {
+	for _, x := range list {
+		if x == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+func TestConfigValuesLookup(t *testing.T) {
+	os.Setenv("TEST_CONFIG_KUBECONFIG", "/environment/kubeconfig")
+	defer os.Unsetenv("TEST_CONFIG_KUBECONFIG")
+	cx := newFakeConfigContext(t, "--tag-name", "CommandLine", "--token-ttl", "1m")
+
+	c := &configValues{
+		cx: cx,
+		profile: map[string]interface{}{
+			"kubeconfig": "/profile/kubeconfig",
+			"token-ttl":  time.Minute,
+		},
+		values: map[string]interface{}{
+			"kubeconfig":      "/file/kubeconfig",
+			"tag-name":        "File",
+			"token-ttl":       time.Second,
+			"token-namespace": "file",
+		},
+	}
+	// step: the profile beats the environment, the command line beats the file
+	assert.Equal(t, "/profile/kubeconfig", c.String("kubeconfig"))
+	assert.Equal(t, time.Minute, c.Duration("token-ttl"))
+	assert.Equal(t, "CommandLine", c.String("tag-name"))
+	assert.Equal(t, "file", c.String("token-namespace"))
+	assert.NoError(t, c.checkProfile())
+
+	// step: without a profile the environment beats the file, which beats the defaults
+	c.profile = nil
+	assert.Equal(t, "/environment/kubeconfig", c.String("kubeconfig"))
+	delete(c.values, "token-namespace")
+	assert.Equal(t, "kube-system", c.String("token-namespace"))
+}
+
+func TestConfigValuesCheckProfile(t *testing.T) {
+	os.Setenv("TEST_CONFIG_KUBECONFIG", "/environment/kubeconfig")
+	defer os.Unsetenv("TEST_CONFIG_KUBECONFIG")
+	cs := []struct {
+		Args    []string
+		Profile map[string]interface{}
+		Ok      bool
+	}{
+		{Profile: map[string]interface{}{"tag-name": "Profile"}, Ok: true},
+		// the environment is overridden by the profile
+		{Profile: map[string]interface{}{"kubeconfig": "/profile/kubeconfig"}, Ok: true},
+		{Args: []string{"--tag-name", "Profile"}, Profile: map[string]interface{}{"tag-name": "Profile"}, Ok: true},
+		{Args: []string{"--tag-name", "CommandLine"}, Profile: map[string]interface{}{"tag-name": "Profile"}},
+		{Args: []string{"--token-ttl", "1h"}, Profile: map[string]interface{}{"token-ttl": time.Minute}},
+	}
+	for i, x := range cs {
+		c := &configValues{cx: newFakeConfigContext(t, x.Args...), profile: x.Profile}
+		err := c.checkProfile()
+		if x.Ok {
+			assert.NoError(t, err, "case %d should not have thrown error", i)
+			continue
+		}
+		assert.Error(t, err, "case %d should have thrown an error", i)
+	}
+}
+
+func newFakeConfigContext(t *testing.T, args ...string) *cli.Context {
+	command := cli.Command{
+		Name: "server",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "kubeconfig", EnvVar: "TEST_CONFIG_KUBECONFIG"},
+			cli.StringFlag{Name: "tag-name", Value: "KubeletToken"},
+			cli.DurationFlag{Name: "token-ttl", Value: time.Hour},
+			cli.StringFlag{Name: "token-namespace", Value: "kube-system"},
+		},
+	}
+	set := flag.NewFlagSet("server", flag.ContinueOnError)
+	for _, x := range command.Flags {
+		x.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatalf("unable to parse the arguments: %s", err)
+	}
+	cx := cli.NewContext(nil, set, nil)
+	cx.Command = command
+
+	return cx
+}
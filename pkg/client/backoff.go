@@ -0,0 +1,99 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff provides the intervals between checks, growing exponentially with jitter
+// so a group of nodes launched together drift apart rather than polling in lock-step
+type backoff struct {
+	// current is the interval before jitter
+	current time.Duration
+	// max is the ceiling on the interval
+	max time.Duration
+	// factor is the multiplier applied after each interval
+	factor float64
+	// jitter is the fraction the interval is varied by
+	jitter float64
+	// throttle is the minimum interval after being throttled
+	throttle time.Duration
+	// random is the source for the jitter
+	random *rand.Rand
+}
+
+// newBackoff creates a backoff from the client configuration
+func newBackoff(c Config) *backoff {
+	b := &backoff{
+		current:  c.Interval,
+		factor:   c.Backoff,
+		jitter:   c.Jitter,
+		max:      c.MaxInterval,
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		throttle: c.ThrottleInterval,
+	}
+	if b.factor < 1 {
+		b.factor = 1
+	}
+	if b.max <= 0 {
+		b.max = c.Interval
+	}
+	if b.throttle <= 0 {
+		b.throttle = b.max
+	}
+
+	return b
+}
+
+// Next returns the next interval and grows the backoff
+func (b *backoff) Next() time.Duration {
+	interval := b.jittered(b.current)
+	b.current = b.cap(time.Duration(float64(b.current) * b.factor))
+
+	return interval
+}
+
+// Throttled returns the interval after being throttled, no shorter than the throttle interval
+func (b *backoff) Throttled() time.Duration {
+	if b.current < b.throttle {
+		b.current = b.throttle
+	}
+
+	return b.Next()
+}
+
+// jittered randomly varies the interval by the jitter either way, within the ceiling
+func (b *backoff) jittered(interval time.Duration) time.Duration {
+	if b.jitter <= 0 {
+		return interval
+	}
+	delta := float64(interval) * b.jitter
+	interval = time.Duration(float64(interval) - delta + b.random.Float64()*2*delta)
+
+	return b.cap(interval)
+}
+
+// cap ensures the interval is within the ceiling
+func (b *backoff) cap(interval time.Duration) time.Duration {
+	if interval > b.max || interval < 0 {
+		return b.max
+	}
+
+	return interval
+}
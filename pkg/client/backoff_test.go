@@ -0,0 +1,74 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffNext(t *testing.T) {
+	b := newBackoff(Config{
+		Backoff:     2,
+		Interval:    time.Second,
+		MaxInterval: 10 * time.Second,
+	})
+	var intervals []time.Duration
+	for i := 0; i < 6; i++ {
+		intervals = append(intervals, b.Next())
+	}
+	assert.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second,
+	}, intervals)
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	b := newBackoff(Config{Interval: time.Second})
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, time.Second, b.Next())
+	}
+	assert.Equal(t, time.Second, b.Throttled())
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := newBackoff(Config{
+		Backoff:     1,
+		Interval:    10 * time.Second,
+		Jitter:      0.5,
+		MaxInterval: 12 * time.Second,
+	})
+	for i := 0; i < 100; i++ {
+		interval := b.Next()
+		assert.True(t, interval >= 5*time.Second, "interval %s below the jitter", interval)
+		assert.True(t, interval <= 12*time.Second, "interval %s above the max interval", interval)
+	}
+}
+
+func TestBackoffThrottled(t *testing.T) {
+	b := newBackoff(Config{
+		Backoff:          2,
+		Interval:         time.Second,
+		MaxInterval:      time.Minute,
+		ThrottleInterval: 20 * time.Second,
+	})
+	assert.Equal(t, time.Second, b.Next())
+	assert.Equal(t, 20*time.Second, b.Throttled())
+	assert.Equal(t, 40*time.Second, b.Next())
+	assert.Equal(t, time.Minute, b.Throttled())
+}
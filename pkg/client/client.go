@@ -17,21 +17,21 @@ limitations under the License.
 package client
 
 import (
+	"context"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"time"
 
 	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/ghodss/yaml"
 	api "k8s.io/client-go/tools/clientcmd/api/v1"
 )
 
-const (
-	// CompletedTagValue indicates the client has processed the token
-	CompletedTagValue = "Success"
-)
-
 var (
 	// ErrTimedOut means the operation has timed out
 	ErrTimedOut = errors.New("operation timed out")
@@ -43,6 +43,8 @@ var (
 type Client struct {
 	config Config
 	client cloud.Provider
+	// caHash is the ca hash published alongside the token
+	caHash string
 }
 
 // New creates a new client
@@ -56,43 +58,111 @@ func New(cfg Config, provider cloud.Provider) (*Client, error) {
 
 // Start is responsible for retrieving the tokens from instance tags
 func (c *Client) Start() (string, error) {
-	var tmCh <-chan time.Time
-	if c.config.Timeout > 0 {
-		tmCh = time.After(c.config.Timeout)
-	}
-	intervalCh := time.NewTicker(1)
-	firstTime := true
+	ctx, cancel := c.newContext()
+	defer cancel()
+	b := newBackoff(c.config)
+	// step: the first check is immediate
+	interval := time.Duration(0)
 
 	for {
 		select {
-		case <-intervalCh.C:
-			if firstTime {
-				firstTime = false
-				intervalCh.Stop()
-				intervalCh = time.NewTicker(c.config.Interval)
-			}
-			token, found, err := c.consumeKubeletToken()
-			if err == nil && found {
+		case <-time.After(interval):
+			token, found, err := c.consumeKubeletToken(ctx)
+			switch {
+			case err == nil && found:
 				return token, nil
-			}
-			if err == ErrConsumedToken {
+			case err == ErrConsumedToken:
 				return "", ErrConsumedToken
+			case ctx.Err() != nil:
+				return "", ErrTimedOut
+			case cloud.IsPermanent(err):
+				// no amount of retrying will fix bad credentials or misconfiguration
+				return "", err
+			case cloud.IsThrottled(err):
+				interval = b.Throttled()
+				log.WithFields(log.Fields{
+					"interval": interval.String(),
+				}).Warn("provider is throttling our requests, backing off")
+			default:
+				interval = b.Next()
+				log.WithFields(log.Fields{
+					"interval": interval.String(),
+				}).Debug("waiting for the registration token")
 			}
-		case <-tmCh:
+		case <-ctx.Done():
 			return "", ErrTimedOut
 		}
 	}
 }
 
+// CACertHash returns the cluster ca hash published alongside the token, if any
+func (c *Client) CACertHash() string {
+	return c.caHash
+}
+
+// Request resets the tag, asking the server to issue a new token
+func (c *Client) Request() error {
+	ctx, cancel := c.newContext()
+	defer cancel()
+
+	nodeID, err := c.client.GetNodeID(ctx)
+	if err != nil {
+		return err
+	}
+	err = cloud.SetNodeTagIf(ctx, c.client, nodeID, c.config.TagName, cloud.CompletedTagValue, cloud.RequestTagValue)
+	if err == cloud.ErrTagChanged {
+		// a token is already waiting or the tag is gone, either way one will be issued
+		log.WithFields(log.Fields{
+			"id":  nodeID,
+			"tag": c.config.TagName,
+		}).Debug("token has not been consumed, skipping the request")
+
+		return nil
+	}
+
+	return err
+}
+
+// Issued checks if a token we have yet to consume is waiting in the tag, as written by the
+// server or an administrator issuing one to the node
+func (c *Client) Issued() (bool, error) {
+	ctx, cancel := c.newContext()
+	defer cancel()
+
+	nodeID, err := c.client.GetNodeID(ctx)
+	if err != nil {
+		return false, err
+	}
+	value, found, err := c.client.GetNodeTag(ctx, nodeID, c.config.TagName)
+	if err != nil || !found {
+		return false, err
+	}
+	switch value {
+	case cloud.CompletedTagValue, cloud.RequestTagValue, cloud.RevokedTagValue:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// newContext returns a context bounded by the timeout, if any
+func (c *Client) newContext() (context.Context, context.CancelFunc) {
+	if c.config.Timeout > 0 {
+		return context.WithTimeout(context.Background(), c.config.Timeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
 // consumeKubeletToken is responsible for consuming the kubelet registration token
-func (c *Client) consumeKubeletToken() (string, bool, error) {
+func (c *Client) consumeKubeletToken(ctx context.Context) (string, bool, error) {
 	// step: get our instance id
-	nodeID, err := c.client.GetNodeID()
+	nodeID, err := c.client.GetNodeID(ctx)
 	if err != nil {
 		return "", false, err
 	}
 	// step: retrieve the tags for this node
-	token, found, err := c.client.GetNodeTag(nodeID, c.config.TagName)
+	token, found, err := c.client.GetNodeTag(ctx, nodeID, c.config.TagName)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"id":    nodeID,
@@ -101,7 +171,7 @@ func (c *Client) consumeKubeletToken() (string, bool, error) {
 
 		return "", false, err
 	}
-	if !found {
+	if !found || token == cloud.RequestTagValue {
 		log.WithFields(log.Fields{
 			"id":  nodeID,
 			"tag": c.config.TagName,
@@ -109,8 +179,17 @@ func (c *Client) consumeKubeletToken() (string, bool, error) {
 
 		return "", false, nil
 	}
+	// step: an administrator has revoked the token, wait for them to issue another
+	if token == cloud.RevokedTagValue {
+		log.WithFields(log.Fields{
+			"id":  nodeID,
+			"tag": c.config.TagName,
+		}).Warn("registration token has been revoked, waiting for another to be issued")
+
+		return "", false, nil
+	}
 	// step: check the token hasn't been consumed already
-	if token == CompletedTagValue {
+	if token == cloud.CompletedTagValue {
 		return "", false, ErrConsumedToken
 	}
 
@@ -119,12 +198,28 @@ func (c *Client) consumeKubeletToken() (string, bool, error) {
 		"tag": c.config.TagName,
 	}).Info("found kubelet registration token")
 
-	// step: update the tag to indicate we are done
-	updateTags := cloud.NodeTags{
-		c.config.TagName: CompletedTagValue,
+	// step: retrieve the ca hash published with the token if any
+	if c.config.CAHashTagName != "" {
+		hash, found, err := c.client.GetNodeTag(ctx, nodeID, c.config.CAHashTagName)
+		if err != nil {
+			return "", false, err
+		}
+		// step: an empty value means the server has not signed the cluster-info for this token
+		if found && hash != "" {
+			c.caHash = hash
+		}
 	}
 
-	if err := c.client.SetNodeTags(nodeID, updateTags); err != nil {
+	// step: update the tag to indicate we are done, provided no one has beaten us to it
+	if err := cloud.SetNodeTagIf(ctx, c.client, nodeID, c.config.TagName, token, cloud.CompletedTagValue); err != nil {
+		if err == cloud.ErrTagChanged {
+			log.WithFields(log.Fields{
+				"id":  nodeID,
+				"tag": c.config.TagName,
+			}).Warn("registration token changed while consuming, retrying")
+
+			return "", false, nil
+		}
 		log.WithFields(log.Fields{
 			"id":    nodeID,
 			"error": err.Error(),
@@ -137,23 +232,36 @@ func (c *Client) consumeKubeletToken() (string, bool, error) {
 }
 
 // GenerateKubeconfig generates a bootstrap kubeconfig for us
-func GenerateKubeconfig(token, master, caPath string) ([]byte, error) {
-	cluster := api.Cluster{
-		Server:               master,
-		CertificateAuthority: caPath,
+func GenerateKubeconfig(options KubeconfigOptions) ([]byte, error) {
+	if err := options.IsValid(); err != nil {
+		return nil, err
 	}
-	if caPath == "" {
+
+	cluster := api.Cluster{Server: options.Master}
+	switch {
+	case len(options.CAData) > 0:
+		cluster.CertificateAuthorityData = options.CAData
+	case options.CAPath == "":
 		cluster.InsecureSkipTLSVerify = true
+	case options.EmbedCA:
+		data, err := readCertificateAuthority(options.CAPath)
+		if err != nil {
+			return nil, err
+		}
+		cluster.CertificateAuthorityData = data
+	default:
+		cluster.CertificateAuthority = options.CAPath
 	}
 
-	name := "bootstrap-context"
-	clusterName := "cluster"
+	name := defaultString(options.ContextName, "bootstrap-context")
+	clusterName := defaultString(options.ClusterName, "cluster")
+	userName := defaultString(options.UserName, name)
 
 	cfg := api.Config{
 		APIVersion: "v1",
 		Kind:       "Config",
 		AuthInfos: []api.NamedAuthInfo{
-			{Name: name, AuthInfo: api.AuthInfo{Token: token}},
+			{Name: userName, AuthInfo: api.AuthInfo{Token: options.Token}},
 		},
 		Clusters: []api.NamedCluster{
 			{Name: clusterName, Cluster: cluster},
@@ -161,11 +269,37 @@ func GenerateKubeconfig(token, master, caPath string) ([]byte, error) {
 		Contexts: []api.NamedContext{
 			{
 				Name:    name,
-				Context: api.Context{Cluster: clusterName, AuthInfo: name},
+				Context: api.Context{Cluster: clusterName, AuthInfo: userName},
 			},
 		},
 		CurrentContext: name,
 	}
 
+	if options.Format == FormatYAML {
+		return yaml.Marshal(&cfg)
+	}
+
 	return json.MarshalIndent(&cfg, "", "  ")
 }
+
+// readCertificateAuthority reads and checks the ca certificate
+func readCertificateAuthority(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("ca: %s does not contain a pem encoded certificate", filename)
+	}
+
+	return data, nil
+}
+
+// defaultString returns the value or the default if empty
+func defaultString(v, d string) string {
+	if v == "" {
+		return d
+	}
+
+	return v
+}
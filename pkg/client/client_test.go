@@ -17,8 +17,11 @@ limitations under the License.
 package client
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"io/ioutil"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -56,13 +59,98 @@ func TestConsumeToken(t *testing.T) {
 	token, err := client.Start()
 	assert.NoError(t, err)
 	assert.Equal(t, "test-token", token)
+	v, found, err := p.GetNodeTag(context.Background(), "test-node", c.TagName)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, cloud.CompletedTagValue, v)
+}
+
+func TestConsumeTokenCAHash(t *testing.T) {
+	p := newFakeProvider("test-node", cloud.NodeTags{
+		"KubeToken":     "test-token",
+		"KubeletCAHash": "sha256:test",
+	})
+	c := newFakeConfig()
+	c.CAHashTagName = "KubeletCAHash"
+	client, err := New(c, p)
+	if !assert.NoError(t, err) {
+		return
+	}
+	token, err := client.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, "test-token", token)
+	assert.Equal(t, "sha256:test", client.CACertHash())
+
+	// step: an empty hash means the server has not signed the cluster-info
+	p = newFakeProvider("test-node", cloud.NodeTags{"KubeToken": "test-token", "KubeletCAHash": ""})
+	client, err = New(c, p)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = client.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, "", client.CACertHash())
+}
+
+func TestClientThrottled(t *testing.T) {
+	p := &throttlingProvider{
+		Provider: newFakeProvider("test-node", cloud.NodeTags{"KubeToken": "test-token"}),
+		throttle: 2,
+	}
+	c := newFakeConfig()
+	c.Interval = time.Duration(10) * time.Millisecond
+	c.MaxInterval = time.Duration(50) * time.Millisecond
+	c.Timeout = time.Duration(5) * time.Second
+	client, err := New(c, p)
+	if !assert.NoError(t, err) {
+		return
+	}
+	token, err := client.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, "test-token", token)
+	assert.Equal(t, 0, p.throttle)
+}
+
+func TestClientPermanentError(t *testing.T) {
+	denied := cloud.NewError(cloud.Unauthorized, errors.New("access denied"))
+	p := &failingProvider{Provider: newFakeProviderSetup(), err: denied}
+	c := newFakeConfig()
+	c.Timeout = time.Duration(5) * time.Second
+	client, err := New(c, p)
+	if !assert.NoError(t, err) {
+		return
+	}
+	token, err := client.Start()
+	assert.Empty(t, token)
+	assert.Equal(t, denied, err)
+}
+
+func TestClientTimeoutBoundsCalls(t *testing.T) {
+	p := &blockingProvider{Provider: newFakeProviderSetup()}
+	c := newFakeConfig()
+	c.Timeout = time.Duration(50) * time.Millisecond
+	client, err := New(c, p)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doneCh := make(chan error)
+	go func() {
+		_, err := client.Start()
+		doneCh <- err
+	}()
+	select {
+	case err := <-doneCh:
+		assert.Equal(t, ErrTimedOut, err)
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Error("the timeout did not interrupt the call")
+	}
 }
 
 func TestClientTokenConsumed(t *testing.T) {
 	p := newFakeProvider("test-node", cloud.NodeTags{
 		"Name":      "test-id",
 		"Role":      "compute",
-		"KubeToken": CompletedTagValue,
+		"KubeToken": cloud.CompletedTagValue,
 	})
 	c, err := New(newFakeConfig(), p)
 	assert.NotNil(t, c)
@@ -73,6 +161,49 @@ func TestClientTokenConsumed(t *testing.T) {
 	assert.Equal(t, ErrConsumedToken.Error(), err.Error())
 }
 
+func TestClientTokenRevoked(t *testing.T) {
+	p := newFakeProvider("test-node", cloud.NodeTags{
+		"Name":      "test-id",
+		"Role":      "compute",
+		"KubeToken": cloud.RevokedTagValue,
+	})
+	c := newFakeConfig()
+	c.Interval = time.Duration(10) * time.Millisecond
+	c.Timeout = time.Duration(100) * time.Millisecond
+	client, err := New(c, p)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// step: the client waits for another token rather than consuming the marker
+	token, err := client.Start()
+	assert.Empty(t, token)
+	assert.Equal(t, ErrTimedOut, err)
+	v, _, _ := p.GetNodeTag(context.Background(), "test-node", "KubeToken")
+	assert.Equal(t, cloud.RevokedTagValue, v)
+}
+
+func TestClientIssued(t *testing.T) {
+	cs := []struct {
+		Tags     cloud.NodeTags
+		Expected bool
+	}{
+		{Tags: cloud.NodeTags{}},
+		{Tags: cloud.NodeTags{"KubeToken": cloud.CompletedTagValue}},
+		{Tags: cloud.NodeTags{"KubeToken": cloud.RequestTagValue}},
+		{Tags: cloud.NodeTags{"KubeToken": cloud.RevokedTagValue}},
+		{Tags: cloud.NodeTags{"KubeToken": "abcdef.0123456789abcdef"}, Expected: true},
+	}
+	for i, x := range cs {
+		client, err := New(newFakeConfig(), newFakeProvider("test-node", x.Tags))
+		if !assert.NoError(t, err) {
+			return
+		}
+		issued, err := client.Issued()
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, x.Expected, issued, "case %d", i)
+	}
+}
+
 func TestClientTokenWaiting(t *testing.T) {
 	p := newFakeProviderSetup()
 	c := newFakeConfig()
@@ -83,7 +214,7 @@ func TestClientTokenWaiting(t *testing.T) {
 	assert.NoError(t, err)
 	go func() {
 		<-time.After(time.Duration(100) * time.Millisecond)
-		p.SetNodeTags("test-node", cloud.NodeTags{
+		p.SetNodeTags(context.Background(), "test-node", cloud.NodeTags{
 			c.TagName: "test",
 		})
 	}()
@@ -92,6 +223,38 @@ func TestClientTokenWaiting(t *testing.T) {
 	assert.Equal(t, "test", token)
 }
 
+func TestClientRequest(t *testing.T) {
+	p := newFakeProvider("test-node", cloud.NodeTags{
+		"KubeToken": cloud.CompletedTagValue,
+	})
+	c := newFakeConfig()
+	c.Interval = time.Duration(10) * time.Millisecond
+	c.Timeout = time.Duration(5) * time.Second
+	client, err := New(c, p)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, client.Request())
+	v, _, _ := p.GetNodeTag(context.Background(), "test-node", c.TagName)
+	assert.Equal(t, cloud.RequestTagValue, v)
+
+	// step: a token which has not been consumed is left alone
+	p.SetNodeTags(context.Background(), "test-node", cloud.NodeTags{c.TagName: "test"})
+	assert.NoError(t, client.Request())
+	v, _, _ = p.GetNodeTag(context.Background(), "test-node", c.TagName)
+	assert.Equal(t, "test", v)
+
+	// step: the client waits for the server to issue a token
+	p.SetNodeTags(context.Background(), "test-node", cloud.NodeTags{c.TagName: cloud.RequestTagValue})
+	go func() {
+		<-time.After(time.Duration(100) * time.Millisecond)
+		p.SetNodeTags(context.Background(), "test-node", cloud.NodeTags{c.TagName: "new-token"})
+	}()
+	token, err := client.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, "new-token", token)
+}
+
 func TestConfigIsValid(t *testing.T) {
 	cs := []struct {
 		config Config
@@ -106,6 +269,46 @@ func TestConfigIsValid(t *testing.T) {
 			},
 			Ok: true,
 		},
+		{
+			config: Config{
+				Backoff:          2,
+				Interval:         time.Duration(5) * time.Second,
+				Jitter:           0.2,
+				MaxInterval:      time.Duration(2) * time.Minute,
+				TagName:          "KubeToken",
+				ThrottleInterval: time.Duration(1) * time.Minute,
+			},
+			Ok: true,
+		},
+		{
+			config: Config{
+				Interval:    time.Duration(10) * time.Second,
+				MaxInterval: time.Duration(5) * time.Second,
+				TagName:     "KubeToken",
+			},
+		},
+		{
+			config: Config{
+				Backoff:  0.5,
+				Interval: time.Duration(10) * time.Second,
+				TagName:  "KubeToken",
+			},
+		},
+		{
+			config: Config{
+				Interval: time.Duration(10) * time.Second,
+				Jitter:   1.5,
+				TagName:  "KubeToken",
+			},
+		},
+		{
+			config: Config{
+				Interval:         time.Duration(10) * time.Second,
+				MaxInterval:      time.Duration(1) * time.Minute,
+				TagName:          "KubeToken",
+				ThrottleInterval: time.Duration(2) * time.Minute,
+			},
+		},
 	}
 	for i, c := range cs {
 		err := c.config.IsValid()
@@ -140,7 +343,7 @@ func TestGenerateKubeConfig(t *testing.T) {
 		},
 	}
 	for i, c := range cs {
-		config, err := GenerateKubeconfig(c.Token, c.KubeAPI, c.CAPath)
+		config, err := GenerateKubeconfig(KubeconfigOptions{Token: c.Token, Master: c.KubeAPI, CAPath: c.CAPath})
 		if err != nil {
 			t.Errorf("case %d should not have thrown error: %s", i, err)
 			continue
@@ -150,6 +353,50 @@ func TestGenerateKubeConfig(t *testing.T) {
 	}
 }
 
+func TestGenerateKubeConfigOptions(t *testing.T) {
+	ca, err := ioutil.TempFile("", "ca")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(ca.Name())
+	ca.WriteString(fakeCertificate)
+	ca.Close()
+
+	config, err := GenerateKubeconfig(KubeconfigOptions{
+		CAPath:      ca.Name(),
+		ClusterName: "kubernetes",
+		ContextName: "tls-bootstrap-token-user@kubernetes",
+		EmbedCA:     true,
+		Format:      FormatYAML,
+		Master:      "https://127.0.0.1:6443",
+		Token:       "test-token",
+		UserName:    "tls-bootstrap-token-user",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	content := string(config)
+	assert.Contains(t, content, "certificate-authority-data: "+base64.StdEncoding.EncodeToString([]byte(fakeCertificate)))
+	assert.NotContains(t, content, "certificate-authority:")
+	assert.Contains(t, content, "current-context: tls-bootstrap-token-user@kubernetes")
+	assert.Contains(t, content, "- name: tls-bootstrap-token-user\n")
+	assert.Contains(t, content, "    cluster: kubernetes\n")
+	assert.Contains(t, content, "    token: test-token\n")
+}
+
+func TestGenerateKubeConfigBadOptions(t *testing.T) {
+	cs := []KubeconfigOptions{
+		{Token: "test-token"},
+		{Token: "test-token", Master: "https://127.0.0.1", EmbedCA: true},
+		{Token: "test-token", Master: "https://127.0.0.1", CAPath: "/not/there", EmbedCA: true},
+		{Token: "test-token", Master: "https://127.0.0.1", Format: "toml"},
+	}
+	for i, c := range cs {
+		_, err := GenerateKubeconfig(c)
+		assert.Error(t, err, "case %d should have thrown an error", i)
+	}
+}
+
 func TestNewClientBadConfig(t *testing.T) {
 	client, err := New(Config{}, newFakeProviderSetup())
 	assert.Error(t, err)
@@ -190,16 +437,16 @@ func newFakeProvider(nodeID cloud.NodeID, tags cloud.NodeTags) cloud.Provider {
 	}
 }
 
-func (f *fakeProvider) GetNodeID() (cloud.NodeID, error) {
+func (f *fakeProvider) GetNodeID(ctx context.Context) (cloud.NodeID, error) {
 	return f.nodeID, nil
 }
 
-func (f *fakeProvider) DescribePools(cloud.NodeTags) ([]cloud.Pool, error) {
+func (f *fakeProvider) DescribePools(context.Context, cloud.Selector) ([]cloud.Pool, error) {
 	return []cloud.Pool{}, errors.New("access denyed")
 }
 
 // GetNodeTags retrieves a list of node tags
-func (f *fakeProvider) GetNodeTags(id cloud.NodeID) (cloud.NodeTags, error) {
+func (f *fakeProvider) GetNodeTags(ctx context.Context, id cloud.NodeID) (cloud.NodeTags, error) {
 	if f.nodeID == id {
 		return f.tags, nil
 	}
@@ -208,7 +455,7 @@ func (f *fakeProvider) GetNodeTags(id cloud.NodeID) (cloud.NodeTags, error) {
 }
 
 // GetNodeTag retrieves a specific node tag
-func (f *fakeProvider) GetNodeTag(id cloud.NodeID, tag string) (string, bool, error) {
+func (f *fakeProvider) GetNodeTag(ctx context.Context, id cloud.NodeID, tag string) (string, bool, error) {
 	f.RLock()
 	defer f.RUnlock()
 	if id != f.nodeID {
@@ -220,7 +467,7 @@ func (f *fakeProvider) GetNodeTag(id cloud.NodeID, tag string) (string, bool, er
 }
 
 // SetNodeTags is used to set a series of tags on a node
-func (f *fakeProvider) SetNodeTags(id cloud.NodeID, tags cloud.NodeTags) error {
+func (f *fakeProvider) SetNodeTags(ctx context.Context, id cloud.NodeID, tags cloud.NodeTags) error {
 	f.Lock()
 	defer f.Unlock()
 	if id != f.nodeID {
@@ -233,3 +480,52 @@ func (f *fakeProvider) SetNodeTags(id cloud.NodeID, tags cloud.NodeTags) error {
 
 	return nil
 }
+
+// throttlingProvider throttles the first few requests for the node tags
+type throttlingProvider struct {
+	cloud.Provider
+	throttle int
+}
+
+func (t *throttlingProvider) GetNodeTag(ctx context.Context, id cloud.NodeID, tag string) (string, bool, error) {
+	if t.throttle > 0 {
+		t.throttle--
+		return "", false, cloud.ErrThrottled
+	}
+
+	return t.Provider.GetNodeTag(ctx, id, tag)
+}
+
+// failingProvider fails the requests for the node tags
+type failingProvider struct {
+	cloud.Provider
+	err error
+}
+
+func (f *failingProvider) GetNodeTag(ctx context.Context, id cloud.NodeID, tag string) (string, bool, error) {
+	return "", false, f.err
+}
+
+// blockingProvider blocks on the node tags until the context is done
+type blockingProvider struct {
+	cloud.Provider
+}
+
+func (b *blockingProvider) GetNodeTag(ctx context.Context, id cloud.NodeID, tag string) (string, bool, error) {
+	<-ctx.Done()
+
+	return "", false, ctx.Err()
+}
+
+const fakeCertificate = `-----BEGIN CERTIFICATE-----
+MIIBgDCCASWgAwIBAgIUfC9aSnbsYBb3swsO+PbHlQYvSHswCgYIKoZIzj0EAwIw
+FTETMBEGA1UEAwwKa3ViZXJuZXRlczAeFw0yNjEwMTgxNjEyMzRaFw0zNjEwMTUx
+NjEyMzRaMBUxEzARBgNVBAMMCmt1YmVybmV0ZXMwWTATBgcqhkjOPQIBBggqhkjO
+PQMBBwNCAARGV417SlLT31mqaE+JzHh/LELMLfzJV3CzAp99v728Cc0hqsMnbgkN
+OEE7eeN5zTWGAKXucTe6Bd9scBgOvVtYo1MwUTAdBgNVHQ4EFgQU9VpBPswmFYpO
+03XwgSfPh6T9dGcwHwYDVR0jBBgwFoAU9VpBPswmFYpO03XwgSfPh6T9dGcwDwYD
+VR0TAQH/BAUwAwEB/zAKBggqhkjOPQQDAgNJADBGAiEA4hYyvVlyE3PAjIEtgm+F
+repuuJScmfpboEr6wZAfTPECIQDOOLXRBPTvmEtzTD1w4APZXRRFwhr7Af79OgPa
+xqkx8Q==
+-----END CERTIFICATE-----
+`
@@ -0,0 +1,99 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/ghodss/yaml"
+	api "k8s.io/client-go/tools/clientcmd/api/v1"
+)
+
+var (
+	// ErrNoCredentials means the kubelet credentials are not there yet
+	ErrNoCredentials = errors.New("no client credentials found")
+)
+
+// ReadClientCertificate reads the kubelet client certificate from either a pem file
+// (i.e. kubelet-client-current.pem, which holds the key as well) or a kubeconfig
+func ReadClientCertificate(filename string) (*x509.Certificate, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoCredentials
+		}
+		return nil, err
+	}
+	if certificate, err := parseCertificateBlock(content); err == nil {
+		return certificate, nil
+	}
+
+	// step: else we are looking at a kubeconfig
+	cfg := api.Config{}
+	if err := yaml.Unmarshal(content, &cfg); err != nil {
+		return nil, fmt.Errorf("%s is neither a certificate or kubeconfig: %s", filename, err)
+	}
+	user := ""
+	for _, x := range cfg.Contexts {
+		if x.Name == cfg.CurrentContext {
+			user = x.Context.AuthInfo
+		}
+	}
+	for _, x := range cfg.AuthInfos {
+		if x.Name != user {
+			continue
+		}
+		switch {
+		case len(x.AuthInfo.ClientCertificateData) > 0:
+			return parseCertificateBlock(x.AuthInfo.ClientCertificateData)
+		case x.AuthInfo.ClientCertificate != "":
+			certificate := x.AuthInfo.ClientCertificate
+			if !path.IsAbs(certificate) {
+				certificate = path.Join(path.Dir(filename), certificate)
+			}
+			return ReadClientCertificate(certificate)
+		}
+	}
+
+	return nil, ErrNoCredentials
+}
+
+// NeedsBootstrap checks if the certificate has expired or will within the renewal window
+func NeedsBootstrap(certificate *x509.Certificate, renewBefore time.Duration, now time.Time) bool {
+	return !now.Add(renewBefore).Before(certificate.NotAfter)
+}
+
+// parseCertificateBlock returns the first certificate in the pem content
+func parseCertificateBlock(content []byte) (*x509.Certificate, error) {
+	for {
+		block, rest := pem.Decode(content)
+		if block == nil {
+			return nil, errors.New("no pem encoded certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+		content = rest
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("not a key")})
+	files := map[string]string{
+		"kubelet-client-current.pem": string(key) + fakeCertificate,
+		"kubelet.crt":                fakeCertificate,
+		"kubeconfig-data": `apiVersion: v1
+kind: Config
+current-context: default
+contexts:
+- name: default
+  context:
+    cluster: default
+    user: kubelet
+users:
+- name: kubelet
+  user:
+    client-certificate-data: ` + base64.StdEncoding.EncodeToString([]byte(fakeCertificate)),
+		"kubeconfig-path": `apiVersion: v1
+kind: Config
+current-context: default
+contexts:
+- name: default
+  context:
+    cluster: default
+    user: kubelet
+users:
+- name: kubelet
+  user:
+    client-certificate: kubelet.crt
+`,
+		"kubeconfig-token": `apiVersion: v1
+kind: Config
+current-context: default
+contexts:
+- name: default
+  context:
+    cluster: default
+    user: kubelet
+users:
+- name: kubelet
+  user:
+    token: test-token
+`,
+		"garbage": "[not yaml",
+	}
+	for name, content := range files {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte(content), 0600))
+	}
+	for _, x := range []string{"kubelet-client-current.pem", "kubelet.crt", "kubeconfig-data", "kubeconfig-path"} {
+		certificate, err := ReadClientCertificate(path.Join(dir, x))
+		if !assert.NoError(t, err, "%s should not have thrown error", x) {
+			continue
+		}
+		assert.Equal(t, "kubernetes", certificate.Subject.CommonName)
+	}
+	_, err = ReadClientCertificate(path.Join(dir, "kubeconfig-token"))
+	assert.Equal(t, ErrNoCredentials, err)
+	_, err = ReadClientCertificate(path.Join(dir, "not-there"))
+	assert.Equal(t, ErrNoCredentials, err)
+	_, err = ReadClientCertificate(path.Join(dir, "garbage"))
+	assert.Error(t, err)
+}
+
+func TestNeedsBootstrap(t *testing.T) {
+	certificate, err := parseCertificateBlock([]byte(fakeCertificate))
+	if !assert.NoError(t, err) {
+		return
+	}
+	expires := certificate.NotAfter
+	cs := []struct {
+		Now         time.Time
+		RenewBefore time.Duration
+		Expected    bool
+	}{
+		{Now: expires.Add(-time.Hour)},
+		{Now: expires.Add(-time.Hour), RenewBefore: 2 * time.Hour, Expected: true},
+		{Now: expires, Expected: true},
+		{Now: expires.Add(time.Hour), Expected: true},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, NeedsBootstrap(certificate, c.RenewBefore, c.Now), "case %d", i)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+// Note: this follows the kubeadm token discovery
+// https://github.com/kubernetes/kubernetes/tree/master/cmd/kubeadm/app/discovery/token
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/jws"
+	"github.com/UKHomeOffice/keto-tokens/pkg/pubkeypin"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ghodss/yaml"
+	api "k8s.io/client-go/tools/clientcmd/api/v1"
+)
+
+const (
+	// clusterInfoPath is the path to the cluster-info configmap
+	clusterInfoPath = "/api/v1/namespaces/kube-public/configmaps/cluster-info"
+	// kubeconfigKey is the key in the cluster-info holding the kubeconfig
+	kubeconfigKey = "kubeconfig"
+	// signaturePrefix is the prefix of the jws signatures in the cluster-info
+	signaturePrefix = "jws-kubeconfig-"
+	// defaultDiscoveryTimeout is the timeout when none is given
+	defaultDiscoveryTimeout = time.Duration(30) * time.Second
+	// defaultDiscoveryRetryTimeout bounds the discovery retries when the client has no timeout
+	defaultDiscoveryRetryTimeout = time.Duration(5) * time.Minute
+)
+
+// configMap is the subset of a configmap we require
+type configMap struct {
+	Data map[string]string `json:"data"`
+}
+
+// DiscoverCA retrieves the cluster-info configmap, verifies the signature made with our
+// token and checks the ca it contains against the pins, returning the pem encoded ca
+func DiscoverCA(options DiscoveryOptions) ([]byte, error) {
+	if err := options.IsValid(); err != nil {
+		return nil, err
+	}
+	pins, err := pubkeypin.NewSet(options.CACertHashes)
+	if err != nil {
+		return nil, err
+	}
+	e := strings.SplitN(options.Token, ".", 2)
+	if len(e) != 2 {
+		return nil, errors.New("token is not of the form id.secret")
+	}
+	tokenID, tokenSecret := e[0], e[1]
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = defaultDiscoveryTimeout
+	}
+
+	// step: we can't verify the api yet, so the cluster-info is retrieved anonymously; the token
+	// must never cross an unverified connection, else anyone in the middle could sign their own ca
+	insecure := &tls.Config{InsecureSkipVerify: true}
+	info, err := getClusterInfo(options.Master, "", insecure, timeout)
+	if err != nil {
+		return nil, err
+	}
+	content, found := info.Data[kubeconfigKey]
+	if !found {
+		return nil, errors.New("cluster-info has no kubeconfig")
+	}
+	signature, found := info.Data[signaturePrefix+tokenID]
+	if !found {
+		return nil, fmt.Errorf("cluster-info has not been signed for token id: %s", tokenID)
+	}
+	if err := jws.VerifyDetachedSignature(content, signature, tokenID, tokenSecret); err != nil {
+		return nil, fmt.Errorf("cluster-info signature verification failed, error: %s", err)
+	}
+
+	// step: extract and check the ca
+	ca, err := getClusterInfoCA(content)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := pubkeypin.ParseCertificate(ca)
+	if err != nil {
+		return nil, err
+	}
+	if len(pins) > 0 {
+		if err := pins.Check(certificate); err != nil {
+			return nil, err
+		}
+	} else {
+		log.WithFields(log.Fields{
+			"pin": pubkeypin.Hash(certificate),
+		}).Warn("cluster ca has not been verified against a pin")
+	}
+
+	// step: go back around with the ca to ensure the api holds the key, the connection now being
+	// pinned to the verified ca it is safe to present the token
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	verified, err := getClusterInfo(options.Master, options.Token, &tls.Config{RootCAs: pool}, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify the api with the cluster ca, error: %s", err)
+	}
+	if verified.Data[kubeconfigKey] != content {
+		return nil, errors.New("cluster-info changed while validating the cluster ca")
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}), nil
+}
+
+// DiscoverCA discovers the cluster ca, retrying with the backoff until the timeout; the token
+// has been consumed by now, so a transient failure must not strand the node, though without a
+// timeout the retries are bounded, so a cluster-info which is never signed cannot hang us
+func (c *Client) DiscoverCA(options DiscoveryOptions) ([]byte, error) {
+	if err := options.IsValid(); err != nil {
+		return nil, err
+	}
+	timeout := c.config.Timeout
+	if timeout <= 0 {
+		timeout = defaultDiscoveryRetryTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	b := newBackoff(c.config)
+
+	for {
+		ca, err := DiscoverCA(options)
+		if err == nil {
+			return ca, nil
+		}
+		interval := b.Next()
+		log.WithFields(log.Fields{
+			"error":    err.Error(),
+			"interval": interval.String(),
+		}).Warn("unable to discover the cluster ca, retrying")
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// getClusterInfo retrieves the cluster-info configmap from the api, anonymously unless a token is given
+func getClusterInfo(master, token string, config *tls.Config, timeout time.Duration) (*configMap, error) {
+	hc := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: config},
+	}
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(master, "/")+clusterInfoPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	request.Header.Set("Accept", "application/json")
+
+	resp, err := hc.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to retrieve cluster-info, status: %d", resp.StatusCode)
+	}
+	info := &configMap{}
+	if err := json.Unmarshal(content, info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// getClusterInfoCA extracts the ca from the cluster-info kubeconfig
+func getClusterInfoCA(content string) ([]byte, error) {
+	cfg := api.Config{}
+	if err := yaml.Unmarshal([]byte(content), &cfg); err != nil {
+		return nil, fmt.Errorf("cluster-info kubeconfig is invalid, error: %s", err)
+	}
+	if len(cfg.Clusters) <= 0 {
+		return nil, errors.New("cluster-info kubeconfig has no clusters")
+	}
+	ca := bytes.TrimSpace(cfg.Clusters[0].Cluster.CertificateAuthorityData)
+	if len(ca) <= 0 {
+		return nil, errors.New("cluster-info kubeconfig has no certificate authority data")
+	}
+
+	return ca, nil
+}
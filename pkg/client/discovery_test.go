@@ -0,0 +1,191 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/jws"
+	"github.com/UKHomeOffice/keto-tokens/pkg/pubkeypin"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	fakeTokenID     = "abcdef"
+	fakeTokenSecret = "0123456789abcdef"
+	fakeToken       = fakeTokenID + "." + fakeTokenSecret
+)
+
+func TestDiscoverCA(t *testing.T) {
+	srv, ca := newFakeClusterInfoServer(t, fakeTokenSecret, nil)
+	defer srv.Close()
+
+	data, err := DiscoverCA(DiscoveryOptions{
+		CACertHashes: []string{pubkeypin.Hash(ca)},
+		Master:       srv.URL,
+		Token:        fakeToken,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), data)
+}
+
+func TestDiscoverCATokenNotSentInsecurely(t *testing.T) {
+	var headers []string
+	srv, ca := newFakeClusterInfoServer(t, fakeTokenSecret, func(r *http.Request) bool {
+		headers = append(headers, r.Header.Get("Authorization"))
+		return true
+	})
+	defer srv.Close()
+
+	_, err := DiscoverCA(DiscoveryOptions{
+		CACertHashes: []string{pubkeypin.Hash(ca)},
+		Master:       srv.URL,
+		Token:        fakeToken,
+	})
+	assert.NoError(t, err)
+	// step: only the request pinned to the verified ca may carry the token
+	assert.Equal(t, []string{"", "Bearer " + fakeToken}, headers)
+}
+
+func TestClientDiscoverCARetries(t *testing.T) {
+	failures := 2
+	srv, ca := newFakeClusterInfoServer(t, fakeTokenSecret, func(r *http.Request) bool {
+		failures--
+		return failures < 0
+	})
+	defer srv.Close()
+
+	c, err := New(Config{Interval: time.Millisecond, TagName: "token", Timeout: time.Second}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err := c.DiscoverCA(DiscoveryOptions{
+		CACertHashes: []string{pubkeypin.Hash(ca)},
+		Master:       srv.URL,
+		Token:        fakeToken,
+	})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, data)
+	assert.True(t, failures < 0)
+}
+
+func TestClientDiscoverCATimeout(t *testing.T) {
+	srv, ca := newFakeClusterInfoServer(t, fakeTokenSecret, func(r *http.Request) bool {
+		return false
+	})
+	defer srv.Close()
+
+	c, err := New(Config{Interval: time.Millisecond, TagName: "token", Timeout: time.Duration(50) * time.Millisecond}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = c.DiscoverCA(DiscoveryOptions{
+		CACertHashes: []string{pubkeypin.Hash(ca)},
+		Master:       srv.URL,
+		Token:        fakeToken,
+	})
+	assert.Error(t, err)
+}
+
+func TestDiscoverCABadPin(t *testing.T) {
+	srv, _ := newFakeClusterInfoServer(t, fakeTokenSecret, nil)
+	defer srv.Close()
+
+	_, err := DiscoverCA(DiscoveryOptions{
+		CACertHashes: []string{"sha256:00000000000000000000000000000000000000000000000000000000000000aa"},
+		Master:       srv.URL,
+		Token:        fakeToken,
+	})
+	assert.Error(t, err)
+}
+
+func TestDiscoverCABadSignature(t *testing.T) {
+	srv, ca := newFakeClusterInfoServer(t, "fedcba9876543210", nil)
+	defer srv.Close()
+
+	_, err := DiscoverCA(DiscoveryOptions{
+		CACertHashes: []string{pubkeypin.Hash(ca)},
+		Master:       srv.URL,
+		Token:        fakeToken,
+	})
+	assert.Error(t, err)
+}
+
+func TestDiscoverCAUnsafeSkip(t *testing.T) {
+	srv, _ := newFakeClusterInfoServer(t, fakeTokenSecret, nil)
+	defer srv.Close()
+
+	_, err := DiscoverCA(DiscoveryOptions{Master: srv.URL, Token: fakeToken})
+	assert.Error(t, err)
+	data, err := DiscoverCA(DiscoveryOptions{Master: srv.URL, Token: fakeToken, UnsafeSkipCAVerification: true})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, data)
+}
+
+// newFakeClusterInfoServer creates an api serving a cluster-info signed with the secret, the
+// cluster-info being public as in kube-public; the optional inspector sees each request, the api
+// being unavailable when it returns false
+func newFakeClusterInfoServer(t *testing.T, secret string, inspect func(*http.Request) bool) (*httptest.Server, *x509.Certificate) {
+	var content, signature string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inspect != nil && !inspect(r) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != clusterInfoPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if v := r.Header.Get("Authorization"); v != "" && v != "Bearer "+fakeToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(&configMap{
+			Data: map[string]string{
+				kubeconfigKey:                 content,
+				signaturePrefix + fakeTokenID: signature,
+			},
+		})
+	}))
+	srv.StartTLS()
+
+	ca, err := x509.ParseCertificate(srv.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("unable to parse the server certificate: %s", err)
+	}
+	kubeconfig, err := GenerateKubeconfig(KubeconfigOptions{
+		CAData: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}),
+		Format: FormatYAML,
+		Master: srv.URL,
+	})
+	if err != nil {
+		t.Fatalf("unable to generate the kubeconfig: %s", err)
+	}
+	content = string(kubeconfig)
+	if signature, err = jws.ComputeDetachedSignature(content, fakeTokenID, secret); err != nil {
+		t.Fatalf("unable to sign the kubeconfig: %s", err)
+	}
+
+	return srv, ca
+}
@@ -18,6 +18,7 @@ package client
 
 import (
 	"errors"
+	"fmt"
 	"time"
 )
 
@@ -25,12 +26,23 @@ import (
 
 // Config is the configuration for the client
 type Config struct {
-	// Interval is the period of time between checking for tags
+	// Interval is the initial period of time between checking for tags
 	Interval time.Duration
+	// MaxInterval is the maximum period between checks, defaults to the interval
+	MaxInterval time.Duration
+	// Backoff is the multiplier applied to the interval after each check, defaults to 1
+	Backoff float64
+	// Jitter is the fraction (0-1) by which each interval is randomly varied
+	Jitter float64
+	// ThrottleInterval is the minimum wait after being throttled (within the max interval),
+	// defaults to the max interval
+	ThrottleInterval time.Duration
 	// Timeout is the max time we wait
 	Timeout time.Duration
 	// TagName is the name of the tag the token
 	TagName string
+	// CAHashTagName is the name of the tag holding the cluster ca hash
+	CAHashTagName string
 }
 
 // IsValid check the configuration is valid
@@ -41,6 +53,154 @@ func (c *Config) IsValid() error {
 	if c.TagName == "" {
 		return errors.New("no tag name")
 	}
+	if c.MaxInterval < 0 || (c.MaxInterval > 0 && c.MaxInterval < c.Interval) {
+		return errors.New("max interval must be greater than the interval")
+	}
+	if c.Backoff != 0 && c.Backoff < 1 {
+		return errors.New("backoff multiplier must be one or more")
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return errors.New("jitter must be between zero and one")
+	}
+	if c.ThrottleInterval < 0 {
+		return errors.New("throttle interval cannot be negative")
+	}
+	if c.ThrottleInterval > c.Interval && c.ThrottleInterval > c.MaxInterval {
+		return errors.New("throttle interval cannot exceed the max interval")
+	}
+
+	return nil
+}
+
+const (
+	// FormatJSON indicates the kubeconfig is rendered as json
+	FormatJSON = "json"
+	// FormatYAML indicates the kubeconfig is rendered as yaml
+	FormatYAML = "yaml"
+)
+
+// KubeconfigOptions are the options used to generate a bootstrap kubeconfig
+type KubeconfigOptions struct {
+	// Token is the registration token
+	Token string
+	// Master is the url for the kubernetes api
+	Master string
+	// CAPath is the path to the kubeapi ca certificate
+	CAPath string
+	// EmbedCA indicates we embed the content of the ca rather than reference the path
+	EmbedCA bool
+	// CAData is the pem encoded ca to embed, taking precedence over the path
+	CAData []byte
+	// ClusterName is the name of the cluster in the kubeconfig
+	ClusterName string
+	// ContextName is the name of the context in the kubeconfig
+	ContextName string
+	// UserName is the name of the user in the kubeconfig, defaults to the context name
+	UserName string
+	// Format is the output format, json or yaml
+	Format string
+}
+
+// IsValid checks the kubeconfig options are valid
+func (k *KubeconfigOptions) IsValid() error {
+	if k.Master == "" {
+		return errors.New("no master url")
+	}
+	if k.EmbedCA && k.CAPath == "" && len(k.CAData) <= 0 {
+		return errors.New("no ca path to embed")
+	}
+	switch k.Format {
+	case "", FormatJSON, FormatYAML:
+	default:
+		return fmt.Errorf("unsupported kubeconfig format: %s", k.Format)
+	}
+
+	return nil
+}
+
+// DiscoveryOptions are the options used to discover the cluster ca
+type DiscoveryOptions struct {
+	// Master is the url for the kubernetes api
+	Master string
+	// Token is the registration token used to verify the cluster-info
+	Token string
+	// CACertHashes is a collection of pins (sha256:<hex>) the ca must match
+	CACertHashes []string
+	// UnsafeSkipCAVerification permits a ca which is not pinned
+	UnsafeSkipCAVerification bool
+	// Timeout is the timeout on the requests to the api
+	Timeout time.Duration
+}
+
+// IsValid checks the discovery options are valid
+func (d *DiscoveryOptions) IsValid() error {
+	if d.Master == "" {
+		return errors.New("no master url")
+	}
+	if d.Token == "" {
+		return errors.New("no token")
+	}
+	if len(d.CACertHashes) <= 0 && !d.UnsafeSkipCAVerification {
+		return errors.New("no ca cert hashes to verify the cluster ca against")
+	}
+
+	return nil
+}
+
+// JoinOptions are the options used to generate a kubeadm join configuration
+type JoinOptions struct {
+	// Token is the registration token
+	Token string
+	// Master is the url for the kubernetes api
+	Master string
+	// CACertHashes is a collection of pins (sha256:<hex>) the ca must match
+	CACertHashes []string
+	// UnsafeSkipCAVerification permits kubeadm to join without a pin
+	UnsafeSkipCAVerification bool
+	// CAPath is the path to the ca the pin is computed from when no hashes are given
+	CAPath string
+	// PublishedCAHash indicates the server may publish a pin alongside the token
+	PublishedCAHash bool
+	// NodeName is the name to register the node under, defaults to the hostname
+	NodeName string
+	// APIVersion is the kubeadm api version, defaults to KubeadmAPIVersion
+	APIVersion string
+	// Format is the output format, json or yaml
+	Format string
+}
+
+// IsValid checks the join options are valid
+func (j *JoinOptions) IsValid() error {
+	if err := j.isValidOutput(); err != nil {
+		return err
+	}
+	if j.Token == "" {
+		return errors.New("no token")
+	}
+	if len(j.CACertHashes) <= 0 && !j.UnsafeSkipCAVerification {
+		return errors.New("no ca cert hashes for kubeadm to verify the cluster ca against")
+	}
+
+	return nil
+}
+
+// isValidOutput checks the options known before the token is consumed, so a bad invocation
+// fails without consuming it; the pins need only be available from one of the sources
+func (j *JoinOptions) isValidOutput() error {
+	if j.Master == "" {
+		return errors.New("no master url")
+	}
+	if _, err := getAPIServerEndpoint(j.Master); err != nil {
+		return err
+	}
+	if len(j.CACertHashes) <= 0 && j.CAPath == "" && !j.PublishedCAHash && !j.UnsafeSkipCAVerification {
+		return errors.New("no ca cert hashes, ca path or published ca hash for kubeadm to verify the cluster ca against")
+	}
+	switch j.Format {
+	case "", FormatJSON, FormatYAML:
+	default:
+		return fmt.Errorf("unsupported join configuration format: %s", j.Format)
+	}
 
 	return nil
 }
@@ -0,0 +1,146 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+)
+
+// FileOptions are the permissions applied to the files written
+type FileOptions struct {
+	// Mode is the file mode, defaults to the mode of the output
+	Mode os.FileMode
+	// Owner is the user name or uid which owns the files
+	Owner string
+	// Group is the group name or gid which owns the files
+	Group string
+}
+
+// outputFile is a file written by an output
+type outputFile struct {
+	filename string
+	mode     os.FileMode
+	uid      int
+	gid      int
+}
+
+// newOutputFile resolves the file options for the file
+func newOutputFile(filename string, options FileOptions) (outputFile, error) {
+	file := outputFile{filename: filename, mode: options.Mode, uid: -1, gid: -1}
+	if options.Owner != "" {
+		uid, err := lookupID(options.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return file, fmt.Errorf("invalid file owner: %s", err)
+		}
+		file.uid = uid
+	}
+	if options.Group != "" {
+		gid, err := lookupID(options.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return file, fmt.Errorf("invalid file group: %s", err)
+		}
+		file.gid = gid
+	}
+
+	return file, nil
+}
+
+// write atomically replaces the file; the content is written to a temporary file in
+// the same directory, synced and renamed into place so a reader never sees a partial file
+func (o outputFile) write(content []byte, mode os.FileMode) (err error) {
+	if o.mode != 0 {
+		mode = o.mode
+	}
+	dir := path.Dir(o.filename)
+	if err = os.MkdirAll(dir, os.FileMode(0775)); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+path.Base(o.filename)+".")
+	if err != nil {
+		return err
+	}
+	// step: ensure we clean up on failure
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(content); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if o.uid >= 0 || o.gid >= 0 {
+		if err = tmp.Chown(o.uid, o.gid); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), o.filename); err != nil {
+		return err
+	}
+
+	// step: sync the directory so the rename is durable
+	if d, derr := os.Open(dir); derr == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// lookupID returns the numeric id, resolving names via the lookup
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		if id < 0 {
+			return 0, fmt.Errorf("%d is not a valid id", id)
+		}
+		return id, nil
+	}
+	v, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(v)
+}
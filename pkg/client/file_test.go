@@ -0,0 +1,111 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputFileWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "sub/kubeconfig")
+
+	file, err := newOutputFile(filename, FileOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, file.write([]byte("first"), os.FileMode(0640)))
+	assert.NoError(t, file.write([]byte("second"), os.FileMode(0640)))
+	content, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(content))
+	stat, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), stat.Mode().Perm())
+
+	// step: ensure no temporary files are left behind
+	files, err := ioutil.ReadDir(path.Dir(filename))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestOutputFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "token")
+
+	file, err := newOutputFile(filename, FileOptions{
+		Mode:  os.FileMode(0400),
+		Owner: "-1",
+	})
+	assert.Error(t, err)
+	file, err = newOutputFile(filename, FileOptions{
+		Group: "-1",
+	})
+	assert.Error(t, err)
+	file, err = newOutputFile(filename, FileOptions{
+		Mode:  os.FileMode(0400),
+		Owner: "keto-tokens-no-such-user",
+	})
+	assert.Error(t, err)
+
+	file, err = newOutputFile(filename, FileOptions{
+		Mode:  os.FileMode(0400),
+		Owner: strconv.Itoa(os.Getuid()),
+		Group: strconv.Itoa(os.Getgid()),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, file.write([]byte("token"), os.FileMode(0600)))
+	stat, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0400), stat.Mode().Perm())
+}
+
+func TestOutputFileWriteFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	// step: the target is a directory, so the rename fails
+	filename := path.Join(dir, "kubeconfig")
+	assert.NoError(t, os.MkdirAll(path.Join(filename, "child"), 0755))
+
+	file, err := newOutputFile(filename, FileOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Error(t, file.write([]byte("content"), os.FileMode(0640)))
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/ghodss/yaml"
+)
+
+const (
+	// KubeadmAPIVersion is the default api version of the join configuration
+	KubeadmAPIVersion = "kubeadm.k8s.io/v1beta2"
+)
+
+// joinConfiguration is the subset of the kubeadm JoinConfiguration we render
+type joinConfiguration struct {
+	APIVersion       string           `json:"apiVersion"`
+	Kind             string           `json:"kind"`
+	Discovery        joinDiscovery    `json:"discovery"`
+	NodeRegistration nodeRegistration `json:"nodeRegistration,omitempty"`
+}
+
+// joinDiscovery is the discovery section of the join configuration
+type joinDiscovery struct {
+	BootstrapToken    bootstrapTokenDiscovery `json:"bootstrapToken"`
+	TLSBootstrapToken string                  `json:"tlsBootstrapToken"`
+}
+
+// bootstrapTokenDiscovery is the token discovery for the join
+type bootstrapTokenDiscovery struct {
+	Token                    string   `json:"token"`
+	APIServerEndpoint        string   `json:"apiServerEndpoint"`
+	CACertHashes             []string `json:"caCertHashes,omitempty"`
+	UnsafeSkipCAVerification bool     `json:"unsafeSkipCAVerification"`
+}
+
+// nodeRegistration is the node registration section of the join configuration
+type nodeRegistration struct {
+	Name string `json:"name,omitempty"`
+}
+
+// GenerateJoinConfiguration generates a kubeadm join configuration for us
+func GenerateJoinConfiguration(options JoinOptions) ([]byte, error) {
+	if err := options.IsValid(); err != nil {
+		return nil, err
+	}
+	endpoint, err := getAPIServerEndpoint(options.Master)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := joinConfiguration{
+		APIVersion: defaultString(options.APIVersion, KubeadmAPIVersion),
+		Kind:       "JoinConfiguration",
+		Discovery: joinDiscovery{
+			BootstrapToken: bootstrapTokenDiscovery{
+				APIServerEndpoint:        endpoint,
+				CACertHashes:             options.CACertHashes,
+				Token:                    options.Token,
+				UnsafeSkipCAVerification: options.UnsafeSkipCAVerification,
+			},
+			TLSBootstrapToken: options.Token,
+		},
+		NodeRegistration: nodeRegistration{Name: options.NodeName},
+	}
+
+	if options.Format == FormatJSON {
+		return json.MarshalIndent(&cfg, "", "  ")
+	}
+
+	return yaml.Marshal(&cfg)
+}
+
+// getAPIServerEndpoint converts the master url into the host:port kubeadm expects
+func getAPIServerEndpoint(master string) (string, error) {
+	u, err := url.Parse(master)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("master url: %s has no host", master)
+	}
+	if u.Port() == "" {
+		return u.Host + ":443", nil
+	}
+
+	return u.Host, nil
+}
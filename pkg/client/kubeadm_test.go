@@ -0,0 +1,79 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateJoinConfiguration(t *testing.T) {
+	config, err := GenerateJoinConfiguration(JoinOptions{
+		CACertHashes: []string{"sha256:test"},
+		Master:       "https://127.0.0.1:6443",
+		NodeName:     "ip-10-0-0-1.compute.internal",
+		Token:        "abcdef.0123456789abcdef",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	expected := `apiVersion: kubeadm.k8s.io/v1beta2
+discovery:
+  bootstrapToken:
+    apiServerEndpoint: 127.0.0.1:6443
+    caCertHashes:
+    - sha256:test
+    token: abcdef.0123456789abcdef
+    unsafeSkipCAVerification: false
+  tlsBootstrapToken: abcdef.0123456789abcdef
+kind: JoinConfiguration
+nodeRegistration:
+  name: ip-10-0-0-1.compute.internal
+`
+	assert.Equal(t, expected, string(config))
+}
+
+func TestGenerateJoinConfigurationBadOptions(t *testing.T) {
+	cs := []JoinOptions{
+		{Token: "test-token", CACertHashes: []string{"sha256:test"}},
+		{Master: "https://127.0.0.1", CACertHashes: []string{"sha256:test"}},
+		{Master: "https://127.0.0.1", Token: "test-token"},
+		{Master: "https://127.0.0.1", Token: "test-token", UnsafeSkipCAVerification: true, Format: "toml"},
+		{Master: "127.0.0.1", Token: "test-token", UnsafeSkipCAVerification: true},
+	}
+	for i, c := range cs {
+		_, err := GenerateJoinConfiguration(c)
+		assert.Error(t, err, "case %d should have thrown an error", i)
+	}
+}
+
+func TestGetAPIServerEndpoint(t *testing.T) {
+	cs := []struct {
+		Master   string
+		Expected string
+	}{
+		{Master: "https://127.0.0.1:6443", Expected: "127.0.0.1:6443"},
+		{Master: "https://kube-api.example.com", Expected: "kube-api.example.com:443"},
+		{Master: "https://kube-api.example.com:8443/", Expected: "kube-api.example.com:8443"},
+	}
+	for i, c := range cs {
+		endpoint, err := getAPIServerEndpoint(c.Master)
+		assert.NoError(t, err, "case %d should not have thrown error", i)
+		assert.Equal(t, c.Expected, endpoint, "case %d", i)
+	}
+}
@@ -0,0 +1,295 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/pubkeypin"
+)
+
+const (
+	// OutputKubeconfig writes a bootstrap kubeconfig
+	OutputKubeconfig = "kubeconfig"
+	// OutputKubeadm writes a kubeadm join configuration
+	OutputKubeadm = "kubeadm"
+	// OutputToken writes the raw token
+	OutputToken = "token"
+	// OutputEnv writes a systemd environment file
+	OutputEnv = "env"
+	// OutputJSON writes the result as json
+	OutputJSON = "json"
+	// OutputTemplate renders a go template
+	OutputTemplate = "template"
+)
+
+// Result is the outcome of consuming the token, handed to each output
+type Result struct {
+	// Token is the registration token
+	Token string `json:"token"`
+	// Master is the url for the kubernetes api
+	Master string `json:"master"`
+	// CAPath is the path to the kubeapi ca certificate
+	CAPath string `json:"ca_path,omitempty"`
+	// CAData is the pem encoded ca, if discovered
+	CAData []byte `json:"ca_data,omitempty"`
+	// CACertHashes is a collection of pins (sha256:<hex>) for the ca
+	CACertHashes []string `json:"ca_cert_hashes,omitempty"`
+	// NodeName is the name of the node
+	NodeName string `json:"node_name,omitempty"`
+}
+
+// Output is a sink for the consumed token
+type Output interface {
+	// Write hands the result to the sink
+	Write(Result) error
+}
+
+// OutputOptions are the defaults used when building the outputs
+type OutputOptions struct {
+	// Kubeconfig are the options for the kubeconfig output
+	Kubeconfig KubeconfigOptions
+	// Join are the options for the kubeadm output
+	Join JoinOptions
+	// Stdout is where outputs without a path are written
+	Stdout io.Writer
+	// File are the permissions of the files written
+	File FileOptions
+}
+
+// NewOutput creates an output from the specification, TYPE[=PATH] or template=TEMPLATE[:PATH]
+func NewOutput(spec string, options OutputOptions) (Output, error) {
+	kind, filename := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		kind, filename = spec[:i], spec[i+1:]
+	}
+	stdout := options.Stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	file, err := newOutputFile(filename, options.File)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case OutputKubeconfig:
+		if filename == "" {
+			return nil, fmt.Errorf("output: %s requires a path", kind)
+		}
+		return &kubeconfigOutput{file: file, options: options.Kubeconfig}, nil
+	case OutputKubeadm:
+		if filename == "" {
+			return nil, fmt.Errorf("output: %s requires a path", kind)
+		}
+		if err := options.Join.isValidOutput(); err != nil {
+			return nil, fmt.Errorf("output: %s %s", kind, err)
+		}
+		if len(options.Join.CACertHashes) <= 0 && options.Join.CAPath != "" {
+			if _, err := getCACertHashes(Result{CAPath: options.Join.CAPath}); err != nil {
+				return nil, fmt.Errorf("output: %s unable to pin the ca, error: %s", kind, err)
+			}
+		}
+		return &kubeadmOutput{file: file, options: options.Join}, nil
+	case OutputToken:
+		if filename == "" {
+			return nil, fmt.Errorf("output: %s requires a path", kind)
+		}
+		return &tokenOutput{file: file}, nil
+	case OutputEnv:
+		if filename == "" {
+			return nil, fmt.Errorf("output: %s requires a path", kind)
+		}
+		return &envOutput{file: file}, nil
+	case OutputJSON:
+		return &jsonOutput{file: file, stdout: stdout}, nil
+	case OutputTemplate:
+		source := filename
+		file.filename = ""
+		if i := strings.Index(source, ":"); i >= 0 {
+			source, file.filename = source[:i], source[i+1:]
+		}
+		if source == "" {
+			return nil, fmt.Errorf("output: %s requires a template file", kind)
+		}
+		tmpl, err := template.New(path.Base(source)).Funcs(template.FuncMap{
+			"join": strings.Join,
+		}).ParseFiles(source)
+		if err != nil {
+			return nil, err
+		}
+		return &templateOutput{file: file, stdout: stdout, template: tmpl}, nil
+	}
+
+	return nil, fmt.Errorf("output: %s is not supported", kind)
+}
+
+// kubeconfigOutput writes a bootstrap kubeconfig
+type kubeconfigOutput struct {
+	file    outputFile
+	options KubeconfigOptions
+}
+
+func (k *kubeconfigOutput) Write(r Result) error {
+	options := k.options
+	options.Token = r.Token
+	options.Master = r.Master
+	options.CAPath = r.CAPath
+	options.CAData = r.CAData
+
+	content, err := GenerateKubeconfig(options)
+	if err != nil {
+		return err
+	}
+
+	return k.file.write(content, os.FileMode(0640))
+}
+
+// kubeadmOutput writes a kubeadm join configuration
+type kubeadmOutput struct {
+	file    outputFile
+	options JoinOptions
+}
+
+func (k *kubeadmOutput) Write(r Result) error {
+	options := k.options
+	options.Token = r.Token
+	options.Master = r.Master
+	options.CACertHashes = r.CACertHashes
+	options.NodeName = defaultString(options.NodeName, r.NodeName)
+	// step: pin the ca we were given or discovered
+	if len(options.CACertHashes) <= 0 {
+		hashes, err := getCACertHashes(r)
+		if err != nil {
+			return err
+		}
+		options.CACertHashes = hashes
+	}
+
+	content, err := GenerateJoinConfiguration(options)
+	if err != nil {
+		return err
+	}
+
+	return k.file.write(content, os.FileMode(0600))
+}
+
+// tokenOutput writes the raw token
+type tokenOutput struct {
+	file outputFile
+}
+
+func (t *tokenOutput) Write(r Result) error {
+	return t.file.write([]byte(r.Token), os.FileMode(0600))
+}
+
+// envOutput writes a systemd environment file
+type envOutput struct {
+	file outputFile
+}
+
+func (e *envOutput) Write(r Result) error {
+	values := map[string]string{
+		"BOOTSTRAP_TOKEN": r.Token,
+		"CA_CERT_HASHES":  strings.Join(r.CACertHashes, ","),
+		"CA_PATH":         r.CAPath,
+		"KUBE_MASTER":     r.Master,
+		"NODE_NAME":       r.NodeName,
+	}
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s=%s", k, strconv.Quote(values[k])))
+	}
+
+	return e.file.write([]byte(strings.Join(lines, "\n")+"\n"), os.FileMode(0600))
+}
+
+// jsonOutput writes the result as json
+type jsonOutput struct {
+	file   outputFile
+	stdout io.Writer
+}
+
+func (j *jsonOutput) Write(r Result) error {
+	content, err := json.MarshalIndent(&r, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+	if j.file.filename == "" {
+		_, err = j.stdout.Write(content)
+		return err
+	}
+
+	return j.file.write(content, os.FileMode(0600))
+}
+
+// templateOutput renders a go template
+type templateOutput struct {
+	file     outputFile
+	stdout   io.Writer
+	template *template.Template
+}
+
+func (t *templateOutput) Write(r Result) error {
+	if t.file.filename == "" {
+		return t.template.Execute(t.stdout, &r)
+	}
+	content := &bytes.Buffer{}
+	if err := t.template.Execute(content, &r); err != nil {
+		return err
+	}
+
+	return t.file.write(content.Bytes(), os.FileMode(0600))
+}
+
+// getCACertHashes returns the pin of the ca in the result, if any
+func getCACertHashes(r Result) ([]string, error) {
+	data := r.CAData
+	if len(data) <= 0 {
+		if r.CAPath == "" {
+			return []string{}, nil
+		}
+		content, err := ioutil.ReadFile(r.CAPath)
+		if err != nil {
+			return nil, err
+		}
+		data = content
+	}
+	hash, err := pubkeypin.HashPEM(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{hash}, nil
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOutputBad(t *testing.T) {
+	cs := []string{
+		"",
+		"unknown",
+		"kubeconfig",
+		"kubeadm=",
+		"token",
+		"env",
+		"template",
+		"template=/not/there:/tmp/out",
+	}
+	for i, c := range cs {
+		_, err := NewOutput(c, OutputOptions{})
+		assert.Error(t, err, "case %d should have thrown an error", i)
+	}
+}
+
+func TestNewOutputKubeadmChecked(t *testing.T) {
+	cs := []struct {
+		Join JoinOptions
+		Ok   bool
+	}{
+		{},
+		{Join: JoinOptions{Master: "https://127.0.0.1:6443"}},
+		{Join: JoinOptions{Master: "https://127.0.0.1:6443", CAPath: "/not/there"}},
+		{Join: JoinOptions{Master: "https://127.0.0.1:6443", PublishedCAHash: true, Format: "toml"}},
+		{Join: JoinOptions{Master: "127.0.0.1", PublishedCAHash: true}},
+		{Join: JoinOptions{PublishedCAHash: true}},
+		{Join: JoinOptions{Master: "https://127.0.0.1:6443", PublishedCAHash: true}, Ok: true},
+		{Join: JoinOptions{Master: "https://127.0.0.1:6443", CACertHashes: []string{"sha256:test"}}, Ok: true},
+		{Join: JoinOptions{Master: "https://127.0.0.1:6443", UnsafeSkipCAVerification: true}, Ok: true},
+	}
+	for i, c := range cs {
+		_, err := NewOutput("kubeadm=/tmp/kubeadm.yaml", OutputOptions{Join: c.Join})
+		if c.Ok {
+			assert.NoError(t, err, "case %d should not have thrown error", i)
+			continue
+		}
+		assert.Error(t, err, "case %d should have thrown an error", i)
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputs")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	tmpl := path.Join(dir, "token.tmpl")
+	assert.NoError(t, ioutil.WriteFile(tmpl, []byte(`TOKEN={{ .Token }} PINS={{ join .CACertHashes "," }}`), 0600))
+
+	result := Result{
+		CACertHashes: []string{"sha256:test"},
+		Master:       "https://127.0.0.1:6443",
+		NodeName:     "compute00",
+		Token:        "abcdef.0123456789abcdef",
+	}
+	cs := []struct {
+		Spec     string
+		Filename string
+		Expected string
+		Contains []string
+	}{
+		{
+			Spec:     "token=" + path.Join(dir, "token"),
+			Filename: path.Join(dir, "token"),
+			Expected: "abcdef.0123456789abcdef",
+		},
+		{
+			Spec:     "env=" + path.Join(dir, "env"),
+			Filename: path.Join(dir, "env"),
+			Expected: "BOOTSTRAP_TOKEN=\"abcdef.0123456789abcdef\"\nCA_CERT_HASHES=\"sha256:test\"\nCA_PATH=\"\"\nKUBE_MASTER=\"https://127.0.0.1:6443\"\nNODE_NAME=\"compute00\"\n",
+		},
+		{
+			Spec:     "template=" + tmpl + ":" + path.Join(dir, "rendered"),
+			Filename: path.Join(dir, "rendered"),
+			Expected: "TOKEN=abcdef.0123456789abcdef PINS=sha256:test",
+		},
+		{
+			Spec:     "kubeconfig=" + path.Join(dir, "sub/kubeconfig"),
+			Filename: path.Join(dir, "sub/kubeconfig"),
+			Contains: []string{"\"token\": \"abcdef.0123456789abcdef\"", "\"server\": \"https://127.0.0.1:6443\""},
+		},
+		{
+			Spec:     "kubeadm=" + path.Join(dir, "kubeadm.yaml"),
+			Filename: path.Join(dir, "kubeadm.yaml"),
+			Contains: []string{"apiServerEndpoint: 127.0.0.1:6443", "- sha256:test", "name: compute00"},
+		},
+	}
+	options := OutputOptions{Join: JoinOptions{Master: result.Master, CACertHashes: result.CACertHashes}}
+	for i, c := range cs {
+		output, err := NewOutput(c.Spec, options)
+		if !assert.NoError(t, err, "case %d should not have thrown error", i) {
+			continue
+		}
+		if !assert.NoError(t, output.Write(result), "case %d should not have thrown error", i) {
+			continue
+		}
+		content, err := ioutil.ReadFile(c.Filename)
+		if !assert.NoError(t, err, "case %d should not have thrown error", i) {
+			continue
+		}
+		if c.Expected != "" {
+			assert.Equal(t, c.Expected, string(content), "case %d", i)
+		}
+		for _, x := range c.Contains {
+			assert.Contains(t, string(content), x, "case %d", i)
+		}
+	}
+}
+
+func TestOutputStdout(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	output, err := NewOutput("json", OutputOptions{Stdout: stdout})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, output.Write(Result{Master: "https://127.0.0.1", Token: "test-token"}))
+	result := Result{}
+	assert.NoError(t, json.Unmarshal(stdout.Bytes(), &result))
+	assert.Equal(t, "test-token", result.Token)
+	assert.Equal(t, "https://127.0.0.1", result.Master)
+}
+
+func TestOutputKubeadmCAPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputs")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	ca := path.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(ca, []byte(fakeCertificate), 0600))
+
+	output, err := NewOutput("kubeadm="+path.Join(dir, "kubeadm.yaml"), OutputOptions{Join: JoinOptions{CAPath: ca, Master: "https://127.0.0.1"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, output.Write(Result{CAPath: ca, Master: "https://127.0.0.1", Token: "test-token"}))
+	content, err := ioutil.ReadFile(path.Join(dir, "kubeadm.yaml"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "sha256:fd9be4d5f0034e6910e376b02038603d017e78e31f8f8b6c783e77cec85e78c2")
+}
@@ -17,11 +17,13 @@ limitations under the License.
 package aws
 
 import (
+	"context"
 	"os"
 
 	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
 
 	awsp "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
@@ -75,11 +77,15 @@ func getInstanceMetadata() (ec2metadata.EC2InstanceIdentityDocument, error) {
 }
 
 // GetNodeID returns our node id
-func (a *awsProvider) GetNodeID() (cloud.NodeID, error) {
+func (a *awsProvider) GetNodeID(ctx context.Context) (cloud.NodeID, error) {
 	if a.metadata == nil {
+		// the metadata client does not take a context, so the best we can do is check it
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
 		doc, err := getInstanceMetadata()
 		if err != nil {
-			return "", err
+			return "", translateError(err)
 		}
 		a.metadata = &doc
 	}
@@ -88,8 +94,8 @@ func (a *awsProvider) GetNodeID() (cloud.NodeID, error) {
 }
 
 // DescribePools is used to retrieve a list of node pools, filters if required by tags
-func (a *awsProvider) DescribePools(filter cloud.NodeTags) ([]cloud.Pool, error) {
-	groups, err := a.getFilterGroups(filter)
+func (a *awsProvider) DescribePools(ctx context.Context, filter cloud.Selector) ([]cloud.Pool, error) {
+	groups, err := a.getFilterGroups(ctx, filter)
 	if err != nil {
 		return []cloud.Pool{}, err
 	}
@@ -98,16 +104,11 @@ func (a *awsProvider) DescribePools(filter cloud.NodeTags) ([]cloud.Pool, error)
 	for _, x := range groups {
 		pool := cloud.Pool{
 			Name: *x.AutoScalingGroupName,
-			Tags: make(cloud.NodeTags, 0),
+			Tags: getGroupTags(x.Tags),
 		}
 		for _, i := range x.Instances {
 			pool.Nodes = append(pool.Nodes, cloud.NodeID(*i.InstanceId))
 		}
-		for _, t := range x.Tags {
-			if t.Key != nil && t.Value != nil {
-				pool.Tags[*t.Key] = *t.Value
-			}
-		}
 		pools = append(pools, pool)
 	}
 
@@ -115,12 +116,12 @@ func (a *awsProvider) DescribePools(filter cloud.NodeTags) ([]cloud.Pool, error)
 }
 
 // GetNodeTags retrieves a list of tags for a specific node
-func (a *awsProvider) GetNodeTags(id cloud.NodeID) (cloud.NodeTags, error) {
-	resp, err := a.compute.DescribeInstances(&ec2.DescribeInstancesInput{
+func (a *awsProvider) GetNodeTags(ctx context.Context, id cloud.NodeID) (cloud.NodeTags, error) {
+	resp, err := a.compute.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{awsp.String(string(id))},
 	})
 	if err != nil {
-		return cloud.NodeTags{}, err
+		return cloud.NodeTags{}, translateError(err)
 	}
 
 	tags := make(cloud.NodeTags, 0)
@@ -142,9 +143,114 @@ func (a *awsProvider) GetNodeTags(id cloud.NodeID) (cloud.NodeTags, error) {
 	return tags, nil
 }
 
+// GetNodeNames returns the names the instance may register with, the private dns name
+// being the name used by the kubelet aws cloud provider
+func (a *awsProvider) GetNodeNames(ctx context.Context, id cloud.NodeID) ([]string, error) {
+	resp, err := a.compute.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{awsp.String(string(id))},
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if len(resp.Reservations) <= 0 || len(resp.Reservations[0].Instances) <= 0 {
+		return nil, cloud.ErrInstanceNotFound
+	}
+
+	names := []string{string(id)}
+	if i := resp.Reservations[0].Instances[0]; i.PrivateDnsName != nil && *i.PrivateDnsName != "" {
+		names = append(names, *i.PrivateDnsName)
+	}
+
+	return names, nil
+}
+
+// GetNodeAddresses returns the private ip address of the instance
+func (a *awsProvider) GetNodeAddresses(ctx context.Context, id cloud.NodeID) ([]string, error) {
+	resp, err := a.compute.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{awsp.String(string(id))},
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if len(resp.Reservations) <= 0 || len(resp.Reservations[0].Instances) <= 0 {
+		return nil, cloud.ErrInstanceNotFound
+	}
+
+	addresses := []string{}
+	if i := resp.Reservations[0].Instances[0]; i.PrivateIpAddress != nil && *i.PrivateIpAddress != "" {
+		addresses = append(addresses, *i.PrivateIpAddress)
+	}
+
+	return addresses, nil
+}
+
+// DescribeNodes describes the instances with the ids or the private dns names, one call for
+// each. Filters are used rather than the instance ids, as asking for an instance which has
+// gone fails the whole call
+func (a *awsProvider) DescribeNodes(ctx context.Context, ids []cloud.NodeID, names []string) ([]cloud.Node, error) {
+	var filters []*ec2.Filter
+	if len(ids) > 0 {
+		var values []*string
+		for _, x := range ids {
+			values = append(values, awsp.String(string(x)))
+		}
+		filters = append(filters, &ec2.Filter{Name: awsp.String("instance-id"), Values: values})
+	}
+	if len(names) > 0 {
+		filters = append(filters, &ec2.Filter{Name: awsp.String("private-dns-name"), Values: awsp.StringSlice(names)})
+	}
+
+	var list []cloud.Node
+	seen := make(map[cloud.NodeID]bool, 0)
+	for _, x := range filters {
+		resp, err := a.compute.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{x},
+		})
+		if err != nil {
+			return nil, translateError(err)
+		}
+		for _, r := range resp.Reservations {
+			for _, i := range r.Instances {
+				if i.InstanceId == nil || seen[cloud.NodeID(*i.InstanceId)] {
+					continue
+				}
+				node := getInstanceNode(i)
+				seen[node.ID] = true
+				list = append(list, node)
+			}
+		}
+	}
+
+	return list, nil
+}
+
+// getInstanceNode converts the instance to a node
+func getInstanceNode(i *ec2.Instance) cloud.Node {
+	node := cloud.Node{
+		ID:        cloud.NodeID(*i.InstanceId),
+		Names:     []string{*i.InstanceId},
+		Addresses: []string{},
+		Tags:      make(cloud.NodeTags, 0),
+	}
+	if i.PrivateDnsName != nil && *i.PrivateDnsName != "" {
+		node.Names = append(node.Names, *i.PrivateDnsName)
+	}
+	if i.PrivateIpAddress != nil && *i.PrivateIpAddress != "" {
+		node.Addresses = append(node.Addresses, *i.PrivateIpAddress)
+	}
+	for _, t := range i.Tags {
+		if t.Key == nil || t.Value == nil {
+			continue
+		}
+		node.Tags[*t.Key] = *t.Value
+	}
+
+	return node
+}
+
 // GetNodeTag retrieves a specific instance tag
-func (a *awsProvider) GetNodeTag(id cloud.NodeID, tag string) (string, bool, error) {
-	tags, err := a.GetNodeTags(id)
+func (a *awsProvider) GetNodeTag(ctx context.Context, id cloud.NodeID, tag string) (string, bool, error) {
+	tags, err := a.GetNodeTags(ctx, id)
 	if err != nil {
 		return "", false, err
 	}
@@ -159,7 +265,7 @@ func (a *awsProvider) GetNodeTag(id cloud.NodeID, tag string) (string, bool, err
 }
 
 // SetNodeTags updates the tags of a instance
-func (a *awsProvider) SetNodeTags(nodeID cloud.NodeID, tags cloud.NodeTags) error {
+func (a *awsProvider) SetNodeTags(ctx context.Context, nodeID cloud.NodeID, tags cloud.NodeTags) error {
 	if len(tags) < 0 {
 		return nil
 	}
@@ -173,20 +279,20 @@ func (a *awsProvider) SetNodeTags(nodeID cloud.NodeID, tags cloud.NodeTags) erro
 	}
 
 	// step: attempting to update the tags
-	_, err := a.compute.CreateTags(&ec2.CreateTagsInput{
+	_, err := a.compute.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
 		Resources: []*string{awsp.String(string(nodeID))},
 		Tags:      newTags,
 	})
 
-	return err
+	return translateError(err)
 }
 
 // getFiltersGroups retrieves a list of auto-scaling groups and applies the filter. For some
 // god-forsaken reason you cannot search by tags
-func (a *awsProvider) getFilterGroups(filter cloud.NodeTags) ([]*autoscaling.Group, error) {
-	resp, err := a.client.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{})
+func (a *awsProvider) getFilterGroups(ctx context.Context, filter cloud.Selector) ([]*autoscaling.Group, error) {
+	resp, err := a.client.DescribeAutoScalingGroupsWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{})
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 
 	// if we are not filtering
@@ -197,7 +303,7 @@ func (a *awsProvider) getFilterGroups(filter cloud.NodeTags) ([]*autoscaling.Gro
 	// step: filter out the groups
 	var list []*autoscaling.Group
 	for _, x := range resp.AutoScalingGroups {
-		if filterGroupByTags(filter, x.Tags) {
+		if filter.Matches(getGroupTags(x.Tags)) {
 			list = append(list, x)
 		}
 	}
@@ -205,19 +311,72 @@ func (a *awsProvider) getFilterGroups(filter cloud.NodeTags) ([]*autoscaling.Gro
 	return list, nil
 }
 
-// filterGroupByTags checks the group has all the required tags
-func filterGroupByTags(filter cloud.NodeTags, tags []*autoscaling.TagDescription) bool {
-	count := 0
-	for k, v := range filter {
-		for _, tag := range tags {
-			if tag == nil || tag.Value == nil {
-				continue
-			}
-			if *tag.Key == k && *tag.Value == v {
-				count++
-			}
+// getGroupTags converts the tags of the group
+func getGroupTags(tags []*autoscaling.TagDescription) cloud.NodeTags {
+	list := make(cloud.NodeTags, 0)
+	for _, t := range tags {
+		if t != nil && t.Key != nil && t.Value != nil {
+			list[*t.Key] = *t.Value
 		}
 	}
 
-	return count == len(filter)
+	return list
+}
+
+// errorCodes maps the aws error codes onto the kind of error
+var errorCodes = map[string]cloud.Kind{
+	// throttling
+	"ProvisionedThroughputExceededException": cloud.Throttled,
+	"RequestLimitExceeded":                   cloud.Throttled,
+	"RequestThrottled":                       cloud.Throttled,
+	"RequestThrottledException":              cloud.Throttled,
+	"Throttling":                             cloud.Throttled,
+	"ThrottlingException":                    cloud.Throttled,
+	"TooManyRequestsException":               cloud.Throttled,
+	// transient
+	"EC2MetadataRequestError":     cloud.Transient,
+	"InternalError":               cloud.Transient,
+	"InternalFailure":             cloud.Transient,
+	"RequestError":                cloud.Transient,
+	"RequestTimeout":              cloud.Transient,
+	"RequestTimeoutException":     cloud.Transient,
+	"ServiceUnavailable":          cloud.Transient,
+	"Unavailable":                 cloud.Transient,
+	"ServiceUnavailableException": cloud.Transient,
+	// authentication and authorization
+	"AccessDenied":                cloud.Unauthorized,
+	"AccessDeniedException":       cloud.Unauthorized,
+	"AuthFailure":                 cloud.Unauthorized,
+	"ExpiredToken":                cloud.Unauthorized,
+	"ExpiredTokenException":       cloud.Unauthorized,
+	"InvalidClientTokenId":        cloud.Unauthorized,
+	"NoCredentialProviders":       cloud.Unauthorized,
+	"SignatureDoesNotMatch":       cloud.Unauthorized,
+	"UnauthorizedOperation":       cloud.Unauthorized,
+	"UnrecognizedClientException": cloud.Unauthorized,
+	// not found
+	"InvalidInstanceID.NotFound": cloud.NotFound,
+	// permanent
+	"InvalidInstanceID.Malformed": cloud.Invalid,
+	"InvalidParameterCombination": cloud.Invalid,
+	"InvalidParameterValue":       cloud.Invalid,
+	"MissingParameter":            cloud.Invalid,
+	"ValidationError":             cloud.Invalid,
+}
+
+// translateError classifies the aws errors into the cloud error kinds
+func translateError(err error) error {
+	e, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	if kind, found := errorCodes[e.Code()]; found {
+		return cloud.NewError(kind, err)
+	}
+	// step: fall back to the status code of the request
+	if r, ok := err.(awserr.RequestFailure); ok && r.StatusCode() >= 500 {
+		return cloud.NewError(cloud.Transient, err)
+	}
+
+	return err
 }
@@ -17,11 +17,14 @@ limitations under the License.
 package aws
 
 import (
+	"context"
 	"testing"
 
 	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
 
 	awsp "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -31,17 +34,26 @@ import (
 
 func TestDescribePools(t *testing.T) {
 	cs := []struct {
-		Tags cloud.NodeTags
-		Size int
+		Filter []string
+		Size   int
 	}{
-		{Tags: cloud.NodeTags{"Env": "dev"}, Size: 3},
-		{Tags: cloud.NodeTags{"Role": "compute"}, Size: 3},
-		{Tags: cloud.NodeTags{"Role": "compute", "Env": "dev"}, Size: 2},
-		{Tags: cloud.NodeTags{"Role": "master"}, Size: 1},
+		{Filter: []string{"Env=dev"}, Size: 3},
+		{Filter: []string{"Role=compute"}, Size: 3},
+		{Filter: []string{"Role=compute", "Env=dev"}, Size: 2},
+		{Filter: []string{"Role=master"}, Size: 1},
+		{Filter: []string{"Role=compute,Env!=dev"}, Size: 1},
+		{Filter: []string{"Env in (dev, other_env)"}, Size: 4},
+		{Filter: []string{"Role", "!Missing"}, Size: 4},
+		{Filter: []string{"Env=other_*"}, Size: 1},
+		{Filter: []string{"Role=compute", "Env=~^(dev|qa)$"}, Size: 2},
 	}
 	p := newFakeAWS(newFakeSetup())
 	for i, c := range cs {
-		g, err := p.DescribePools(c.Tags)
+		selector, err := cloud.ParseSelector(c.Filter)
+		if !assert.NoError(t, err, "case %d should have parsed", i) {
+			continue
+		}
+		g, err := p.DescribePools(context.Background(), selector)
 		assert.NoError(t, err, "case %d should not have thrown error", i)
 		if !assert.NotNil(t, g, "case %d should not be nil", i) {
 			continue
@@ -52,7 +64,7 @@ func TestDescribePools(t *testing.T) {
 
 func TestDescribePoolsEmpty(t *testing.T) {
 	p := newFakeAWS(newFakeSetup())
-	groups, err := p.DescribePools(nil)
+	groups, err := p.DescribePools(context.Background(), nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, groups)
 	assert.NotEmpty(t, groups)
@@ -61,9 +73,9 @@ func TestDescribePoolsEmpty(t *testing.T) {
 
 func TestDescribePoolsByFilter(t *testing.T) {
 	p := newFakeAWS(newFakeSetup())
-	groups, err := p.DescribePools(cloud.NodeTags{
+	groups, err := p.DescribePools(context.Background(), cloud.NewSelector(cloud.NodeTags{
 		"Role": "master",
-	})
+	}))
 	assert.NoError(t, err)
 	assert.NotNil(t, groups)
 	assert.NotEmpty(t, groups)
@@ -73,14 +85,14 @@ func TestDescribePoolsByFilter(t *testing.T) {
 
 func TestGetNodeTags(t *testing.T) {
 	p := newFakeAWS(newFakeSetup())
-	tags, err := p.GetNodeTags("compute00")
+	tags, err := p.GetNodeTags(context.Background(), "compute00")
 	assert.NoError(t, err)
 	assert.NotEmpty(t, tags)
 }
 
 func TestGetNodeTagsNotFound(t *testing.T) {
 	p := newFakeAWS(newFakeSetup())
-	tags, err := p.GetNodeTags("not_there")
+	tags, err := p.GetNodeTags(context.Background(), "not_there")
 	assert.Error(t, err)
 	assert.Empty(t, tags)
 	assert.Equal(t, err.Error(), cloud.ErrInstanceNotFound.Error())
@@ -111,7 +123,7 @@ func TestGetNodeTag(t *testing.T) {
 	}
 	p := newFakeAWS(newFakeSetup())
 	for i, c := range cs {
-		v, found, err := p.GetNodeTag(c.ID, c.Tag)
+		v, found, err := p.GetNodeTag(context.Background(), c.ID, c.Tag)
 		if !c.NoError && err == nil {
 			t.Errorf("case %d should not have thrown error: %s", i, err)
 			continue
@@ -125,6 +137,41 @@ func TestGetNodeTag(t *testing.T) {
 	}
 }
 
+func TestGetNodeNames(t *testing.T) {
+	p := newFakeAWS(newFakeSetup())
+	names, err := p.GetNodeNames(context.Background(), "compute00")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"compute00", "compute00.compute.internal"}, names)
+	_, err = p.GetNodeNames(context.Background(), "not_there")
+	assert.Error(t, err)
+}
+
+func TestGetNodeAddresses(t *testing.T) {
+	p := newFakeAWS(newFakeSetup())
+	addresses, err := p.GetNodeAddresses(context.Background(), "compute00")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.10"}, addresses)
+	_, err = p.GetNodeAddresses(context.Background(), "not_there")
+	assert.Error(t, err)
+}
+
+func TestDescribeNodes(t *testing.T) {
+	p := newFakeAWS(newFakeSetup())
+	nodes, err := p.DescribeNodes(context.Background(),
+		[]cloud.NodeID{"compute00", "not_there"}, []string{"compute10.compute.internal", "compute00.compute.internal"})
+	assert.NoError(t, err)
+	if !assert.Equal(t, 2, len(nodes)) {
+		return
+	}
+	assert.Equal(t, cloud.NodeID("compute00"), nodes[0].ID)
+	assert.Equal(t, []string{"compute00", "compute00.compute.internal"}, nodes[0].Names)
+	assert.Equal(t, []string{"10.0.0.10"}, nodes[0].Addresses)
+	assert.Equal(t, cloud.NodeID("compute10"), nodes[1].ID)
+	nodes, err = p.DescribeNodes(context.Background(), nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, nodes)
+}
+
 func TestSetNodeTag(t *testing.T) {
 	cs := []struct {
 		ID   cloud.NodeID
@@ -138,7 +185,7 @@ func TestSetNodeTag(t *testing.T) {
 	}
 	p := newFakeAWS(newFakeSetup())
 	for i, c := range cs {
-		err := p.SetNodeTags(c.ID, c.Tags)
+		err := p.SetNodeTags(context.Background(), c.ID, c.Tags)
 		if !c.Ok && err != nil {
 			t.Errorf("case %d should have thrown error", i)
 			continue
@@ -147,6 +194,42 @@ func TestSetNodeTag(t *testing.T) {
 	}
 }
 
+func TestCancelledContext(t *testing.T) {
+	p := newFakeAWS(newFakeSetup())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := p.DescribePools(ctx, nil)
+	assert.Equal(t, context.Canceled, err)
+	_, err = p.GetNodeTags(ctx, "compute00")
+	assert.Equal(t, context.Canceled, err)
+	err = p.SetNodeTags(ctx, "compute00", cloud.NodeTags{"Test": "Tag"})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestTranslateError(t *testing.T) {
+	cs := []struct {
+		Err  error
+		Kind cloud.Kind
+	}{
+		{},
+		{Err: cloud.ErrInstanceNotFound, Kind: cloud.NotFound},
+		{Err: awserr.New("RequestLimitExceeded", "slow down", nil), Kind: cloud.Throttled},
+		{Err: awserr.New("Throttling", "rate exceeded", nil), Kind: cloud.Throttled},
+		{Err: awserr.New("RequestError", "send request failed", nil), Kind: cloud.Transient},
+		{Err: awserr.New("UnauthorizedOperation", "not allowed", nil), Kind: cloud.Unauthorized},
+		{Err: awserr.New("InvalidInstanceID.NotFound", "not found", nil), Kind: cloud.NotFound},
+		{Err: awserr.New("InvalidParameterValue", "bad filter", nil), Kind: cloud.Invalid},
+		{Err: awserr.New("SomethingNew", "who knows", nil), Kind: cloud.Unknown},
+	}
+	for i, c := range cs {
+		err := translateError(c.Err)
+		assert.Equal(t, c.Kind, cloud.KindOf(err), "case %d", i)
+		if c.Err != nil {
+			assert.Equal(t, c.Err.Error(), err.Error(), "case %d", i)
+		}
+	}
+}
+
 func newFakeSetup() []cloud.Pool {
 	return []cloud.Pool{
 		{
@@ -207,7 +290,10 @@ type fakeAutoscalingProvider struct {
 	pools []cloud.Pool
 }
 
-func (f *fakeAutoscalingProvider) DescribeAutoScalingGroups(input *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+func (f *fakeAutoscalingProvider) DescribeAutoScalingGroupsWithContext(ctx awsp.Context, input *autoscaling.DescribeAutoScalingGroupsInput, options ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	resp := &autoscaling.DescribeAutoScalingGroupsOutput{
 		AutoScalingGroups: make([]*autoscaling.Group, 0),
 	}
@@ -240,9 +326,18 @@ type fakeComputeProvider struct {
 	nodes map[cloud.NodeID]cloud.NodeTags
 }
 
-func (f *fakeComputeProvider) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+func (f *fakeComputeProvider) DescribeInstancesWithContext(ctx awsp.Context, input *ec2.DescribeInstancesInput, options ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	instances := make([]*ec2.Instance, 0)
-	if input.InstanceIds != nil && len(input.InstanceIds) > 0 {
+	if len(input.Filters) > 0 {
+		for id, n := range f.nodes {
+			if i := f.convertToInstance(id, n); matchesFilters(i, input.Filters) {
+				instances = append(instances, i)
+			}
+		}
+	} else if input.InstanceIds != nil && len(input.InstanceIds) > 0 {
 		for _, id := range input.InstanceIds {
 			nodeID := cloud.NodeID(*id)
 			if n, found := f.nodes[nodeID]; found {
@@ -262,7 +357,10 @@ func (f *fakeComputeProvider) DescribeInstances(input *ec2.DescribeInstancesInpu
 	}, nil
 }
 
-func (f *fakeComputeProvider) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+func (f *fakeComputeProvider) CreateTagsWithContext(ctx awsp.Context, input *ec2.CreateTagsInput, options ...request.Option) (*ec2.CreateTagsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	for _, r := range input.Resources {
 		nodeID := cloud.NodeID(*r)
 		if node, found := f.nodes[nodeID]; found {
@@ -275,10 +373,31 @@ func (f *fakeComputeProvider) CreateTags(input *ec2.CreateTagsInput) (*ec2.Creat
 	return nil, nil
 }
 
+// matchesFilters checks the instance matches the instance id and private dns name filters
+func matchesFilters(i *ec2.Instance, filters []*ec2.Filter) bool {
+	for _, x := range filters {
+		value := *i.InstanceId
+		if *x.Name == "private-dns-name" {
+			value = *i.PrivateDnsName
+		}
+		found := false
+		for _, v := range x.Values {
+			found = found || *v == value
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (f *fakeComputeProvider) convertToInstance(id cloud.NodeID, tags cloud.NodeTags) *ec2.Instance {
 	in := &ec2.Instance{
-		InstanceId: awsp.String(string(id)),
-		Tags:       make([]*ec2.Tag, 0),
+		InstanceId:       awsp.String(string(id)),
+		PrivateDnsName:   awsp.String(string(id) + ".compute.internal"),
+		PrivateIpAddress: awsp.String("10.0.0.10"),
+		Tags:             make([]*ec2.Tag, 0),
 	}
 	for k, v := range tags {
 		in.Tags = append(in.Tags, &ec2.Tag{
@@ -17,15 +17,33 @@ limitations under the License.
 package cloud
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"sort"
 	"strings"
 )
 
+const (
+	// CompletedTagValue is the value of the token tag once the client has consumed the token
+	CompletedTagValue = "Success"
+	// RequestTagValue is the value of the token tag when the client is requesting a new token
+	RequestTagValue = "Request"
+	// RevokedTagValue is the value of the token tag once an administrator has revoked the
+	// token; the server issues no more until the tag is reset to RequestTagValue
+	RevokedTagValue = "Revoked"
+	// NonceTagSuffix is appended to the tag name to make the tag carrying the nonce of the
+	// last conditional update
+	NonceTagSuffix = "Nonce"
+)
+
 var (
 	// ErrInstanceNotFound was not found
 	ErrInstanceNotFound = errors.New("no instances found")
+	// ErrTagChanged indicates the tag did not hold the expected value
+	ErrTagChanged = errors.New("tag value has changed")
 )
 
 // Pool is a collection of compute nodes
@@ -67,24 +85,169 @@ func (n *NodeTags) Clone() NodeTags {
 	return m
 }
 
+// Node describes an instance
+type Node struct {
+	// ID is the node id
+	ID NodeID
+	// Names are the names the node may register with in kubernetes
+	Names []string
+	// Addresses are the private ip addresses of the node
+	Addresses []string
+	// Tags are the tags on the node
+	Tags NodeTags
+}
+
 // Plugin represents a cloud provider plugin
 type Plugin interface {
 	// New returns an instance of a cloud provider
 	New() (Provider, error)
 }
 
-// Provider is the cloud provider interface
+// Provider is the cloud provider interface; the context bounds any calls made to the
+// cloud api
 type Provider interface {
 	// GetNodeID returns our own node id
-	GetNodeID() (NodeID, error)
-	// DescribePools retrieves a list of compute pool
-	DescribePools(NodeTags) ([]Pool, error)
+	GetNodeID(context.Context) (NodeID, error)
+	// DescribePools retrieves a list of compute pool matching the selector
+	DescribePools(context.Context, Selector) ([]Pool, error)
 	// GetNodeTags retrieves a list of node tags
-	GetNodeTags(NodeID) (NodeTags, error)
+	GetNodeTags(context.Context, NodeID) (NodeTags, error)
 	// GetNodeTag retrieves a specific node tag
-	GetNodeTag(NodeID, string) (string, bool, error)
+	GetNodeTag(context.Context, NodeID, string) (string, bool, error)
 	// SetNodeTags is used to set a series of tags on a node
-	SetNodeTags(NodeID, NodeTags) error
+	SetNodeTags(context.Context, NodeID, NodeTags) error
+}
+
+// ConditionalTagger is implemented by providers whose API supports a conditional
+// update (compare-and-swap) of a node tag
+type ConditionalTagger interface {
+	// SetNodeTagIf sets the tag to value only if it currently holds expected
+	SetNodeTagIf(context.Context, NodeID, string, string, string) error
+}
+
+// NodeNamer is implemented by providers able to resolve the names a node may register
+// with in kubernetes
+type NodeNamer interface {
+	// GetNodeNames returns the kubernetes node names of the node
+	GetNodeNames(context.Context, NodeID) ([]string, error)
+}
+
+// GetNodeNames returns the names the node may register with in kubernetes, falling back
+// to the node id for providers which do not implement NodeNamer
+func GetNodeNames(ctx context.Context, p Provider, id NodeID) ([]string, error) {
+	if n, ok := p.(NodeNamer); ok {
+		return n.GetNodeNames(ctx, id)
+	}
+
+	return []string{string(id)}, nil
+}
+
+// NodeAddresser is implemented by providers able to resolve the private addresses of a node
+type NodeAddresser interface {
+	// GetNodeAddresses returns the private ip addresses of the node
+	GetNodeAddresses(context.Context, NodeID) ([]string, error)
+}
+
+// NodeDescriber is implemented by providers able to describe a batch of nodes in a single call
+type NodeDescriber interface {
+	// DescribeNodes describes the nodes with the ids or registering with the names
+	DescribeNodes(context.Context, []NodeID, []string) ([]Node, error)
+}
+
+// DescribeNodes describes the nodes with the ids or registering with the names, leaving out
+// those which have gone. Providers which do not implement NodeDescriber are asked about each
+// node in turn, the names being taken as node ids
+func DescribeNodes(ctx context.Context, p Provider, ids []NodeID, names []string) ([]Node, error) {
+	if d, ok := p.(NodeDescriber); ok {
+		return d.DescribeNodes(ctx, ids, names)
+	}
+
+	var list []Node
+	seen := make(map[NodeID]bool, 0)
+	for _, x := range names {
+		ids = append(ids, NodeID(x))
+	}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		tags, err := p.GetNodeTags(ctx, id)
+		if err != nil {
+			if IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		node := Node{ID: id, Tags: tags}
+		if node.Names, err = GetNodeNames(ctx, p, id); err != nil {
+			return nil, err
+		}
+		if node.Addresses, err = GetNodeAddresses(ctx, p, id); err != nil {
+			return nil, err
+		}
+		list = append(list, node)
+	}
+
+	return list, nil
+}
+
+// GetNodeAddresses returns the private ip addresses of the node, none for providers which
+// do not implement NodeAddresser
+func GetNodeAddresses(ctx context.Context, p Provider, id NodeID) ([]string, error) {
+	if n, ok := p.(NodeAddresser); ok {
+		return n.GetNodeAddresses(ctx, id)
+	}
+
+	return []string{}, nil
+}
+
+// SetNodeTagIf updates the node tag to value only if it currently holds the expected
+// value, returning ErrTagChanged otherwise. Providers implementing ConditionalTagger
+// perform this atomically; for everyone else we read and compare, then write the value
+// along with a random nonce in the tag named key+NonceTagSuffix and read both back. Any
+// writer who updates the tag between our write and the read back replaces the nonce, so
+// we lose even when they wrote the same value. The one window left open is a writer who
+// read the expected value before our write but only writes after our read back
+func SetNodeTagIf(ctx context.Context, p Provider, id NodeID, key, expected, value string) error {
+	if c, ok := p.(ConditionalTagger); ok {
+		return c.SetNodeTagIf(ctx, id, key, expected, value)
+	}
+
+	current, found, err := p.GetNodeTag(ctx, id, key)
+	if err != nil {
+		return err
+	}
+	if !found || current != expected {
+		return ErrTagChanged
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	if err := p.SetNodeTags(ctx, id, NodeTags{key: value, key + NonceTagSuffix: nonce}); err != nil {
+		return err
+	}
+	// step: read back the tag and nonce, anyone writing after us has replaced the nonce
+	tags, err := p.GetNodeTags(ctx, id)
+	if err != nil {
+		return err
+	}
+	if tags[key] != value || tags[key+NonceTagSuffix] != nonce {
+		return ErrTagChanged
+	}
+
+	return nil
+}
+
+// newNonce returns a random nonce for a conditional update
+func newNonce() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
 }
 
 // providers is a map of registered providers
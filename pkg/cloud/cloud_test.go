@@ -17,6 +17,7 @@ limitations under the License.
 package cloud
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -27,6 +28,60 @@ type fakeProvider struct {
 	Provider
 }
 
+type fakeTagProvider struct {
+	Provider
+	tags NodeTags
+	// readback is called before the tags are read, as a concurrent writer
+	readback func(NodeTags)
+}
+
+func (f *fakeTagProvider) GetNodeTag(ctx context.Context, id NodeID, key string) (string, bool, error) {
+	v, found := f.tags[key]
+	return v, found, nil
+}
+
+func (f *fakeTagProvider) GetNodeTags(ctx context.Context, id NodeID) (NodeTags, error) {
+	if f.readback != nil {
+		f.readback(f.tags)
+	}
+	return f.tags.Clone(), nil
+}
+
+func (f *fakeTagProvider) SetNodeTags(ctx context.Context, id NodeID, tags NodeTags) error {
+	for k, v := range tags {
+		f.tags[k] = v
+	}
+	return nil
+}
+
+type fakeNodesProvider struct {
+	Provider
+	nodes map[NodeID]NodeTags
+}
+
+func (f *fakeNodesProvider) GetNodeTags(ctx context.Context, id NodeID) (NodeTags, error) {
+	tags, found := f.nodes[id]
+	if !found {
+		return nil, ErrInstanceNotFound
+	}
+	return tags, nil
+}
+
+type fakeConditionalProvider struct {
+	fakeTagProvider
+	called bool
+}
+
+func (f *fakeConditionalProvider) SetNodeTagIf(ctx context.Context, id NodeID, key, expected, value string) error {
+	f.called = true
+	if f.tags[key] != expected {
+		return ErrTagChanged
+	}
+	f.tags[key] = value
+
+	return nil
+}
+
 func (f *fakePlugin) New() (Provider, error) {
 	return &fakeProvider{}, nil
 }
@@ -55,6 +110,68 @@ func TestNodeClone(t *testing.T) {
 	assert.NotEmpty(t, n["test"])
 }
 
+func TestSetNodeTagIf(t *testing.T) {
+	cs := []struct {
+		Tags     NodeTags
+		Expected string
+		Err      error
+		Value    string
+	}{
+		{Tags: NodeTags{}, Expected: "token", Err: ErrTagChanged},
+		{Tags: NodeTags{"Token": "other"}, Expected: "token", Err: ErrTagChanged, Value: "other"},
+		{Tags: NodeTags{"Token": "token"}, Expected: "token", Value: "done"},
+	}
+	for i, c := range cs {
+		p := &fakeTagProvider{tags: c.Tags}
+		err := SetNodeTagIf(context.Background(), p, "node", "Token", c.Expected, "done")
+		assert.Equal(t, c.Err, err, "case %d, expected: %v, got: %v", i, c.Err, err)
+		assert.Equal(t, c.Value, p.tags["Token"], "case %d", i)
+	}
+}
+
+func TestSetNodeTagIfNonce(t *testing.T) {
+	p := &fakeTagProvider{tags: NodeTags{"Token": "token"}}
+	assert.NoError(t, SetNodeTagIf(context.Background(), p, "node", "Token", "token", "done"))
+	assert.NotEmpty(t, p.tags["Token"+NonceTagSuffix])
+
+	// step: a concurrent writer setting the same value still replaces the nonce
+	p = &fakeTagProvider{tags: NodeTags{"Token": "token"}}
+	p.readback = func(tags NodeTags) {
+		tags["Token"], tags["Token"+NonceTagSuffix] = "done", "theirs"
+	}
+	assert.Equal(t, ErrTagChanged, SetNodeTagIf(context.Background(), p, "node", "Token", "token", "done"))
+}
+
+func TestSetNodeTagIfConditional(t *testing.T) {
+	p := &fakeConditionalProvider{fakeTagProvider: fakeTagProvider{tags: NodeTags{"Token": "token"}}}
+	assert.Equal(t, ErrTagChanged, SetNodeTagIf(context.Background(), p, "node", "Token", "other", "done"))
+	assert.NoError(t, SetNodeTagIf(context.Background(), p, "node", "Token", "token", "done"))
+	assert.True(t, p.called)
+	assert.Equal(t, "done", p.tags["Token"])
+}
+
+func TestGetNodeNames(t *testing.T) {
+	names, err := GetNodeNames(context.Background(), &fakeTagProvider{}, "i-12345")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"i-12345"}, names)
+}
+
+func TestGetNodeAddresses(t *testing.T) {
+	addresses, err := GetNodeAddresses(context.Background(), &fakeTagProvider{}, "i-12345")
+	assert.NoError(t, err)
+	assert.Empty(t, addresses)
+}
+
+func TestDescribeNodes(t *testing.T) {
+	p := &fakeNodesProvider{nodes: map[NodeID]NodeTags{"i-12345": {"Name": "compute00"}, "i-67890": {}}}
+	nodes, err := DescribeNodes(context.Background(), p, []NodeID{"i-12345", "i-gone"}, []string{"i-67890", "i-12345"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Node{
+		{ID: "i-12345", Names: []string{"i-12345"}, Addresses: []string{}, Tags: NodeTags{"Name": "compute00"}},
+		{ID: "i-67890", Names: []string{"i-67890"}, Addresses: []string{}, Tags: NodeTags{}},
+	}, nodes)
+}
+
 func TestRegister(t *testing.T) {
 	err := Register("test", &fakePlugin{})
 	assert.NoError(t, err)
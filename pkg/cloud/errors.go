@@ -0,0 +1,131 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"errors"
+)
+
+// Kind is the class of a provider error, used by callers to decide whether to retry,
+// back off or fail fast
+type Kind int
+
+const (
+	// Unknown is an error we know nothing about
+	Unknown Kind = iota
+	// Throttled means the provider is rate limiting our requests
+	Throttled
+	// Transient is a temporary failure, i.e. a network error or server fault
+	Transient
+	// Unauthorized means the credentials are missing, invalid or lack permissions
+	Unauthorized
+	// NotFound means the resource does not exist
+	NotFound
+	// Invalid is a permanent failure due to a bad request or misconfiguration
+	Invalid
+)
+
+// String returns the name of the kind
+func (k Kind) String() string {
+	switch k {
+	case Throttled:
+		return "throttled"
+	case Transient:
+		return "transient"
+	case Unauthorized:
+		return "unauthorized"
+	case NotFound:
+		return "not-found"
+	case Invalid:
+		return "invalid"
+	}
+
+	return "unknown"
+}
+
+// Error is a provider error classified by kind
+type Error struct {
+	// Kind is the class of error
+	Kind Kind
+	// Err is the underlying error
+	Err error
+}
+
+// Error returns the message of the underlying error
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+var (
+	// ErrThrottled indicates the provider is rate limiting our requests
+	ErrThrottled = NewError(Throttled, errors.New("request throttled by the provider"))
+)
+
+// NewError classifies the error, returning nil if there is no error
+func NewError(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &Error{Kind: kind, Err: err}
+}
+
+// KindOf returns the kind of the error
+func KindOf(err error) Kind {
+	switch e := err.(type) {
+	case nil:
+		return Unknown
+	case *Error:
+		return e.Kind
+	}
+	if err == ErrInstanceNotFound {
+		return NotFound
+	}
+
+	return Unknown
+}
+
+// IsThrottled checks if the provider is rate limiting us
+func IsThrottled(err error) bool {
+	return KindOf(err) == Throttled
+}
+
+// IsRetryable checks if the error is temporary, retrying will likely succeed
+func IsRetryable(err error) bool {
+	switch KindOf(err) {
+	case Throttled, Transient:
+		return true
+	}
+
+	return false
+}
+
+// IsPermanent checks if the error will not go away by retrying, i.e. bad credentials or
+// misconfiguration, and we should fail fast
+func IsPermanent(err error) bool {
+	switch KindOf(err) {
+	case Unauthorized, Invalid:
+		return true
+	}
+
+	return false
+}
+
+// IsNotFound checks if the resource does not exist
+func IsNotFound(err error) bool {
+	return KindOf(err) == NotFound
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewError(t *testing.T) {
+	assert.Nil(t, NewError(Throttled, nil))
+	err := NewError(Transient, errors.New("connection reset"))
+	assert.Equal(t, "connection reset", err.Error())
+	assert.Equal(t, Transient, KindOf(err))
+}
+
+func TestErrorKinds(t *testing.T) {
+	cs := []struct {
+		Err       error
+		Kind      Kind
+		Throttled bool
+		Retryable bool
+		Permanent bool
+		NotFound  bool
+	}{
+		{},
+		{Err: errors.New("unknown")},
+		{Err: ErrThrottled, Kind: Throttled, Throttled: true, Retryable: true},
+		{Err: NewError(Transient, errors.New("timeout")), Kind: Transient, Retryable: true},
+		{Err: NewError(Unauthorized, errors.New("denied")), Kind: Unauthorized, Permanent: true},
+		{Err: NewError(Invalid, errors.New("bad")), Kind: Invalid, Permanent: true},
+		{Err: NewError(NotFound, errors.New("gone")), Kind: NotFound, NotFound: true},
+		{Err: ErrInstanceNotFound, Kind: NotFound, NotFound: true},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Kind, KindOf(c.Err), "case %d", i)
+		assert.Equal(t, c.Throttled, IsThrottled(c.Err), "case %d", i)
+		assert.Equal(t, c.Retryable, IsRetryable(c.Err), "case %d", i)
+		assert.Equal(t, c.Permanent, IsPermanent(c.Err), "case %d", i)
+		assert.Equal(t, c.NotFound, IsNotFound(c.Err), "case %d", i)
+	}
+}
+
+func TestKindString(t *testing.T) {
+	assert.Equal(t, "throttled", Throttled.String())
+	assert.Equal(t, "unknown", Kind(100).String())
+}
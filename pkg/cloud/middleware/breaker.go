@@ -0,0 +1,114 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// breaker is a circuit breaker; after a run of consecutive failures the circuit opens and
+// calls fail immediately until the cooldown has passed, when a single trial call is let
+// through to decide whether to close it again
+type breaker struct {
+	sync.Mutex
+	// threshold is the consecutive failures which open the circuit
+	threshold int
+	// cooldown is the time the circuit stays open
+	cooldown time.Duration
+	// failures is the current run of failures
+	failures int
+	// openedAt is when the circuit was opened, zero when closed
+	openedAt time.Time
+	// trial indicates a trial call is in flight
+	trial bool
+	// now returns the time
+	now func() time.Time
+}
+
+// newBreaker creates a breaker, nil if disabled
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+
+	return &breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Allow checks if a call may proceed
+func (b *breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if b.trial || b.now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.trial = true
+
+	return true
+}
+
+// Success records a successful call, closing the circuit
+func (b *breaker) Success() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if !b.openedAt.IsZero() {
+		log.Info("provider has recovered, closing the circuit breaker")
+	}
+	b.failures = 0
+	b.openedAt = time.Time{}
+	b.trial = false
+}
+
+// Release records a call which neither succeeded nor failed, only freeing the trial so
+// another may be let through
+func (b *breaker) Release() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.trial = false
+}
+
+// Failure records a failed call, opening the circuit once over the threshold
+func (b *breaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.failures++
+	if b.trial || (b.openedAt.IsZero() && b.failures >= b.threshold) {
+		log.WithFields(log.Fields{
+			"cooldown": b.cooldown.String(),
+			"failures": b.failures,
+		}).Error("provider is failing, opening the circuit breaker")
+		b.openedAt = b.now()
+		b.trial = false
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CacheOptions are the options for the caching provider
+type CacheOptions struct {
+	// PoolsTTL is how long the node pools are cached, zero disables
+	PoolsTTL time.Duration
+	// TagsTTL is how long a found tag is cached, zero disables. It is off by default as the
+	// token tag is how the clients ask for and acknowledge tokens, which a cached tag delays
+	TagsTTL time.Duration
+	// NegativeTTL is how long a missing tag or instance is cached, zero disables
+	NegativeTTL time.Duration
+}
+
+// IsValid checks the cache options are valid
+func (c *CacheOptions) IsValid() error {
+	if c.PoolsTTL < 0 || c.TagsTTL < 0 || c.NegativeTTL < 0 {
+		return errors.New("cache ttl cannot be negative")
+	}
+
+	return nil
+}
+
+// cacheEntry is a cached result
+type cacheEntry struct {
+	expires time.Time
+	pools   []cloud.Pool
+	tags    cloud.NodeTags
+	value   string
+	found   bool
+	err     error
+}
+
+// cachingProvider caches the lookups of a cloud provider
+type cachingProvider struct {
+	sync.RWMutex
+	options CacheOptions
+	next    cloud.Provider
+	// pools is keyed by the filter
+	pools map[string]cacheEntry
+	// tags is keyed by node, then by tag (an empty key holding all the tags)
+	tags map[cloud.NodeID]map[string]cacheEntry
+	// generations is bumped on every invalidation of the node, so a lookup which raced a
+	// write does not put back what it read before the write; these are never pruned, as
+	// a lookup may still be in flight, costing a counter per node written to
+	generations map[cloud.NodeID]uint64
+	// now returns the time
+	now func() time.Time
+}
+
+// NewCache decorates the provider with a cache
+func NewCache(p cloud.Provider, options CacheOptions) (cloud.Provider, error) {
+	if err := options.IsValid(); err != nil {
+		return nil, err
+	}
+
+	return &cachingProvider{
+		next:        p,
+		now:         time.Now,
+		options:     options,
+		pools:       make(map[string]cacheEntry, 0),
+		tags:        make(map[cloud.NodeID]map[string]cacheEntry, 0),
+		generations: make(map[cloud.NodeID]uint64, 0),
+	}, nil
+}
+
+// GetNodeID returns our own node id
+func (c *cachingProvider) GetNodeID(ctx context.Context) (cloud.NodeID, error) {
+	return c.next.GetNodeID(ctx)
+}
+
+// DescribePools retrieves a list of compute pool
+func (c *cachingProvider) DescribePools(ctx context.Context, filter cloud.Selector) ([]cloud.Pool, error) {
+	key := filter.String()
+	c.RLock()
+	entry, found := c.pools[key]
+	c.RUnlock()
+	if found && c.now().Before(entry.expires) {
+		return entry.pools, nil
+	}
+
+	c.prune()
+	pools, err := c.next.DescribePools(ctx, filter)
+	if err == nil && c.options.PoolsTTL > 0 {
+		c.Lock()
+		c.pools[key] = cacheEntry{expires: c.now().Add(c.options.PoolsTTL), pools: pools}
+		c.Unlock()
+	}
+
+	return pools, err
+}
+
+// GetNodeTags retrieves a list of node tags
+func (c *cachingProvider) GetNodeTags(ctx context.Context, id cloud.NodeID) (cloud.NodeTags, error) {
+	entry, found, generation := c.lookup(id, "")
+	if found {
+		return entry.tags.Clone(), entry.err
+	}
+
+	tags, err := c.next.GetNodeTags(ctx, id)
+	switch {
+	case err == nil:
+		c.store(id, "", generation, cacheEntry{tags: tags.Clone()}, c.options.TagsTTL)
+	case cloud.IsNotFound(err):
+		c.store(id, "", generation, cacheEntry{tags: cloud.NodeTags{}, err: err}, c.options.NegativeTTL)
+	}
+
+	return tags, err
+}
+
+// GetNodeTag retrieves a specific node tag
+func (c *cachingProvider) GetNodeTag(ctx context.Context, id cloud.NodeID, key string) (string, bool, error) {
+	entry, cached, generation := c.lookup(id, "tag:"+key)
+	if cached {
+		return entry.value, entry.found, entry.err
+	}
+
+	value, found, err := c.next.GetNodeTag(ctx, id, key)
+	switch {
+	case err == nil && found:
+		c.store(id, "tag:"+key, generation, cacheEntry{value: value, found: true}, c.options.TagsTTL)
+	case err == nil:
+		c.store(id, "tag:"+key, generation, cacheEntry{}, c.options.NegativeTTL)
+	case cloud.IsNotFound(err):
+		c.store(id, "tag:"+key, generation, cacheEntry{err: err}, c.options.NegativeTTL)
+	}
+
+	return value, found, err
+}
+
+// SetNodeTags is used to set a series of tags on a node, invalidating the node
+func (c *cachingProvider) SetNodeTags(ctx context.Context, id cloud.NodeID, tags cloud.NodeTags) error {
+	defer c.Invalidate(id)
+
+	return c.next.SetNodeTags(ctx, id, tags)
+}
+
+// GetNodeNames returns the kubernetes node names of the node
+func (c *cachingProvider) GetNodeNames(ctx context.Context, id cloud.NodeID) ([]string, error) {
+	return cloud.GetNodeNames(ctx, c.next, id)
+}
+
+// GetNodeAddresses returns the private ip addresses of the node
+func (c *cachingProvider) GetNodeAddresses(ctx context.Context, id cloud.NodeID) ([]string, error) {
+	return cloud.GetNodeAddresses(ctx, c.next, id)
+}
+
+// DescribeNodes describes a batch of nodes, always from the provider
+func (c *cachingProvider) DescribeNodes(ctx context.Context, ids []cloud.NodeID, names []string) ([]cloud.Node, error) {
+	return cloud.DescribeNodes(ctx, c.next, ids, names)
+}
+
+// SetNodeTagIf sets the tag only if it holds the expected value, invalidating the node. The
+// comparison is always made against the provider, never a cached value
+func (c *cachingProvider) SetNodeTagIf(ctx context.Context, id cloud.NodeID, key, expected, value string) error {
+	defer c.Invalidate(id)
+
+	return cloud.SetNodeTagIf(ctx, c.next, id, key, expected, value)
+}
+
+// Invalidate removes the cached entries for the node, bumping its generation so any
+// lookup already in flight is not stored
+func (c *cachingProvider) Invalidate(id cloud.NodeID) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.tags, id)
+	c.generations[id]++
+}
+
+// lookup returns the cached entry if present and not expired, along with the generation
+// of the node to hand to store should the caller go to the provider
+func (c *cachingProvider) lookup(id cloud.NodeID, key string) (cacheEntry, bool, uint64) {
+	c.RLock()
+	defer c.RUnlock()
+	entry, found := c.tags[id][key]
+	if !found || !c.now().Before(entry.expires) {
+		return cacheEntry{}, false, c.generations[id]
+	}
+	log.WithFields(log.Fields{
+		"key":  key,
+		"node": id,
+	}).Debug("serving node lookup from the cache")
+
+	return entry, true, c.generations[id]
+}
+
+// store caches the entry for the ttl, unless the node has been invalidated since the
+// generation was taken, in which case the entry may predate the write
+func (c *cachingProvider) store(id cloud.NodeID, key string, generation uint64, entry cacheEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.generations[id] != generation {
+		return
+	}
+	entries, found := c.tags[id]
+	if !found {
+		entries = make(map[string]cacheEntry, 0)
+		c.tags[id] = entries
+	}
+	entry.expires = c.now().Add(ttl)
+	entries[key] = entry
+}
+
+// prune removes the expired entries, so instances which have gone do not linger
+func (c *cachingProvider) prune() {
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	for id, entries := range c.tags {
+		for k, v := range entries {
+			if !now.Before(v.expires) {
+				delete(entries, k)
+			}
+		}
+		if len(entries) <= 0 {
+			delete(c.tags, id)
+		}
+	}
+}
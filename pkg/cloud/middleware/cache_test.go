@@ -0,0 +1,240 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheOptionsIsValid(t *testing.T) {
+	assert.NoError(t, (&CacheOptions{}).IsValid())
+	assert.NoError(t, newFakeCacheOptions().IsValid())
+	assert.Error(t, (&CacheOptions{TagsTTL: -1}).IsValid())
+}
+
+func TestCacheTags(t *testing.T) {
+	f := newFakeTagsProvider()
+	p, now := newFakeCache(f)
+	ctx := context.Background()
+
+	// step: a found tag is served from the cache until the ttl
+	for i := 0; i < 3; i++ {
+		v, found, err := p.GetNodeTag(ctx, "node", "KubeletToken")
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, "Success", v)
+	}
+	assert.Equal(t, 1, f.calls)
+	*now = now.Add(time.Minute)
+	p.GetNodeTag(ctx, "node", "KubeletToken")
+	assert.Equal(t, 2, f.calls)
+
+	// step: a missing tag is negatively cached for the shorter ttl
+	for i := 0; i < 3; i++ {
+		_, found, err := p.GetNodeTag(ctx, "node", "Missing")
+		assert.NoError(t, err)
+		assert.False(t, found)
+	}
+	assert.Equal(t, 3, f.calls)
+	*now = now.Add(10 * time.Second)
+	p.GetNodeTag(ctx, "node", "Missing")
+	assert.Equal(t, 4, f.calls)
+
+	// step: a missing instance is negatively cached
+	for i := 0; i < 3; i++ {
+		_, _, err := p.GetNodeTag(ctx, "gone", "KubeletToken")
+		assert.Equal(t, cloud.ErrInstanceNotFound, err)
+	}
+	assert.Equal(t, 5, f.calls)
+}
+
+func TestCacheInvalidatesOnSet(t *testing.T) {
+	f := newFakeTagsProvider()
+	p, _ := newFakeCache(f)
+	ctx := context.Background()
+
+	_, found, _ := p.GetNodeTag(ctx, "node", "Token")
+	assert.False(t, found)
+	assert.NoError(t, p.SetNodeTags(ctx, "node", cloud.NodeTags{"Token": "token"}))
+	v, found, _ := p.GetNodeTag(ctx, "node", "Token")
+	assert.True(t, found)
+	assert.Equal(t, "token", v)
+
+	tags, err := p.GetNodeTags(ctx, "node")
+	assert.NoError(t, err)
+	assert.Equal(t, "token", tags["Token"])
+	assert.NoError(t, p.SetNodeTags(ctx, "node", cloud.NodeTags{"Token": "Success"}))
+	tags, _ = p.GetNodeTags(ctx, "node")
+	assert.Equal(t, "Success", tags["Token"])
+}
+
+func TestCacheDropsStaleLookups(t *testing.T) {
+	f := newFakeTagsProvider()
+	p, _ := newFakeCache(f)
+	ctx := context.Background()
+
+	// step: a write lands while the lookup is with the provider
+	f.during = func() {
+		f.during = nil
+		assert.NoError(t, p.SetNodeTags(ctx, "node", cloud.NodeTags{"KubeletToken": "Request"}))
+	}
+	v, _, _ := p.GetNodeTag(ctx, "node", "KubeletToken")
+	assert.Equal(t, "Success", v)
+	v, _, _ = p.GetNodeTag(ctx, "node", "KubeletToken")
+	assert.Equal(t, "Request", v)
+	assert.Equal(t, 2, f.calls)
+}
+
+func TestCachePools(t *testing.T) {
+	f := newFakeTagsProvider()
+	p, now := newFakeCache(f)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		pools, err := p.DescribePools(ctx, cloud.NewSelector(cloud.NodeTags{"Role": "compute"}))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(pools))
+	}
+	assert.Equal(t, 1, f.calls)
+	p.DescribePools(ctx, cloud.NewSelector(cloud.NodeTags{"Role": "master"}))
+	assert.Equal(t, 2, f.calls)
+	*now = now.Add(time.Minute)
+	p.DescribePools(ctx, cloud.NewSelector(cloud.NodeTags{"Role": "compute"}))
+	assert.Equal(t, 3, f.calls)
+}
+
+func TestCacheDisabled(t *testing.T) {
+	f := newFakeTagsProvider()
+	p, err := NewCache(f, CacheOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	p.DescribePools(ctx, cloud.NewSelector(cloud.NodeTags{}))
+	p.GetNodeTag(ctx, "node", "KubeletToken")
+	p.GetNodeTag(ctx, "node", "KubeletToken")
+	assert.Equal(t, 3, f.calls)
+}
+
+func TestCachePrune(t *testing.T) {
+	f := newFakeTagsProvider()
+	p, now := newFakeCache(f)
+	ctx := context.Background()
+	p.GetNodeTag(ctx, "gone", "KubeletToken")
+	*now = now.Add(time.Hour)
+	p.DescribePools(ctx, cloud.NewSelector(cloud.NodeTags{}))
+	assert.Empty(t, p.(*cachingProvider).tags)
+}
+
+func TestCacheOptionalInterfaces(t *testing.T) {
+	c := &fakeConditionalProvider{}
+	p, _ := NewCache(c, *newFakeCacheOptions())
+	_, ok := p.(cloud.ConditionalTagger)
+	assert.True(t, ok)
+	ctx := context.Background()
+	p.GetNodeTag(ctx, "node", "tag")
+	assert.NoError(t, cloud.SetNodeTagIf(ctx, p, "node", "tag", "token", "done"))
+	assert.True(t, c.called)
+	// step: the conditional write should have dropped the cached tag
+	p.GetNodeTag(ctx, "node", "tag")
+	assert.Equal(t, 2, c.calls)
+}
+
+func TestCacheConditionalBypassesCache(t *testing.T) {
+	f := newFakeTagsProvider()
+	p, _ := newFakeCache(f)
+	ctx := context.Background()
+
+	// step: cache the tag, then change it behind the cache's back
+	v, _, _ := p.GetNodeTag(ctx, "node", "KubeletToken")
+	assert.Equal(t, "Success", v)
+	f.tags["KubeletToken"] = "token"
+	assert.Equal(t, cloud.ErrTagChanged, cloud.SetNodeTagIf(ctx, p, "node", "KubeletToken", "Success", "Request"))
+	assert.Equal(t, "token", f.tags["KubeletToken"])
+	assert.NoError(t, cloud.SetNodeTagIf(ctx, p, "node", "KubeletToken", "token", "Success"))
+	assert.Equal(t, "Success", f.tags["KubeletToken"])
+}
+
+func newFakeCacheOptions() *CacheOptions {
+	return &CacheOptions{
+		NegativeTTL: 10 * time.Second,
+		PoolsTTL:    time.Minute,
+		TagsTTL:     time.Minute,
+	}
+}
+
+func newFakeCache(p cloud.Provider) (cloud.Provider, *time.Time) {
+	c, _ := NewCache(p, *newFakeCacheOptions())
+	now := time.Now()
+	c.(*cachingProvider).now = func() time.Time { return now }
+
+	return c, &now
+}
+
+// fakeTagsProvider holds the tags for a single node
+type fakeTagsProvider struct {
+	cloud.Provider
+	calls int
+	tags  cloud.NodeTags
+	// during is called while a tag is being read
+	during func()
+}
+
+func newFakeTagsProvider() *fakeTagsProvider {
+	return &fakeTagsProvider{tags: cloud.NodeTags{"KubeletToken": "Success"}}
+}
+
+func (f *fakeTagsProvider) DescribePools(ctx context.Context, filter cloud.Selector) ([]cloud.Pool, error) {
+	f.calls++
+
+	return []cloud.Pool{{Name: "pool", Nodes: []cloud.NodeID{"node"}}}, nil
+}
+
+func (f *fakeTagsProvider) GetNodeTags(ctx context.Context, id cloud.NodeID) (cloud.NodeTags, error) {
+	f.calls++
+	if id != "node" {
+		return cloud.NodeTags{}, cloud.ErrInstanceNotFound
+	}
+
+	return f.tags.Clone(), nil
+}
+
+func (f *fakeTagsProvider) GetNodeTag(ctx context.Context, id cloud.NodeID, key string) (string, bool, error) {
+	f.calls++
+	if id != "node" {
+		return "", false, cloud.ErrInstanceNotFound
+	}
+	v, found := f.tags[key]
+	if f.during != nil {
+		f.during()
+	}
+
+	return v, found, nil
+}
+
+func (f *fakeTagsProvider) SetNodeTags(ctx context.Context, id cloud.NodeID, tags cloud.NodeTags) error {
+	for k, v := range tags {
+		f.tags[k] = v
+	}
+
+	return nil
+}
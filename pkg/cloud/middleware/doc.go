@@ -0,0 +1,108 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package middleware provides decorators for any cloud.Provider, adding retries with
+// backoff, per-call timeouts and a circuit breaker
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// DescribeMethods are the provider methods describing the pools and instances, typically
+	// the slowest of the calls
+	DescribeMethods = []string{"DescribeNodes", "DescribePools", "GetNodeAddresses", "GetNodeNames"}
+	// TagMethods are the provider methods reading and writing the instance tags
+	TagMethods = []string{"GetNodeTag", "GetNodeTags", "SetNodeTagIf", "SetNodeTags"}
+)
+
+// Options are the options for the provider middleware
+type Options struct {
+	// Retries is the number of times a retryable failure is retried
+	Retries int
+	// Backoff is the initial wait between retries, doubling on each attempt
+	Backoff time.Duration
+	// MaxBackoff is the ceiling on the wait between retries
+	MaxBackoff time.Duration
+	// Timeout bounds each call to the provider, zero for no timeout
+	Timeout time.Duration
+	// Timeouts are the timeouts of specific methods, keyed by the method name and taking
+	// precedence over the Timeout
+	Timeouts map[string]time.Duration
+	// BreakerThreshold is the number of consecutive failures which opens the circuit,
+	// zero disables the breaker
+	BreakerThreshold int
+	// BreakerCooldown is how long the circuit stays open before a trial call
+	BreakerCooldown time.Duration
+}
+
+// IsValid checks the options are valid
+func (o *Options) IsValid() error {
+	if o.Retries < 0 {
+		return errors.New("retries cannot be negative")
+	}
+	if o.Retries > 0 && o.Backoff <= 0 {
+		return errors.New("retry backoff must be positive")
+	}
+	if o.MaxBackoff < 0 || (o.MaxBackoff > 0 && o.MaxBackoff < o.Backoff) {
+		return errors.New("max backoff must be greater than the backoff")
+	}
+	if o.Timeout < 0 {
+		return errors.New("timeout cannot be negative")
+	}
+	for method, timeout := range o.Timeouts {
+		if !isMethod(method) {
+			return fmt.Errorf("timeout given for unknown method: %s", method)
+		}
+		if timeout < 0 {
+			return fmt.Errorf("timeout for method: %s cannot be negative", method)
+		}
+	}
+	if o.BreakerThreshold < 0 {
+		return errors.New("breaker threshold cannot be negative")
+	}
+	if o.BreakerThreshold > 0 && o.BreakerCooldown <= 0 {
+		return errors.New("breaker cooldown must be positive")
+	}
+
+	return nil
+}
+
+// timeout returns the timeout of the method
+func (o *Options) timeout(method string) time.Duration {
+	if timeout, found := o.Timeouts[method]; found {
+		return timeout
+	}
+
+	return o.Timeout
+}
+
+// isMethod checks the method is one we decorate
+func isMethod(method string) bool {
+	if method == "GetNodeID" {
+		return true
+	}
+	for _, x := range append(DescribeMethods, TagMethods...) {
+		if x == method {
+			return true
+		}
+	}
+
+	return false
+}
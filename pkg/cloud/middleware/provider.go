@@ -0,0 +1,250 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// ErrCircuitOpen means the circuit breaker is open and the call was not made
+	ErrCircuitOpen = cloud.NewError(cloud.Throttled, errors.New("circuit breaker open, provider calls suspended"))
+)
+
+// provider decorates a cloud provider with retries, timeouts and a circuit breaker
+type provider struct {
+	options Options
+	next    cloud.Provider
+	breaker *breaker
+	// random is the source for the jitter
+	random *rand.Rand
+	// lock guards random
+	lock sync.Mutex
+}
+
+// conditionalProvider is the decorator for providers implementing cloud.ConditionalTagger
+type conditionalProvider struct {
+	*provider
+}
+
+// New decorates the provider
+func New(p cloud.Provider, options Options) (cloud.Provider, error) {
+	if err := options.IsValid(); err != nil {
+		return nil, err
+	}
+	m := &provider{
+		breaker: newBreaker(options.BreakerThreshold, options.BreakerCooldown),
+		next:    p,
+		options: options,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if _, ok := p.(cloud.ConditionalTagger); ok {
+		return &conditionalProvider{provider: m}, nil
+	}
+
+	return m, nil
+}
+
+// GetNodeID returns our own node id
+func (m *provider) GetNodeID(ctx context.Context) (cloud.NodeID, error) {
+	var id cloud.NodeID
+	err := m.call(ctx, "GetNodeID", true, func(ctx context.Context) (err error) {
+		id, err = m.next.GetNodeID(ctx)
+		return err
+	})
+
+	return id, err
+}
+
+// DescribePools retrieves a list of compute pool
+func (m *provider) DescribePools(ctx context.Context, filter cloud.Selector) ([]cloud.Pool, error) {
+	var pools []cloud.Pool
+	err := m.call(ctx, "DescribePools", true, func(ctx context.Context) (err error) {
+		pools, err = m.next.DescribePools(ctx, filter)
+		return err
+	})
+
+	return pools, err
+}
+
+// GetNodeTags retrieves a list of node tags
+func (m *provider) GetNodeTags(ctx context.Context, id cloud.NodeID) (cloud.NodeTags, error) {
+	var tags cloud.NodeTags
+	err := m.call(ctx, "GetNodeTags", true, func(ctx context.Context) (err error) {
+		tags, err = m.next.GetNodeTags(ctx, id)
+		return err
+	})
+
+	return tags, err
+}
+
+// GetNodeTag retrieves a specific node tag
+func (m *provider) GetNodeTag(ctx context.Context, id cloud.NodeID, key string) (string, bool, error) {
+	var value string
+	var found bool
+	err := m.call(ctx, "GetNodeTag", true, func(ctx context.Context) (err error) {
+		value, found, err = m.next.GetNodeTag(ctx, id, key)
+		return err
+	})
+
+	return value, found, err
+}
+
+// SetNodeTags is used to set a series of tags on a node; writing the same tags again is
+// harmless, so it is retried like the rest
+func (m *provider) SetNodeTags(ctx context.Context, id cloud.NodeID, tags cloud.NodeTags) error {
+	return m.call(ctx, "SetNodeTags", true, func(ctx context.Context) error {
+		return m.next.SetNodeTags(ctx, id, tags)
+	})
+}
+
+// GetNodeNames returns the kubernetes node names of the node
+func (m *provider) GetNodeNames(ctx context.Context, id cloud.NodeID) ([]string, error) {
+	var names []string
+	err := m.call(ctx, "GetNodeNames", true, func(ctx context.Context) (err error) {
+		names, err = cloud.GetNodeNames(ctx, m.next, id)
+		return err
+	})
+
+	return names, err
+}
+
+// GetNodeAddresses returns the private ip addresses of the node
+func (m *provider) GetNodeAddresses(ctx context.Context, id cloud.NodeID) ([]string, error) {
+	var addresses []string
+	err := m.call(ctx, "GetNodeAddresses", true, func(ctx context.Context) (err error) {
+		addresses, err = cloud.GetNodeAddresses(ctx, m.next, id)
+		return err
+	})
+
+	return addresses, err
+}
+
+// DescribeNodes describes a batch of nodes
+func (m *provider) DescribeNodes(ctx context.Context, ids []cloud.NodeID, names []string) ([]cloud.Node, error) {
+	var nodes []cloud.Node
+	err := m.call(ctx, "DescribeNodes", true, func(ctx context.Context) (err error) {
+		nodes, err = cloud.DescribeNodes(ctx, m.next, ids, names)
+		return err
+	})
+
+	return nodes, err
+}
+
+// SetNodeTagIf sets the tag only if it holds the expected value; it is not retried as we
+// cannot know if a failed attempt was applied
+func (c *conditionalProvider) SetNodeTagIf(ctx context.Context, id cloud.NodeID, key, expected, value string) error {
+	return c.call(ctx, "SetNodeTagIf", false, func(ctx context.Context) error {
+		return c.next.(cloud.ConditionalTagger).SetNodeTagIf(ctx, id, key, expected, value)
+	})
+}
+
+// call performs the call, applying the timeout, retries and breaker
+func (m *provider) call(ctx context.Context, method string, retry bool, fn func(context.Context) error) error {
+	attempts := 1
+	if retry {
+		attempts += m.options.Retries
+	}
+	backoff := m.options.Backoff
+
+	for attempt := 1; ; attempt++ {
+		if !m.breaker.Allow() {
+			log.WithFields(log.Fields{
+				"method": method,
+			}).Debug("circuit breaker open, skipping provider call")
+
+			return ErrCircuitOpen
+		}
+		err := m.attempt(ctx, m.options.timeout(method), fn)
+		switch {
+		case err == nil || cloud.IsNotFound(err):
+			m.breaker.Success()
+			return err
+		case !cloud.IsRetryable(err):
+			// step: a permanent failure such as bad credentials says nothing of the provider's
+			// health, so neither closes nor counts towards opening the circuit
+			m.breaker.Release()
+			return err
+		}
+		m.breaker.Failure()
+
+		if attempt >= attempts || ctx.Err() != nil {
+			log.WithFields(log.Fields{
+				"attempts": attempt,
+				"error":    err.Error(),
+				"kind":     cloud.KindOf(err).String(),
+				"method":   method,
+			}).Warn("provider call failed")
+
+			return err
+		}
+
+		delay := m.jitter(backoff)
+		log.WithFields(log.Fields{
+			"attempt": attempt,
+			"delay":   delay.String(),
+			"error":   err.Error(),
+			"kind":    cloud.KindOf(err).String(),
+			"method":  method,
+		}).Warn("provider call failed, retrying")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; m.options.MaxBackoff > 0 && backoff > m.options.MaxBackoff {
+			backoff = m.options.MaxBackoff
+		}
+	}
+}
+
+// attempt makes a single call bounded by the timeout; a timeout of the attempt rather
+// than the caller is transient and may be retried
+func (m *provider) attempt(ctx context.Context, timeout time.Duration, fn func(context.Context) error) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	actx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := fn(actx)
+	if err != nil && ctx.Err() == nil && actx.Err() == context.DeadlineExceeded {
+		return cloud.NewError(cloud.Transient, err)
+	}
+
+	return err
+}
+
+// jitter returns a random duration between half and the whole of the interval
+func (m *provider) jitter(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return interval/2 + time.Duration(m.random.Int63n(int64(interval/2)+1))
+}
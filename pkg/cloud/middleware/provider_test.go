@@ -0,0 +1,286 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+var (
+	errTransient = cloud.NewError(cloud.Transient, errors.New("connection reset"))
+	errDenied    = cloud.NewError(cloud.Unauthorized, errors.New("access denied"))
+)
+
+func TestOptionsIsValid(t *testing.T) {
+	cs := []struct {
+		Options Options
+		Ok      bool
+	}{
+		{Ok: true},
+		{Options: newFakeOptions(), Ok: true},
+		{Options: Options{Retries: -1}},
+		{Options: Options{Retries: 1}},
+		{Options: Options{Retries: 1, Backoff: time.Second, MaxBackoff: time.Millisecond}},
+		{Options: Options{Timeout: -1}},
+		{Options: Options{Timeouts: map[string]time.Duration{"DescribePools": time.Minute, "SetNodeTags": 0}}, Ok: true},
+		{Options: Options{Timeouts: map[string]time.Duration{"DescribePools": -1}}},
+		{Options: Options{Timeouts: map[string]time.Duration{"DescribeInstances": time.Minute}}},
+		{Options: Options{BreakerThreshold: -1}},
+		{Options: Options{BreakerThreshold: 1}},
+	}
+	for i, c := range cs {
+		err := c.Options.IsValid()
+		if c.Ok {
+			assert.NoError(t, err, "case %d should not have thrown error", i)
+			continue
+		}
+		assert.Error(t, err, "case %d should have thrown an error", i)
+	}
+}
+
+func TestProviderRetries(t *testing.T) {
+	cs := []struct {
+		Errors   []error
+		Expected error
+		Calls    int
+	}{
+		{Calls: 1},
+		{Errors: []error{errTransient}, Calls: 2},
+		{Errors: []error{errTransient, cloud.ErrThrottled}, Calls: 3},
+		{Errors: []error{errTransient, errTransient, errTransient}, Expected: errTransient, Calls: 3},
+		{Errors: []error{errDenied}, Expected: errDenied, Calls: 1},
+		{Errors: []error{cloud.ErrInstanceNotFound}, Expected: cloud.ErrInstanceNotFound, Calls: 1},
+	}
+	for i, c := range cs {
+		f := &fakeProvider{errors: c.Errors}
+		p, err := New(f, newFakeOptions())
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, _, err = p.GetNodeTag(context.Background(), "node", "tag")
+		assert.Equal(t, c.Expected, err, "case %d", i)
+		assert.Equal(t, c.Calls, f.calls, "case %d", i)
+	}
+}
+
+func TestProviderTimeout(t *testing.T) {
+	f := &fakeProvider{block: true}
+	options := newFakeOptions()
+	options.Timeout = time.Duration(10) * time.Millisecond
+	p, err := New(f, options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = p.GetNodeID(context.Background())
+	assert.Error(t, err)
+	assert.True(t, cloud.IsRetryable(err))
+	assert.Equal(t, 3, f.calls)
+}
+
+func TestProviderMethodTimeout(t *testing.T) {
+	f := &fakeProvider{block: true}
+	options := newFakeOptions()
+	options.Retries = 0
+	options.Timeout = time.Hour
+	options.Timeouts = map[string]time.Duration{"GetNodeTags": time.Duration(10) * time.Millisecond}
+	p, err := New(f, options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = p.GetNodeTags(context.Background(), "node")
+	assert.Error(t, err)
+	assert.True(t, cloud.IsRetryable(err))
+	assert.Equal(t, 1, f.calls)
+}
+
+func TestOptionsTimeout(t *testing.T) {
+	options := Options{Timeout: time.Second, Timeouts: map[string]time.Duration{"DescribePools": time.Minute, "SetNodeTags": 0}}
+	assert.Equal(t, time.Minute, options.timeout("DescribePools"))
+	assert.Equal(t, time.Duration(0), options.timeout("SetNodeTags"))
+	assert.Equal(t, time.Second, options.timeout("GetNodeTag"))
+}
+
+func TestProviderCancelled(t *testing.T) {
+	f := &fakeProvider{errors: []error{errTransient, errTransient, errTransient}}
+	options := newFakeOptions()
+	options.Backoff = time.Hour
+	options.MaxBackoff = time.Hour
+	p, err := New(f, options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(50)*time.Millisecond)
+	defer cancel()
+	_, err = p.GetNodeTags(ctx, "node")
+	assert.Equal(t, errTransient, err)
+	assert.Equal(t, 1, f.calls)
+}
+
+func TestProviderBreaker(t *testing.T) {
+	f := &fakeProvider{errors: []error{errTransient, errTransient, errTransient, errTransient}}
+	options := newFakeOptions()
+	options.Retries = 0
+	options.BreakerThreshold = 2
+	options.BreakerCooldown = time.Duration(50) * time.Millisecond
+	p, err := New(f, options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	assert.Equal(t, errTransient, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+	assert.Equal(t, errTransient, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+	// step: the circuit is now open
+	assert.Equal(t, ErrCircuitOpen, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+	assert.Equal(t, 2, f.calls)
+	assert.True(t, cloud.IsThrottled(ErrCircuitOpen))
+
+	// step: the trial call fails and the circuit opens again
+	<-time.After(options.BreakerCooldown)
+	assert.Equal(t, errTransient, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+	assert.Equal(t, ErrCircuitOpen, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+
+	// step: the trial call succeeds and the circuit closes
+	<-time.After(options.BreakerCooldown)
+	f.errors = nil
+	assert.NoError(t, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+	assert.NoError(t, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+}
+
+func TestProviderBreakerIgnoresPermanent(t *testing.T) {
+	f := &fakeProvider{errors: []error{errTransient, errDenied, errTransient, errDenied, errDenied}}
+	options := newFakeOptions()
+	options.Retries = 0
+	options.BreakerThreshold = 2
+	options.BreakerCooldown = time.Duration(50) * time.Millisecond
+	p, err := New(f, options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	// step: the permanent failure neither resets nor adds to the run of failures
+	assert.Equal(t, errTransient, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+	assert.Equal(t, errDenied, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+	assert.Equal(t, errTransient, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+	assert.Equal(t, ErrCircuitOpen, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+
+	// step: a permanent failure on the trial leaves the circuit open, but frees the trial
+	<-time.After(options.BreakerCooldown)
+	assert.Equal(t, errDenied, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+	assert.Equal(t, errDenied, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+	f.errors = nil
+	assert.NoError(t, p.SetNodeTags(ctx, "node", cloud.NodeTags{}))
+	assert.Equal(t, 6, f.calls)
+}
+
+func TestProviderOptionalInterfaces(t *testing.T) {
+	p, err := New(&fakeProvider{}, newFakeOptions())
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, ok := p.(cloud.ConditionalTagger)
+	assert.False(t, ok)
+	names, err := cloud.GetNodeNames(context.Background(), p, "node")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node"}, names)
+	addresses, err := cloud.GetNodeAddresses(context.Background(), p, "node")
+	assert.NoError(t, err)
+	assert.Empty(t, addresses)
+	nodes, err := cloud.DescribeNodes(context.Background(), p, []cloud.NodeID{"node"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []cloud.Node{{ID: "node", Names: []string{"node"}, Addresses: []string{}, Tags: cloud.NodeTags{}}}, nodes)
+
+	c := &fakeConditionalProvider{}
+	p, err = New(c, newFakeOptions())
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, ok = p.(cloud.ConditionalTagger)
+	assert.True(t, ok)
+	assert.NoError(t, cloud.SetNodeTagIf(context.Background(), p, "node", "tag", "token", "done"))
+	assert.True(t, c.called)
+}
+
+func newFakeOptions() Options {
+	return Options{
+		Backoff:    time.Millisecond,
+		MaxBackoff: time.Duration(5) * time.Millisecond,
+		Retries:    2,
+	}
+}
+
+// fakeProvider fails with the errors in turn, then succeeds
+type fakeProvider struct {
+	cloud.Provider
+	block  bool
+	calls  int
+	errors []error
+}
+
+func (f *fakeProvider) next(ctx context.Context) error {
+	f.calls++
+	if f.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if len(f.errors) > 0 {
+		err := f.errors[0]
+		f.errors = f.errors[1:]
+		return err
+	}
+
+	return nil
+}
+
+func (f *fakeProvider) GetNodeID(ctx context.Context) (cloud.NodeID, error) {
+	return "node", f.next(ctx)
+}
+
+func (f *fakeProvider) GetNodeTags(ctx context.Context, id cloud.NodeID) (cloud.NodeTags, error) {
+	return cloud.NodeTags{}, f.next(ctx)
+}
+
+func (f *fakeProvider) GetNodeTag(ctx context.Context, id cloud.NodeID, key string) (string, bool, error) {
+	return "", false, f.next(ctx)
+}
+
+func (f *fakeProvider) SetNodeTags(ctx context.Context, id cloud.NodeID, tags cloud.NodeTags) error {
+	return f.next(ctx)
+}
+
+type fakeConditionalProvider struct {
+	fakeProvider
+	called bool
+}
+
+func (f *fakeConditionalProvider) SetNodeTagIf(ctx context.Context, id cloud.NodeID, key, expected, value string) error {
+	f.called = true
+
+	return nil
+}
@@ -0,0 +1,330 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Operator is the comparison made by a selector requirement
+type Operator string
+
+const (
+	// Equals matches a tag equal to the value, or the glob
+	Equals Operator = "="
+	// NotEquals matches a tag which is missing or not equal to the value
+	NotEquals Operator = "!="
+	// In matches a tag equal to one of the values
+	In Operator = "in"
+	// NotIn matches a tag which is missing or equal to none of the values
+	NotIn Operator = "notin"
+	// Exists matches a tag being present, whatever the value
+	Exists Operator = "exists"
+	// DoesNotExist matches a tag being absent
+	DoesNotExist Operator = "!"
+	// Matches matches a tag against the regular expression
+	Matches Operator = "=~"
+	// NotMatches matches a tag which is missing or does not match the regular expression
+	NotMatches Operator = "!~"
+)
+
+var (
+	// comparisonRegex parses the key=value, key!=value, key=~regex and key!~regex requirements
+	comparisonRegex = regexp.MustCompile(`^([^\s!=~(),]+)\s*(==|=~|!=|!~|=)\s*(.*)$`)
+	// setRegex parses the key in (a,b) and key notin (a,b) requirements
+	setRegex = regexp.MustCompile(`^([^\s!=~(),]+)\s+(in|notin)\s*\((.*)\)$`)
+	// keyRegex validates a tag key
+	keyRegex = regexp.MustCompile(`^[^\s!=~(),]+$`)
+)
+
+// Requirement is a single expression of a selector
+type Requirement struct {
+	// Key is the tag the requirement applies to
+	Key string
+	// Operator is the comparison made
+	Operator Operator
+	// Values are the values, globs or regular expression compared with
+	Values []string
+	// patterns are the compiled globs or regular expressions, nil for a literal value
+	patterns []*regexp.Regexp
+}
+
+// Selector is a collection of requirements, all of which must match
+type Selector []Requirement
+
+// NewRequirement creates and validates a requirement
+func NewRequirement(key string, op Operator, values []string) (Requirement, error) {
+	r := Requirement{Key: key, Operator: op, Values: values}
+	if !keyRegex.MatchString(key) {
+		return r, fmt.Errorf("selector: key '%s' is invalid", key)
+	}
+	switch op {
+	case Exists, DoesNotExist:
+		if len(values) > 0 {
+			return r, fmt.Errorf("selector: operator '%s' does not take values", op)
+		}
+	case Equals, NotEquals, Matches, NotMatches:
+		if len(values) != 1 {
+			return r, fmt.Errorf("selector: operator '%s' takes a single value", op)
+		}
+	case In, NotIn:
+		if len(values) <= 0 {
+			return r, fmt.Errorf("selector: operator '%s' requires at least one value", op)
+		}
+	default:
+		return r, fmt.Errorf("selector: unknown operator '%s'", op)
+	}
+
+	r.patterns = make([]*regexp.Regexp, len(values))
+	for i, v := range values {
+		if v == "" {
+			return r, fmt.Errorf("selector: empty value for key '%s'", key)
+		}
+		expr := ""
+		switch {
+		case op == Matches || op == NotMatches:
+			expr = "^(?:" + v + ")$"
+		case strings.ContainsAny(v, "*?"):
+			expr = globToRegex(v)
+		default:
+			continue
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return r, fmt.Errorf("selector: invalid pattern '%s', error: %s", v, err)
+		}
+		r.patterns[i] = re
+	}
+
+	return r, nil
+}
+
+// ParseSelector parses the filter expressions, each being one or more comma separated
+// requirements. The expressions are joined before splitting, as the values of an
+// environment variable are split on the commas within the parentheses of a set
+func ParseSelector(expressions []string) (Selector, error) {
+	if len(expressions) <= 0 {
+		return nil, nil
+	}
+	list, err := splitRequirements(strings.Join(expressions, ","))
+	if err != nil {
+		return nil, err
+	}
+	var selector Selector
+	for _, e := range list {
+		r, err := parseRequirement(e)
+		if err != nil {
+			return nil, err
+		}
+		selector = append(selector, r)
+	}
+
+	return selector, nil
+}
+
+// NewSelector returns a selector requiring each of the tags be equal to the value
+func NewSelector(tags NodeTags) Selector {
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var selector Selector
+	for _, k := range keys {
+		selector = append(selector, Requirement{
+			Key:      k,
+			Operator: Equals,
+			Values:   []string{tags[k]},
+			patterns: make([]*regexp.Regexp, 1),
+		})
+	}
+
+	return selector
+}
+
+// Matches checks the tags satisfy all the requirements
+func (s Selector) Matches(tags NodeTags) bool {
+	for _, r := range s {
+		if !r.Matches(tags) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String returns the selector in the form it is parsed from
+func (s Selector) String() string {
+	var list []string
+	for _, r := range s {
+		list = append(list, r.String())
+	}
+
+	return strings.Join(list, ",")
+}
+
+// Matches checks the tags satisfy the requirement
+func (r Requirement) Matches(tags NodeTags) bool {
+	value, found := tags[r.Key]
+	switch r.Operator {
+	case Exists:
+		return found
+	case DoesNotExist:
+		return !found
+	case Equals, In, Matches:
+		return found && r.matchValue(value)
+	case NotEquals, NotIn, NotMatches:
+		return !found || !r.matchValue(value)
+	}
+
+	return false
+}
+
+// String returns the requirement in the form it is parsed from
+func (r Requirement) String() string {
+	b := &bytes.Buffer{}
+	switch r.Operator {
+	case Exists:
+		b.WriteString(r.Key)
+	case DoesNotExist:
+		b.WriteString("!" + r.Key)
+	case In, NotIn:
+		fmt.Fprintf(b, "%s %s (%s)", r.Key, r.Operator, strings.Join(r.Values, ","))
+	default:
+		fmt.Fprintf(b, "%s%s%s", r.Key, r.Operator, strings.Join(r.Values, ","))
+	}
+
+	return b.String()
+}
+
+// matchValue checks the value equals or matches any of the values of the requirement
+func (r Requirement) matchValue(value string) bool {
+	for i, v := range r.Values {
+		if i < len(r.patterns) && r.patterns[i] != nil {
+			if r.patterns[i].MatchString(value) {
+				return true
+			}
+			continue
+		}
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseRequirement parses a single requirement expression
+func parseRequirement(expression string) (Requirement, error) {
+	e := strings.TrimSpace(expression)
+	switch {
+	case e == "":
+		return Requirement{}, fmt.Errorf("selector: empty requirement in '%s'", expression)
+	case strings.HasPrefix(e, "!") && keyRegex.MatchString(strings.TrimSpace(e[1:])):
+		return NewRequirement(strings.TrimSpace(e[1:]), DoesNotExist, nil)
+	case setRegex.MatchString(e):
+		m := setRegex.FindStringSubmatch(e)
+		var values []string
+		for _, v := range strings.Split(m[3], ",") {
+			values = append(values, strings.TrimSpace(v))
+		}
+		return NewRequirement(m[1], Operator(m[2]), values)
+	case comparisonRegex.MatchString(e):
+		m := comparisonRegex.FindStringSubmatch(e)
+		op := Operator(m[2])
+		if op == "==" {
+			op = Equals
+		}
+		return NewRequirement(m[1], op, []string{strings.TrimSpace(m[3])})
+	case keyRegex.MatchString(e):
+		return NewRequirement(e, Exists, nil)
+	}
+
+	return Requirement{}, fmt.Errorf("selector: unable to parse requirement '%s'", expression)
+}
+
+// splitRequirements splits the expression on the commas outside of parentheses, and outside
+// of the braces and escapes of a regular expression (i.e. Env=~^a{1,2}$)
+func splitRequirements(expression string) ([]string, error) {
+	var list []string
+	depth, braces, start := 0, 0, 0
+	escaped := false
+	for i, c := range expression {
+		regex := strings.Contains(expression[start:i], "=~") || strings.Contains(expression[start:i], "!~")
+		if escaped {
+			escaped = false
+			continue
+		}
+		switch c {
+		case '\\':
+			escaped = regex
+		case '{':
+			if regex {
+				braces++
+			}
+		case '}':
+			if regex && braces > 0 {
+				braces--
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("selector: unbalanced parentheses in '%s'", expression)
+			}
+		case ',':
+			if depth == 0 && braces == 0 {
+				list = append(list, expression[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("selector: unbalanced parentheses in '%s'", expression)
+	}
+	if braces != 0 {
+		return nil, fmt.Errorf("selector: unbalanced braces in '%s'", expression)
+	}
+
+	return append(list, expression[start:]), nil
+}
+
+// globToRegex converts a glob, where * matches any run of characters and ? any one, into
+// an anchored regular expression
+func globToRegex(glob string) string {
+	b := &bytes.Buffer{}
+	b.WriteString("^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	return b.String()
+}
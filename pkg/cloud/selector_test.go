@@ -0,0 +1,147 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelector(t *testing.T) {
+	cs := []struct {
+		Expressions []string
+		Expected    string
+		Ok          bool
+	}{
+		{Ok: true},
+		{Expressions: []string{"Role=compute"}, Expected: "Role=compute", Ok: true},
+		{Expressions: []string{"Role==compute"}, Expected: "Role=compute", Ok: true},
+		{Expressions: []string{" Role = compute "}, Expected: "Role=compute", Ok: true},
+		{Expressions: []string{"Role=compute", "Env!=prod"}, Expected: "Role=compute,Env!=prod", Ok: true},
+		{Expressions: []string{"Role=compute,Env!=prod"}, Expected: "Role=compute,Env!=prod", Ok: true},
+		{Expressions: []string{"Env in (dev, qa)"}, Expected: "Env in (dev,qa)", Ok: true},
+		{Expressions: []string{"Env notin (prod)"}, Expected: "Env notin (prod)", Ok: true},
+		{Expressions: []string{"Env in (dev", "qa)"}, Expected: "Env in (dev,qa)", Ok: true},
+		{Expressions: []string{"kubernetes.io/cluster/dev"}, Expected: "kubernetes.io/cluster/dev", Ok: true},
+		{Expressions: []string{"!Disabled"}, Expected: "!Disabled", Ok: true},
+		{Expressions: []string{"Name=compute-*"}, Expected: "Name=compute-*", Ok: true},
+		{Expressions: []string{"Env=~^(dev|qa)$"}, Expected: "Env=~^(dev|qa)$", Ok: true},
+		{Expressions: []string{"Env!~prod.*"}, Expected: "Env!~prod.*", Ok: true},
+		{Expressions: []string{"Env=~^d{1,2}ev$,Role=compute"}, Expected: "Env=~^d{1,2}ev$,Role=compute", Ok: true},
+		{Expressions: []string{`Env=~^\(dev\)$`}, Expected: `Env=~^\(dev\)$`, Ok: true},
+		{Expressions: []string{""}},
+		{Expressions: []string{"Role="}},
+		{Expressions: []string{"=compute"}},
+		{Expressions: []string{"Role=compute,"}},
+		{Expressions: []string{"Env in ()"}},
+		{Expressions: []string{"Env in (dev,)"}},
+		{Expressions: []string{"Env in (dev"}},
+		{Expressions: []string{"Env=~("}},
+		{Expressions: []string{"Env=~^d{1,2$"}},
+		{Expressions: []string{"!Env=dev"}},
+		{Expressions: []string{"Env dev"}},
+	}
+	for i, c := range cs {
+		s, err := ParseSelector(c.Expressions)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, s.String(), "case %d", i)
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	tags := NodeTags{
+		"Env":  "dev",
+		"Name": "compute-dev-a",
+		"Role": "compute",
+	}
+	cs := []struct {
+		Expressions []string
+		Expected    bool
+	}{
+		{Expected: true},
+		{Expressions: []string{"Role=compute"}, Expected: true},
+		{Expressions: []string{"Role=master"}},
+		{Expressions: []string{"Missing=compute"}},
+		{Expressions: []string{"Role=compute", "Env=dev"}, Expected: true},
+		{Expressions: []string{"Role=compute", "Env=prod"}},
+		{Expressions: []string{"Env!=prod"}, Expected: true},
+		{Expressions: []string{"Env!=dev"}},
+		{Expressions: []string{"Missing!=dev"}, Expected: true},
+		{Expressions: []string{"Env in (dev,qa)"}, Expected: true},
+		{Expressions: []string{"Env in (prod,qa)"}},
+		{Expressions: []string{"Missing in (dev)"}},
+		{Expressions: []string{"Env notin (prod,qa)"}, Expected: true},
+		{Expressions: []string{"Env notin (dev)"}},
+		{Expressions: []string{"Missing notin (dev)"}, Expected: true},
+		{Expressions: []string{"Role"}, Expected: true},
+		{Expressions: []string{"Missing"}},
+		{Expressions: []string{"!Missing"}, Expected: true},
+		{Expressions: []string{"!Role"}},
+		{Expressions: []string{"Name=compute-*"}, Expected: true},
+		{Expressions: []string{"Name=compute-?ev-a"}, Expected: true},
+		{Expressions: []string{"Name=compute"}},
+		{Expressions: []string{"Name=*-prod-*"}},
+		{Expressions: []string{"Name in (master-*, compute-*)"}, Expected: true},
+		{Expressions: []string{"Name=compute.dev.a"}},
+		{Expressions: []string{"Env=~^(dev|qa)$"}, Expected: true},
+		{Expressions: []string{"Env=~d.v"}, Expected: true},
+		{Expressions: []string{"Env=~de"}},
+		{Expressions: []string{"Env=~^d{1,2}ev$"}, Expected: true},
+		{Expressions: []string{"Env=~^d{2,3}ev$"}},
+		{Expressions: []string{"Env!~prod|qa"}, Expected: true},
+		{Expressions: []string{"Env!~dev"}},
+	}
+	for i, c := range cs {
+		s, err := ParseSelector(c.Expressions)
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, s.Matches(tags), "case %d: %s", i, s.String())
+	}
+}
+
+func TestNewSelector(t *testing.T) {
+	s := NewSelector(NodeTags{"Role": "compute", "Env": "dev"})
+	assert.Equal(t, "Env=dev,Role=compute", s.String())
+	assert.True(t, s.Matches(NodeTags{"Role": "compute", "Env": "dev", "Other": "yes"}))
+	assert.False(t, s.Matches(NodeTags{"Role": "compute"}))
+	// step: the values are compared literally
+	s = NewSelector(NodeTags{"Name": "compute-*"})
+	assert.False(t, s.Matches(NodeTags{"Name": "compute-a"}))
+	assert.True(t, s.Matches(NodeTags{"Name": "compute-*"}))
+}
+
+func TestNewRequirement(t *testing.T) {
+	_, err := NewRequirement("Role", Exists, []string{"compute"})
+	assert.Error(t, err)
+	_, err = NewRequirement("Role", Equals, nil)
+	assert.Error(t, err)
+	_, err = NewRequirement("Role", Operator("~"), []string{"compute"})
+	assert.Error(t, err)
+	_, err = NewRequirement("Ro le", Equals, []string{"compute"})
+	assert.Error(t, err)
+	r, err := NewRequirement("Role", In, []string{"compute", "master"})
+	assert.NoError(t, err)
+	assert.True(t, r.Matches(NodeTags{"Role": "master"}))
+}
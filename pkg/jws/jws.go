@@ -0,0 +1,101 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jws
+
+// Note: this mirrors the detached signatures produced by the kubernetes bootstrap signer
+// https://github.com/kubernetes/kubernetes/tree/master/pkg/controller/bootstrap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidSignature indicates the signature does not match the content
+	ErrInvalidSignature = errors.New("invalid jws signature")
+)
+
+// header is the protected header of the signature
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// ComputeDetachedSignature produces a detached HS256 jws of the content (header..signature),
+// keyed by the token secret
+func ComputeDetachedSignature(content, tokenID, tokenSecret string) (string, error) {
+	encoded, err := json.Marshal(&header{Algorithm: "HS256", KeyID: tokenID})
+	if err != nil {
+		return "", err
+	}
+	protected := encode(encoded)
+	signature := sign(protected, content, tokenSecret)
+
+	return fmt.Sprintf("%s..%s", protected, encode(signature)), nil
+}
+
+// VerifyDetachedSignature checks the detached jws was produced for the content by the token
+func VerifyDetachedSignature(content, signature, tokenID, tokenSecret string) error {
+	parts := strings.Split(signature, ".")
+	if len(parts) != 3 || parts[1] != "" {
+		return errors.New("jws is not a detached compact serialization")
+	}
+	decoded, err := decode(parts[0])
+	if err != nil {
+		return fmt.Errorf("jws header is invalid, error: %s", err)
+	}
+	var h header
+	if err := json.Unmarshal(decoded, &h); err != nil {
+		return fmt.Errorf("jws header is invalid, error: %s", err)
+	}
+	if h.Algorithm != "HS256" {
+		return fmt.Errorf("jws algorithm: %q is not supported", h.Algorithm)
+	}
+	if h.KeyID != "" && h.KeyID != tokenID {
+		return fmt.Errorf("jws key id: %q does not match the token", h.KeyID)
+	}
+	provided, err := decode(parts[2])
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal(provided, sign(parts[0], content, tokenSecret)) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// sign computes the hmac over the jws signing input
+func sign(protected, content, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(protected + "." + encode([]byte(content))))
+
+	return mac.Sum(nil)
+}
+
+func encode(v []byte) string {
+	return base64.RawURLEncoding.EncodeToString(v)
+}
+
+func decode(v string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(v)
+}
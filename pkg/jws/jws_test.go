@@ -0,0 +1,68 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jws
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeDetachedSignature(t *testing.T) {
+	sig, err := ComputeDetachedSignature("content", "abcdef", "0123456789abcdef")
+	assert.NoError(t, err)
+	// header is {"alg":"HS256","kid":"abcdef"}
+	assert.True(t, strings.HasPrefix(sig, "eyJhbGciOiJIUzI1NiIsImtpZCI6ImFiY2RlZiJ9.."))
+}
+
+func TestComputeDetachedSignatureUpstream(t *testing.T) {
+	// test vector taken from the kubernetes bootstrap signer
+	sig, err := ComputeDetachedSignature("Hello from the other side. I must have called a thousand times.",
+		"joshua", "my voice is my passcode")
+	assert.NoError(t, err)
+	assert.Equal(t, "eyJhbGciOiJIUzI1NiIsImtpZCI6Impvc2h1YSJ9..VShe2taLd-YTrmWuRkcL_8QTNDHYxQIEBsAYYiIj1_8", sig)
+}
+
+func TestVerifyDetachedSignature(t *testing.T) {
+	sig, err := ComputeDetachedSignature("content", "abcdef", "0123456789abcdef")
+	if !assert.NoError(t, err) {
+		return
+	}
+	cs := []struct {
+		Content   string
+		Signature string
+		TokenID   string
+		Secret    string
+		Ok        bool
+	}{
+		{Content: "content", Signature: sig, TokenID: "abcdef", Secret: "0123456789abcdef", Ok: true},
+		{Content: "changed", Signature: sig, TokenID: "abcdef", Secret: "0123456789abcdef"},
+		{Content: "content", Signature: sig, TokenID: "abcdef", Secret: "fedcba9876543210"},
+		{Content: "content", Signature: sig, TokenID: "fedcba", Secret: "0123456789abcdef"},
+		{Content: "content", Signature: "bad", TokenID: "abcdef", Secret: "0123456789abcdef"},
+		{Content: "content", Signature: "e30..", TokenID: "abcdef", Secret: "0123456789abcdef"},
+	}
+	for i, c := range cs {
+		err := VerifyDetachedSignature(c.Content, c.Signature, c.TokenID, c.Secret)
+		if c.Ok {
+			assert.NoError(t, err, "case %d should not have thrown error", i)
+		} else {
+			assert.Error(t, err, "case %d should have thrown an error", i)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pubkeypin
+
+// Note: the format matches the kubeadm --discovery-token-ca-cert-hash pins
+// https://github.com/kubernetes/kubernetes/tree/master/cmd/kubeadm/app/util/pubkeypin
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// formatSHA256 is the prefix for a sha256 pin
+	formatSHA256 = "sha256"
+)
+
+// Hash returns the pin (sha256:<hex>) of the certificate public key (subject public key info)
+func Hash(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+
+	return formatSHA256 + ":" + strings.ToLower(hex.EncodeToString(sum[:]))
+}
+
+// HashPEM returns the pin of the first certificate in the pem encoded data
+func HashPEM(data []byte) (string, error) {
+	certificate, err := ParseCertificate(data)
+	if err != nil {
+		return "", err
+	}
+
+	return Hash(certificate), nil
+}
+
+// ParseCertificate decodes the first certificate in the pem encoded data
+func ParseCertificate(data []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no pem encoded certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// Set is a collection of pins
+type Set map[string]bool
+
+// NewSet creates a set from a collection of pins, checking each is valid
+func NewSet(pins []string) (Set, error) {
+	set := make(Set, 0)
+	for _, x := range pins {
+		pin := strings.ToLower(strings.TrimSpace(x))
+		e := strings.SplitN(pin, ":", 2)
+		if len(e) != 2 || e[0] != formatSHA256 {
+			return nil, fmt.Errorf("pin: %q must be of the form sha256:<hex>", x)
+		}
+		if v, err := hex.DecodeString(e[1]); err != nil || len(v) != sha256.Size {
+			return nil, fmt.Errorf("pin: %q is not a valid sha256 hash", x)
+		}
+		set[pin] = true
+	}
+
+	return set, nil
+}
+
+// Check verifies the certificate matches one of the pins
+func (s Set) Check(certificate *x509.Certificate) error {
+	if pin := Hash(certificate); !s[pin] {
+		return fmt.Errorf("certificate pin: %s does not match any of the expected pins", pin)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pubkeypin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashPEM(t *testing.T) {
+	pin, err := HashPEM([]byte(fakeCertificate))
+	assert.NoError(t, err)
+	assert.Equal(t, fakeCertificatePin, pin)
+	_, err = HashPEM([]byte("not a certificate"))
+	assert.Error(t, err)
+}
+
+func TestNewSet(t *testing.T) {
+	cs := []struct {
+		Pins []string
+		Ok   bool
+	}{
+		{Ok: true},
+		{Pins: []string{fakeCertificatePin}, Ok: true},
+		{Pins: []string{"SHA256:" + fakeCertificatePin[7:]}, Ok: true},
+		{Pins: []string{"md5:abcdef"}},
+		{Pins: []string{"sha256:abcdef"}},
+		{Pins: []string{"sha256:zz"}},
+	}
+	for i, c := range cs {
+		_, err := NewSet(c.Pins)
+		if c.Ok {
+			assert.NoError(t, err, "case %d should not have thrown error", i)
+		} else {
+			assert.Error(t, err, "case %d should have thrown an error", i)
+		}
+	}
+}
+
+func TestSetCheck(t *testing.T) {
+	certificate, err := ParseCertificate([]byte(fakeCertificate))
+	if !assert.NoError(t, err) {
+		return
+	}
+	set, _ := NewSet([]string{fakeCertificatePin})
+	assert.NoError(t, set.Check(certificate))
+	set, _ = NewSet([]string{"sha256:" + "00000000000000000000000000000000000000000000000000000000000000aa"})
+	assert.Error(t, set.Check(certificate))
+}
+
+const fakeCertificatePin = "sha256:fd9be4d5f0034e6910e376b02038603d017e78e31f8f8b6c783e77cec85e78c2"
+
+const fakeCertificate = `-----BEGIN CERTIFICATE-----
+MIIBgDCCASWgAwIBAgIUfC9aSnbsYBb3swsO+PbHlQYvSHswCgYIKoZIzj0EAwIw
+FTETMBEGA1UEAwwKa3ViZXJuZXRlczAeFw0yNjEwMTgxNjEyMzRaFw0zNjEwMTUx
+NjEyMzRaMBUxEzARBgNVBAMMCmt1YmVybmV0ZXMwWTATBgcqhkjOPQIBBggqhkjO
+PQMBBwNCAARGV417SlLT31mqaE+JzHh/LELMLfzJV3CzAp99v728Cc0hqsMnbgkN
+OEE7eeN5zTWGAKXucTe6Bd9scBgOvVtYo1MwUTAdBgNVHQ4EFgQU9VpBPswmFYpO
+03XwgSfPh6T9dGcwHwYDVR0jBBgwFoAU9VpBPswmFYpO03XwgSfPh6T9dGcwDwYD
+VR0TAQH/BAUwAwEB/zAKBggqhkjOPQQDAgNJADBGAiEA4hYyvVlyE3PAjIEtgm+F
+repuuJScmfpboEr6wZAfTPECIQDOOLXRBPTvmEtzTD1w4APZXRRFwhr7Af79OgPa
+xqkx8Q==
+-----END CERTIFICATE-----
+`
@@ -0,0 +1,361 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+
+	log "github.com/Sirupsen/logrus"
+	"k8s.io/client-go/pkg/api/v1"
+	bootstrapapi "k8s.io/kubernetes/pkg/bootstrap/api"
+)
+
+var (
+	// ErrTokenNotFound means no token was found for the node or token id
+	ErrTokenNotFound = errors.New("no tokens found")
+)
+
+// TokenState is the state of a token issued by the server
+type TokenState string
+
+const (
+	// TokenIssued indicates the token is in the instance tag waiting to be consumed
+	TokenIssued TokenState = "issued"
+	// TokenConsumed indicates the node has marked its token as used
+	TokenConsumed TokenState = "consumed"
+	// TokenExpired indicates the token has expired without being consumed
+	TokenExpired TokenState = "expired"
+	// TokenReplaced indicates the instance tag no longer holds the token
+	TokenReplaced TokenState = "replaced"
+	// TokenOrphaned indicates the instance the token was issued to has gone
+	TokenOrphaned TokenState = "orphaned"
+	// TokenRevoked indicates the token has just been revoked
+	TokenRevoked TokenState = "revoked"
+)
+
+const (
+	// ActionRevoked indicates a token was revoked
+	ActionRevoked Action = "TokenRevoked"
+)
+
+// TokenInfo describes a token issued by the server
+type TokenInfo struct {
+	// TokenID is the public portion of the token
+	TokenID string `json:"token_id"`
+	// Node is the node the token was issued to
+	Node cloud.NodeID `json:"node"`
+	// Pool is the node pool the node resides, if still a member
+	Pool string `json:"pool,omitempty"`
+	// Namespace is the namespace of the token
+	Namespace string `json:"namespace"`
+	// Expires is when the token expires, if ever
+	Expires *time.Time `json:"expires,omitempty"`
+	// State is the state of the token
+	State TokenState `json:"state"`
+}
+
+// Admin performs the operator actions on the tokens issued by the server
+type Admin struct {
+	server *Server
+}
+
+// member is a node found in the node pools
+type member struct {
+	nodeRequest
+	// err is set when the overrides on the pool are invalid
+	err error
+}
+
+// NewAdmin creates an admin for the tokens issued under the configuration
+func NewAdmin(cfg Config, p cloud.Provider, t TokensProvider) (*Admin, error) {
+	s, err := newServer(cfg, p, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Admin{server: s}, nil
+}
+
+// List returns the tokens we have issued, joining the token secrets with the instance tags
+func (a *Admin) List(ctx context.Context) ([]TokenInfo, error) {
+	secrets, err := a.getSecrets("")
+	if err != nil {
+		return nil, err
+	}
+	members, err := a.getMembers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tags := make(map[cloud.NodeID]cloud.NodeTags, 0)
+	var list []TokenInfo
+	for _, x := range secrets {
+		node := cloud.NodeID(x.Labels[nodeLabel])
+		if _, found := tags[node]; !found {
+			nodeTags, err := a.server.cm.GetNodeTags(ctx, node)
+			if err != nil && !cloud.IsNotFound(err) {
+				return nil, err
+			}
+			// step: a nil map marks the instance as gone
+			if err != nil {
+				nodeTags = nil
+			}
+			tags[node] = nodeTags
+		}
+		m := a.getMember(members, node)
+		list = append(list, newTokenInfo(x, m.pool, m.options.tagName, tags[node], now))
+	}
+	sort.Sort(tokenInfos(list))
+
+	return list, nil
+}
+
+// Revoke deletes the tokens of the node, or the token with the id, and marks the instance
+// tag revoked if it still holds the token, so the server does not issue another. With
+// reissue the tag is reset to request a new token instead, while skip first opts the
+// instance out altogether
+func (a *Admin) Revoke(ctx context.Context, target string, skip, reissue bool) ([]TokenInfo, error) {
+	if skip && reissue {
+		return nil, errors.New("cannot both skip and reissue the node")
+	}
+	secrets, err := a.getSecrets(target)
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) <= 0 {
+		return nil, ErrTokenNotFound
+	}
+	members, err := a.getMembers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	skipped := make(map[cloud.NodeID]bool, 0)
+	var list []TokenInfo
+	for _, x := range secrets {
+		node := cloud.NodeID(x.Labels[nodeLabel])
+		m := a.getMember(members, node)
+		token := getSecretToken(x)
+
+		// step: opt the instance out before clearing the tag, so the server does not issue another
+		if skip && !skipped[node] {
+			if err := a.server.cm.SetNodeTags(ctx, node, cloud.NodeTags{SkipTag: "true"}); err != nil && !cloud.IsNotFound(err) {
+				return list, err
+			}
+			skipped[node] = true
+		}
+		if err := a.server.tokens.Delete(a.server.kube, token, x.Namespace); err != nil {
+			a.server.record(ActionRevoked, node, m.pool, token, "failed to revoke registration token", err)
+			return list, err
+		}
+		a.server.record(ActionRevoked, node, m.pool, token, "revoked registration token", nil)
+
+		// step: mark the tag if it still holds the token we have revoked
+		value := cloud.RevokedTagValue
+		if reissue {
+			value = cloud.RequestTagValue
+		}
+		err := cloud.SetNodeTagIf(ctx, a.server.cm, node, m.options.tagName, token, value)
+		if err != nil && err != cloud.ErrTagChanged && !cloud.IsNotFound(err) {
+			return list, err
+		}
+		info := newTokenInfo(x, m.pool, m.options.tagName, nil, now)
+		info.State = TokenRevoked
+		list = append(list, info)
+
+		log.WithFields(log.Fields{
+			"node":     node,
+			"pool":     m.pool,
+			"token-id": info.TokenID,
+		}).Info("revoked registration token")
+	}
+
+	return list, nil
+}
+
+// Issue creates a token for the node and writes it to the instance tag, whatever the tag
+// currently holds, revoking any token the node has yet to consume. The node must be a
+// member of the node pools and not opted out
+func (a *Admin) Issue(ctx context.Context, node cloud.NodeID) (TokenInfo, error) {
+	members, err := a.getMembers(ctx)
+	if err != nil {
+		return TokenInfo{}, err
+	}
+	m, found := members[node]
+	switch {
+	case !found:
+		return TokenInfo{}, fmt.Errorf("node: %s is not a member of the node pools", node)
+	case m.err != nil:
+		return TokenInfo{}, fmt.Errorf("node pool: %s has invalid overrides, error: %s", m.pool, m.err)
+	case m.options.skip:
+		return TokenInfo{}, fmt.Errorf("node pool: %s has opted out of token issuance", m.pool)
+	}
+	tags, err := a.server.cm.GetNodeTags(ctx, node)
+	if err != nil {
+		return TokenInfo{}, err
+	}
+	if skip, err := isSkipped(tags); err != nil || skip {
+		return TokenInfo{}, fmt.Errorf("node: %s has opted out of token issuance", node)
+	}
+	// step: revoke the token waiting in the tag, rather than leaving it valid until it expires
+	previous := tags[m.options.tagName]
+	if _, _, err := parseToken(previous); err == nil {
+		if err := a.server.tokens.Delete(a.server.kube, previous, m.options.token.Namespace); err != nil {
+			a.server.record(ActionRevoked, node, m.pool, previous, "failed to revoke the unconsumed registration token", err)
+			return TokenInfo{}, err
+		}
+		a.server.record(ActionRevoked, node, m.pool, previous, "revoked the unconsumed registration token", nil)
+	}
+
+	token, err := a.server.issueToken(ctx, m.nodeRequest)
+	if err != nil {
+		return TokenInfo{}, err
+	}
+	tokenID, _, _ := parseToken(token)
+	info := TokenInfo{
+		Namespace: m.options.token.Namespace,
+		Node:      node,
+		Pool:      m.pool,
+		State:     TokenIssued,
+		TokenID:   tokenID,
+	}
+	if m.options.token.TTL > 0 {
+		expires := time.Now().Add(m.options.token.TTL).UTC()
+		info.Expires = &expires
+	}
+
+	return info, nil
+}
+
+// getSecrets returns the token secrets we manage, all of them or those of the node or token id
+func (a *Admin) getSecrets(target string) ([]v1.Secret, error) {
+	namespace := a.server.config.TokenNamespace
+	selector := managedLabel + "=true"
+	if target != "" {
+		// step: check for a token id first, the node ids being longer
+		if parseTokenID(target) == nil {
+			secret, err := a.server.kube.Secrets(namespace).Get(bootstrapapi.BootstrapTokenSecretPrefix + target)
+			if err == nil && secret.Labels[managedLabel] == "true" {
+				return []v1.Secret{*secret}, nil
+			}
+		}
+		selector = selector + "," + nodeLabel + "=" + target
+	}
+	secrets, err := a.server.kube.Secrets(namespace).List(v1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	return secrets.Items, nil
+}
+
+// getMembers returns the nodes in the node pools, along with the options of their pool
+func (a *Admin) getMembers(ctx context.Context) (map[cloud.NodeID]member, error) {
+	pools, err := a.server.cm.DescribePools(ctx, a.server.config.Filters)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[cloud.NodeID]member, 0)
+	for _, pool := range pools {
+		options, err := a.server.getPoolOptions(pool)
+		for _, node := range pool.Nodes {
+			members[node] = member{nodeRequest: nodeRequest{node: node, pool: pool.Name, options: options}, err: err}
+		}
+	}
+
+	return members, nil
+}
+
+// getMember returns the node from the members, falling back to the defaults for nodes no
+// longer in the node pools or whose pool has invalid overrides
+func (a *Admin) getMember(members map[cloud.NodeID]member, node cloud.NodeID) member {
+	m, found := members[node]
+	if found && m.err == nil {
+		return m
+	}
+	m.node = node
+	m.options = poolOptions{tagName: a.server.config.TagName}
+	m.options.token.Namespace = a.server.config.TokenNamespace
+
+	return m
+}
+
+// newTokenInfo describes the token secret, the tags being those of the instance or nil if the
+// instance has gone
+func newTokenInfo(secret v1.Secret, pool, tagName string, tags cloud.NodeTags, now time.Time) TokenInfo {
+	info := TokenInfo{
+		Namespace: secret.Namespace,
+		Node:      cloud.NodeID(secret.Labels[nodeLabel]),
+		Pool:      pool,
+		TokenID:   string(secret.Data[bootstrapapi.BootstrapTokenIDKey]),
+	}
+	expired := false
+	if v, found := secret.Data[bootstrapapi.BootstrapTokenExpirationKey]; found {
+		if expires, err := time.Parse(time.RFC3339, string(v)); err == nil {
+			expires = expires.UTC()
+			info.Expires = &expires
+			expired = now.After(expires)
+		}
+	}
+	value, found := tags[tagName]
+	switch {
+	case tags == nil:
+		info.State = TokenOrphaned
+	case found && value == getSecretToken(secret):
+		info.State = TokenIssued
+		if expired {
+			info.State = TokenExpired
+		}
+	case found && value == cloud.CompletedTagValue:
+		info.State = TokenConsumed
+	case expired:
+		info.State = TokenExpired
+	default:
+		info.State = TokenReplaced
+	}
+
+	return info
+}
+
+// getSecretToken returns the token held in the secret
+func getSecretToken(secret v1.Secret) string {
+	return fmt.Sprintf("%s.%s", secret.Data[bootstrapapi.BootstrapTokenIDKey], secret.Data[bootstrapapi.BootstrapTokenSecretKey])
+}
+
+// tokenInfos sorts the tokens by node and expiry
+type tokenInfos []TokenInfo
+
+func (t tokenInfos) Len() int      { return len(t) }
+func (t tokenInfos) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t tokenInfos) Less(i, j int) bool {
+	if t[i].Node != t[j].Node {
+		return t[i].Node < t[j].Node
+	}
+	if t[i].Expires == nil || t[j].Expires == nil {
+		return t[j].Expires == nil && t[i].Expires != nil
+	}
+
+	return t[i].Expires.Before(*t[j].Expires)
+}
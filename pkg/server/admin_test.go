@@ -0,0 +1,178 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/pkg/api/v1"
+	bootstrapapi "k8s.io/kubernetes/pkg/bootstrap/api"
+)
+
+func TestNewTokenInfo(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	cs := []struct {
+		Expires string
+		Tags    cloud.NodeTags
+		State   TokenState
+	}{
+		{Tags: cloud.NodeTags{"KubeletToken": "abcdef.0123456789abcdef"}, State: TokenIssued},
+		{Expires: "2017-06-01T12:30:00Z", Tags: cloud.NodeTags{"KubeletToken": "abcdef.0123456789abcdef"}, State: TokenIssued},
+		{Expires: "2017-06-01T11:30:00Z", Tags: cloud.NodeTags{"KubeletToken": "abcdef.0123456789abcdef"}, State: TokenExpired},
+		{Expires: "2017-06-01T11:30:00Z", Tags: cloud.NodeTags{"KubeletToken": cloud.CompletedTagValue}, State: TokenConsumed},
+		{Tags: cloud.NodeTags{"KubeletToken": cloud.CompletedTagValue}, State: TokenConsumed},
+		{Expires: "2017-06-01T11:30:00Z", Tags: cloud.NodeTags{}, State: TokenExpired},
+		{Tags: cloud.NodeTags{"KubeletToken": "ghijkl.0123456789abcdef"}, State: TokenReplaced},
+		{Tags: cloud.NodeTags{"KubeletToken": cloud.RequestTagValue}, State: TokenReplaced},
+		{Tags: cloud.NodeTags{}, State: TokenReplaced},
+		{State: TokenOrphaned},
+	}
+	for i, c := range cs {
+		secret := newFakeNodeSecret("abcdef", "0123456789abcdef", "compute00-gp0", c.Expires)
+		info := newTokenInfo(secret, "compute0", "KubeletToken", c.Tags, now)
+		assert.Equal(t, c.State, info.State, "case %d", i)
+		assert.Equal(t, "abcdef", info.TokenID, "case %d", i)
+		assert.Equal(t, cloud.NodeID("compute00-gp0"), info.Node, "case %d", i)
+		assert.Equal(t, "kube-system", info.Namespace, "case %d", i)
+		assert.Equal(t, c.Expires != "", info.Expires != nil, "case %d", i)
+	}
+}
+
+func TestTokenInfosSort(t *testing.T) {
+	early := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	later := early.Add(time.Hour)
+	list := tokenInfos{
+		{TokenID: "e", Node: "node1"},
+		{TokenID: "d", Node: "node1", Expires: &later},
+		{TokenID: "c", Node: "node1", Expires: &early},
+		{TokenID: "a", Node: "node0"},
+	}
+	sort.Sort(list)
+	var ids []string
+	for _, x := range list {
+		ids = append(ids, x.TokenID)
+	}
+	assert.Equal(t, []string{"a", "c", "d", "e"}, ids)
+}
+
+func TestAdminIssue(t *testing.T) {
+	a, p, tp := newFakeAdmin(newFakeServerConfig())
+	info, err := a.Issue(context.Background(), "compute00-gp0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, cloud.NodeID("compute00-gp0"), info.Node)
+	assert.Equal(t, "compute0", info.Pool)
+	assert.Equal(t, TokenIssued, info.State)
+	assert.NotNil(t, info.Expires)
+
+	token, found, err := p.GetNodeTag(context.Background(), "compute00-gp0", "KubeletToken")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	id, _, err := parseToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, info.TokenID, id)
+	assert.Equal(t, cloud.NodeID("compute00-gp0"), tp.(*fakeTokenProvider).tokens[token])
+
+	// step: issuing again revokes the unconsumed token
+	next, err := a.Issue(context.Background(), "compute00-gp0")
+	assert.NoError(t, err)
+	assert.NotEqual(t, info.TokenID, next.TokenID)
+	assert.NotContains(t, tp.(*fakeTokenProvider).tokens, token)
+	assert.Len(t, tp.(*fakeTokenProvider).tokens, 1)
+
+	// step: issuing again replaces the token, whatever the tag holds
+	for _, x := range []string{cloud.CompletedTagValue, cloud.RevokedTagValue} {
+		assert.NoError(t, p.SetNodeTags(context.Background(), "compute00-gp0", cloud.NodeTags{"KubeletToken": x}))
+		again, err := a.Issue(context.Background(), "compute00-gp0")
+		assert.NoError(t, err)
+		assert.NotEqual(t, next.TokenID, again.TokenID)
+	}
+}
+
+func TestAdminRevokeSkipAndReissue(t *testing.T) {
+	a, _, _ := newFakeAdmin(newFakeServerConfig())
+	_, err := a.Revoke(context.Background(), "compute00-gp0", true, true)
+	assert.Error(t, err)
+}
+
+func TestAdminIssueRefused(t *testing.T) {
+	cs := []struct {
+		Node cloud.NodeID
+		Tags cloud.NodeTags
+	}{
+		{Node: "missing"},
+		{Node: "master0"},
+		{Node: "compute00-gp0", Tags: cloud.NodeTags{SkipTag: "true"}},
+		{Node: "compute00-gp0", Tags: cloud.NodeTags{SkipTag: "bad"}},
+		{Node: "compute00-gp1", Tags: cloud.NodeTags{}},
+	}
+	for i, c := range cs {
+		pools := newFakePools()
+		// step: the compute1 pool has opted out
+		pools[2].Tags = cloud.NodeTags{"Role": "compute", "Env": "dev", SkipTag: "true"}
+		p := newFakeProvider(pools)
+		tp := newFakeTokenProvider()
+		a, err := NewAdmin(newFakeServerConfig(), p, tp)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if c.Tags != nil {
+			assert.NoError(t, p.SetNodeTags(context.Background(), c.Node, c.Tags))
+		}
+		_, err = a.Issue(context.Background(), c.Node)
+		assert.Error(t, err, "case %d should have thrown an error", i)
+		assert.Empty(t, tp.(*fakeTokenProvider).tokens, "case %d", i)
+	}
+}
+
+func newFakeAdmin(cfg Config) (*Admin, cloud.Provider, TokensProvider) {
+	log.SetOutput(ioutil.Discard)
+	p := newFakeProvider(newFakePools())
+	t := newFakeTokenProvider()
+	a, err := NewAdmin(cfg, p, t)
+	if err != nil {
+		panic(err)
+	}
+
+	return a, p, t
+}
+
+func newFakeNodeSecret(id, secret string, node cloud.NodeID, expires string) v1.Secret {
+	s := v1.Secret{
+		Data: map[string][]byte{
+			bootstrapapi.BootstrapTokenIDKey:     []byte(id),
+			bootstrapapi.BootstrapTokenSecretKey: []byte(secret),
+		},
+	}
+	s.Name = bootstrapapi.BootstrapTokenSecretPrefix + id
+	s.Namespace = "kube-system"
+	s.Labels = map[string]string{managedLabel: "true", nodeLabel: string(node)}
+	if expires != "" {
+		s.Data[bootstrapapi.BootstrapTokenExpirationKey] = []byte(expires)
+	}
+
+	return s
+}
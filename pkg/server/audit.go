@@ -0,0 +1,214 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+
+	log "github.com/Sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/api/v1"
+	bootstrapapi "k8s.io/kubernetes/pkg/bootstrap/api"
+)
+
+// Action is a lifecycle action performed on a registration token
+type Action string
+
+const (
+	// eventComponent is the source component of the kubernetes events
+	eventComponent = "keto-tokens"
+
+	// ActionCreated indicates a token was created
+	ActionCreated Action = "TokenCreated"
+	// ActionTagged indicates a token was written to the instance tag
+	ActionTagged Action = "TokenTagged"
+	// ActionRolledBack indicates a token was deleted after failing to tag the instance
+	ActionRolledBack Action = "TokenRolledBack"
+	// ActionConsumed indicates a token was consumed by the node
+	ActionConsumed Action = "TokenConsumed"
+)
+
+// AuditEvent is a record of a lifecycle action on a token
+type AuditEvent struct {
+	// Action is the action performed
+	Action Action `json:"action"`
+	// Time is when the action was performed
+	Time time.Time `json:"time"`
+	// Node is the node the token was issued to
+	Node cloud.NodeID `json:"node"`
+	// Pool is the node pool the node resides
+	Pool string `json:"pool,omitempty"`
+	// TokenID is the public portion of the token
+	TokenID string `json:"token_id,omitempty"`
+	// Namespace is the namespace of the token
+	Namespace string `json:"namespace,omitempty"`
+	// Message is a human readable description
+	Message string `json:"message"`
+	// Error is set if the action failed
+	Error string `json:"error,omitempty"`
+}
+
+// Recorder records the lifecycle actions on tokens
+type Recorder interface {
+	// Record records the event
+	Record(AuditEvent) error
+}
+
+// newRecorder creates the recorders requested by the configuration
+func newRecorder(cfg Config, kube *kubernetes.Clientset) (Recorder, error) {
+	var list multiRecorder
+	if cfg.RecordEvents {
+		list = append(list, &eventRecorder{client: kube, namespace: cfg.EventNamespace})
+	}
+	if cfg.AuditLog != "" {
+		r, err := newFileRecorder(cfg.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+
+	return list, nil
+}
+
+// record is a helper used to record an event, logging on failure
+func (s *Server) record(action Action, node cloud.NodeID, pool, token, message string, err error) {
+	event := AuditEvent{
+		Action:    action,
+		Time:      time.Now().UTC(),
+		Node:      node,
+		Pool:      pool,
+		Namespace: s.config.TokenNamespace,
+		Message:   message,
+	}
+	// step: we only ever record the public portion of the token
+	if id, _, perr := parseToken(token); perr == nil {
+		event.TokenID = id
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if rerr := s.recorder.Record(event); rerr != nil {
+		log.WithFields(log.Fields{
+			"action": action,
+			"error":  rerr.Error(),
+			"node":   node,
+		}).Warn("failed to record the token event")
+	}
+}
+
+// multiRecorder records to a collection of recorders
+type multiRecorder []Recorder
+
+// Record records the event in all the recorders
+func (m multiRecorder) Record(e AuditEvent) error {
+	var failed error
+	for _, r := range m {
+		if err := r.Record(e); err != nil {
+			failed = err
+		}
+	}
+
+	return failed
+}
+
+// fileRecorder appends events as json lines to a file
+type fileRecorder struct {
+	sync.Mutex
+	file *os.File
+}
+
+// newFileRecorder opens the audit log for appending
+func newFileRecorder(filename string) (*fileRecorder, error) {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.FileMode(0600))
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileRecorder{file: file}, nil
+}
+
+// Record appends the event to the audit log
+func (f *fileRecorder) Record(e AuditEvent) error {
+	content, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	_, err = f.file.Write(append(content, '\n'))
+
+	return err
+}
+
+// eventRecorder records the events as kubernetes events against the token secret
+type eventRecorder struct {
+	client    *kubernetes.Clientset
+	namespace string
+}
+
+// Record creates a kubernetes event for the action
+func (k *eventRecorder) Record(e AuditEvent) error {
+	event := newTokenEvent(e, k.namespace)
+	_, err := k.client.Events(event.Namespace).Create(event)
+
+	return err
+}
+
+// newTokenEvent builds the kubernetes event for the action; the event is placed in the event
+// namespace if given, though the involved object is always the secret in the token namespace
+func newTokenEvent(e AuditEvent, namespace string) *v1.Event {
+	if namespace == "" {
+		namespace = e.Namespace
+	}
+	name := fmt.Sprintf("%s%s", bootstrapapi.BootstrapTokenSecretPrefix, e.TokenID)
+	eventType := v1.EventTypeNormal
+	message := fmt.Sprintf("%s (node: %s, pool: %s)", e.Message, e.Node, e.Pool)
+	if e.Error != "" {
+		eventType = v1.EventTypeWarning
+		message = fmt.Sprintf("%s, error: %s", message, e.Error)
+	}
+	timestamp := unversioned.NewTime(e.Time)
+	hostname, _ := os.Hostname()
+
+	return &v1.Event{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", name, e.Time.UnixNano()),
+			Namespace: namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Name:       name,
+			Namespace:  e.Namespace,
+		},
+		Reason:         string(e.Action),
+		Message:        message,
+		Source:         v1.EventSource{Component: eventComponent, Host: hostname},
+		FirstTimestamp: timestamp,
+		LastTimestamp:  timestamp,
+		Count:          1,
+		Type:           eventType,
+	}
+}
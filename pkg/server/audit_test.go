@@ -0,0 +1,122 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRecorder struct {
+	sync.Mutex
+	events []AuditEvent
+}
+
+func (f *fakeRecorder) Record(e AuditEvent) error {
+	f.Lock()
+	defer f.Unlock()
+	f.events = append(f.events, e)
+	return nil
+}
+
+func (f *fakeRecorder) actions() []Action {
+	f.Lock()
+	defer f.Unlock()
+	var list []Action
+	for _, x := range f.events {
+		list = append(list, x.Action)
+	}
+	return list
+}
+
+func TestFileRecorder(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "audit")
+	if !assert.NoError(t, err) {
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	r, err := newFileRecorder(tmp.Name())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, r.Record(AuditEvent{Action: ActionCreated, Node: "compute0", TokenID: "abcdef"}))
+	assert.NoError(t, r.Record(AuditEvent{Action: ActionTagged, Node: "compute0", TokenID: "abcdef"}))
+
+	file, err := os.Open(tmp.Name())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer file.Close()
+	var events []AuditEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e AuditEvent
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, ActionCreated, events[0].Action)
+		assert.Equal(t, ActionTagged, events[1].Action)
+	}
+}
+
+func TestNewTokenEvent(t *testing.T) {
+	e := AuditEvent{
+		Action:    ActionCreated,
+		Time:      time.Now(),
+		Node:      "compute00",
+		Namespace: "kube-system",
+		TokenID:   "abcdef",
+		Message:   "issued registration token",
+	}
+	event := newTokenEvent(e, "")
+	assert.Equal(t, "kube-system", event.Namespace)
+	assert.Equal(t, "kube-system", event.InvolvedObject.Namespace)
+	assert.Equal(t, "bootstrap-token-abcdef", event.InvolvedObject.Name)
+	assert.Equal(t, "Normal", event.Type)
+
+	// step: the event may live elsewhere, but it must still point at the secret
+	e.Error = "failed"
+	event = newTokenEvent(e, "audit")
+	assert.Equal(t, "audit", event.Namespace)
+	assert.Equal(t, "kube-system", event.InvolvedObject.Namespace)
+	assert.Equal(t, "Warning", event.Type)
+}
+
+func TestServerRecordNoSecret(t *testing.T) {
+	s, err := newFakeServer(newFakeServerConfig())
+	if !assert.NoError(t, err) {
+		return
+	}
+	r := &fakeRecorder{}
+	s.recorder = r
+	s.record(ActionCreated, "compute0", "pool", "abcdef.0123456789abcdef", "test", nil)
+	if assert.Equal(t, 1, len(r.events)) {
+		assert.Equal(t, "abcdef", r.events[0].TokenID)
+		content, _ := json.Marshal(r.events[0])
+		assert.NotContains(t, string(content), "0123456789abcdef")
+	}
+}
@@ -0,0 +1,421 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+
+	log "github.com/Sirupsen/logrus"
+	"k8s.io/client-go/pkg/api/v1"
+	bootstrapapi "k8s.io/kubernetes/pkg/bootstrap/api"
+)
+
+// Note: the vendored client-go only carries certificates/v1alpha1, whereas the clusters
+// using bootstrap tokens serve v1beta1, hence we speak to the api directly
+
+const (
+	// csrPath is the api path for the certificate signing requests
+	csrPath = "/apis/certificates.k8s.io/v1beta1/certificatesigningrequests"
+	// csrApprovedReason is the reason placed on the approval
+	csrApprovedReason = "KetoTokensApprove"
+	// nodeUserPrefix is the prefix of the kubelet user names
+	nodeUserPrefix = "system:node:"
+	// nodesGroup is the group the kubelets reside
+	nodesGroup = "system:nodes"
+	// sanDNSName is the tag of a dns name in the subject alternative names
+	sanDNSName = 2
+	// sanIPAddress is the tag of an ip address in the subject alternative names
+	sanIPAddress = 7
+)
+
+var (
+	// clientUsages are the usages permitted on a kubelet client certificate
+	clientUsages = map[string]bool{"digital signature": true, "key encipherment": true, "client auth": true}
+	// servingUsages are the usages permitted on a kubelet serving certificate
+	servingUsages = map[string]bool{"digital signature": true, "key encipherment": true, "server auth": true}
+	// oidSubjectAltName is the object identifier of the subject alternative names extension
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+)
+
+// csrList is a list of certificate signing requests
+type csrList struct {
+	Items []json.RawMessage `json:"items"`
+}
+
+// csrObject is the subset of a certificate signing request we require
+type csrObject struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		Request  []byte   `json:"request"`
+		Usages   []string `json:"usages"`
+		Username string   `json:"username"`
+		Groups   []string `json:"groups"`
+	} `json:"spec"`
+	Status struct {
+		Conditions []struct {
+			Type string `json:"type"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// reconcileCSRs approves any pending kubelet certificate requests which can be tied back
+// to a token we have issued, or a node which consumed one, and a live instance in the pools
+func (s *Server) reconcileCSRs() error {
+	content, err := s.kube.Core().RESTClient().Get().AbsPath(csrPath).DoRaw()
+	if err != nil {
+		return err
+	}
+	list := csrList{}
+	if err := json.Unmarshal(content, &list); err != nil {
+		return err
+	}
+	if len(list.Items) <= 0 {
+		return nil
+	}
+
+	// step: only look up the instances the pending requests name, once per reconciliation
+	var pending []json.RawMessage
+	var ids []cloud.NodeID
+	var names []string
+	for _, raw := range list.Items {
+		csr := csrObject{}
+		if err := json.Unmarshal(raw, &csr); err != nil || len(csr.Status.Conditions) > 0 {
+			continue
+		}
+		pending = append(pending, raw)
+		if request, err := parseCSR(csr.Spec.Request); err == nil && strings.HasPrefix(request.Subject.CommonName, nodeUserPrefix) {
+			names = append(names, strings.TrimPrefix(request.Subject.CommonName, nodeUserPrefix))
+		}
+		if strings.HasPrefix(csr.Spec.Username, bootstrapapi.BootstrapUserPrefix) {
+			if node, err := s.getTokenNode(strings.TrimPrefix(csr.Spec.Username, bootstrapapi.BootstrapUserPrefix)); err == nil {
+				ids = append(ids, node)
+			}
+		}
+	}
+	if len(pending) <= 0 {
+		return nil
+	}
+	members, err := s.getCSRMembers(ids, names)
+	if err != nil {
+		return err
+	}
+
+	for _, raw := range pending {
+		csr := csrObject{}
+		if err := json.Unmarshal(raw, &csr); err != nil {
+			continue
+		}
+		node, err := s.validateCSR(csr, members)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"name":   csr.Metadata.Name,
+				"reason": err.Error(),
+			}).Debug("not approving the certificate request")
+
+			continue
+		}
+		if err := s.approveCSR(csr.Metadata.Name, raw); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+				"name":  csr.Metadata.Name,
+				"node":  node,
+			}).Error("failed to approve the certificate request")
+
+			continue
+		}
+		log.WithFields(log.Fields{
+			"name":     csr.Metadata.Name,
+			"node":     node,
+			"username": csr.Spec.Username,
+		}).Info("approved the kubelet certificate request")
+	}
+
+	return nil
+}
+
+// csrMember is a member of the node pools, as used to validate the certificate requests
+type csrMember struct {
+	// names are the node names the instance may register with
+	names []string
+	// addresses are the private ip addresses of the instance
+	addresses []string
+	// tagName is the instance tag the token is passed in, which the pool may override
+	tagName string
+	// tags are the tags on the instance
+	tags cloud.NodeTags
+}
+
+// csrMembers are the members of the node pools, looked up once per reconciliation
+type csrMembers map[cloud.NodeID]*csrMember
+
+// findByName returns the member which registers with the node name
+func (c csrMembers) findByName(name string) (cloud.NodeID, *csrMember, bool) {
+	for node, m := range c {
+		if containsString(m.names, name) {
+			return node, m, true
+		}
+	}
+
+	return "", nil, false
+}
+
+// getCSRMembers describes the instances with the ids or registering with the names in a
+// single call, keeping those which are members of the node pools and have not opted out
+func (s *Server) getCSRMembers(ids []cloud.NodeID, names []string) (csrMembers, error) {
+	pools, err := s.cm.DescribePools(s.ctx, s.config.Filters)
+	if err != nil {
+		return nil, err
+	}
+	tagNames := make(map[cloud.NodeID]string, 0)
+	for _, p := range pools {
+		// step: a pool with invalid overrides is not trusted
+		options, err := s.getPoolOptions(p)
+		if err != nil || options.skip {
+			continue
+		}
+		for _, n := range p.Nodes {
+			tagNames[n] = options.tagName
+		}
+	}
+
+	members := make(csrMembers, 0)
+	if len(ids) <= 0 && len(names) <= 0 {
+		return members, nil
+	}
+	nodes, err := cloud.DescribeNodes(s.ctx, s.cm, ids, names)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		tagName, found := tagNames[n.ID]
+		if !found {
+			continue
+		}
+		// step: an instance which has opted out, or whose opt-out is unreadable, is not trusted
+		if skip, err := isSkipped(n.Tags); err != nil || skip {
+			continue
+		}
+		members[n.ID] = &csrMember{
+			addresses: n.Addresses,
+			names:     n.Names,
+			tagName:   tagName,
+			tags:      n.Tags,
+		}
+	}
+
+	return members, nil
+}
+
+// validateCSR checks the certificate request is from a kubelet we have bootstrapped, returning
+// the instance it belongs to
+func (s *Server) validateCSR(csr csrObject, members csrMembers) (cloud.NodeID, error) {
+	request, err := parseCSR(csr.Spec.Request)
+	if err != nil {
+		return "", err
+	}
+	if len(request.Subject.Organization) != 1 || request.Subject.Organization[0] != nodesGroup {
+		return "", fmt.Errorf("subject organization must be %s", nodesGroup)
+	}
+	if !strings.HasPrefix(request.Subject.CommonName, nodeUserPrefix) {
+		return "", fmt.Errorf("subject common name must be prefixed with %s", nodeUserPrefix)
+	}
+	if err := checkSubjectAltNames(request); err != nil {
+		return "", err
+	}
+	nodeName := strings.TrimPrefix(request.Subject.CommonName, nodeUserPrefix)
+
+	var node cloud.NodeID
+	switch {
+	case strings.HasPrefix(csr.Spec.Username, bootstrapapi.BootstrapUserPrefix):
+		// step: the initial client certificate requested with the bootstrap token
+		if !hasUsages(csr.Spec.Usages, clientUsages, "client auth") {
+			return "", errors.New("bootstrap requests may only ask for client usages")
+		}
+		if node, err = s.getTokenNode(strings.TrimPrefix(csr.Spec.Username, bootstrapapi.BootstrapUserPrefix)); err != nil {
+			return "", err
+		}
+	case csr.Spec.Username == request.Subject.CommonName:
+		// step: a serving certificate or renewal requested by a kubelet we bootstrapped, the
+		// token having long since expired these are judged on the identity of the node
+		if !hasUsages(csr.Spec.Usages, clientUsages, "client auth") && !hasUsages(csr.Spec.Usages, servingUsages, "server auth") {
+			return "", errors.New("request has invalid usages")
+		}
+		if node, err = s.getBootstrappedNode(nodeName, members); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.New("requester is neither a bootstrap token or the node")
+	}
+
+	m, found := members[node]
+	if !found {
+		return "", fmt.Errorf("instance: %s is not a member of the node pools", node)
+	}
+	if !containsString(m.names, nodeName) {
+		return "", fmt.Errorf("node name: %s does not match the instance: %s", nodeName, node)
+	}
+	for _, x := range request.DNSNames {
+		if !containsString(m.names, x) {
+			return "", fmt.Errorf("dns name: %s does not belong to the instance: %s", x, node)
+		}
+	}
+	for _, x := range request.IPAddresses {
+		if !containsString(m.addresses, x.String()) {
+			return "", fmt.Errorf("ip address: %s does not belong to the instance: %s", x, node)
+		}
+	}
+
+	return node, nil
+}
+
+// getBootstrappedNode finds the pool member which registers with the name, provided it has
+// consumed a registration token and has not been reset or revoked since
+func (s *Server) getBootstrappedNode(name string, members csrMembers) (cloud.NodeID, error) {
+	node, m, found := members.findByName(name)
+	if !found {
+		return "", fmt.Errorf("no instance found for node: %s", name)
+	}
+	if m.tags[m.tagName] != cloud.CompletedTagValue {
+		return "", fmt.Errorf("instance: %s has not consumed a registration token", node)
+	}
+
+	return node, nil
+}
+
+// checkSubjectAltNames ensures the request only carries dns names and ip addresses, the
+// only subject alternative names a kubelet requires; emails, uris and the rest are refused
+func checkSubjectAltNames(request *x509.CertificateRequest) error {
+	if len(request.EmailAddresses) > 0 {
+		return errors.New("email addresses are not permitted")
+	}
+	for _, x := range request.Extensions {
+		if !x.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		sequence := asn1.RawValue{}
+		rest, err := asn1.Unmarshal(x.Value, &sequence)
+		if err != nil || len(rest) > 0 || !sequence.IsCompound || sequence.Tag != asn1.TagSequence {
+			return errors.New("invalid subject alternative names")
+		}
+		for data := sequence.Bytes; len(data) > 0; {
+			name := asn1.RawValue{}
+			if data, err = asn1.Unmarshal(data, &name); err != nil {
+				return errors.New("invalid subject alternative names")
+			}
+			if name.Class != asn1.ClassContextSpecific || (name.Tag != sanDNSName && name.Tag != sanIPAddress) {
+				return errors.New("subject alternative names may only be dns names or ip addresses")
+			}
+		}
+	}
+
+	return nil
+}
+
+// getTokenNode returns the instance a token we issued was given to
+func (s *Server) getTokenNode(tokenID string) (cloud.NodeID, error) {
+	if err := parseTokenID(tokenID); err != nil {
+		return "", err
+	}
+	secret, err := s.kube.Secrets(s.config.TokenNamespace).Get(bootstrapapi.BootstrapTokenSecretPrefix + tokenID)
+	if err != nil {
+		return "", err
+	}
+
+	return getSecretNode(secret)
+}
+
+// getSecretNode returns the instance from a token secret we issued
+func getSecretNode(secret *v1.Secret) (cloud.NodeID, error) {
+	if secret.Labels[managedLabel] != "true" || secret.Labels[nodeLabel] == "" {
+		return "", fmt.Errorf("token: %s was not issued by us", secret.Name)
+	}
+
+	return cloud.NodeID(secret.Labels[nodeLabel]), nil
+}
+
+// approveCSR adds the approved condition to the certificate request
+func (s *Server) approveCSR(name string, raw json.RawMessage) error {
+	object := make(map[string]interface{}, 0)
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return err
+	}
+	status, _ := object["status"].(map[string]interface{})
+	if status == nil {
+		status = make(map[string]interface{}, 0)
+	}
+	status["conditions"] = []interface{}{
+		map[string]interface{}{
+			"type":    "Approved",
+			"reason":  csrApprovedReason,
+			"message": "approved by keto-tokens, node bootstrapped with an issued token",
+		},
+	}
+	object["status"] = status
+	content, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	_, err = s.kube.Core().RESTClient().Put().
+		AbsPath(csrPath, name, "approval").
+		SetHeader("Content-Type", "application/json").
+		Body(content).
+		DoRaw()
+
+	return err
+}
+
+// parseCSR decodes the pem encoded certificate request
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("request is not a pem encoded certificate request")
+	}
+
+	return x509.ParseCertificateRequest(block.Bytes)
+}
+
+// hasUsages checks the usages are all permitted and include the required usage
+func hasUsages(usages []string, permitted map[string]bool, required string) bool {
+	for _, x := range usages {
+		if !permitted[x] {
+			return false
+		}
+	}
+
+	return containsString(usages, required)
+}
+
+// containsString checks if the list contains the value
+func containsString(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+
+	return false
+}
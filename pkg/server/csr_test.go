@@ -0,0 +1,295 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"net"
+	"testing"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestValidateCSR(t *testing.T) {
+	cs := []struct {
+		CommonName   string
+		Organization string
+		DNSNames     []string
+		IPAddresses  []net.IP
+		Emails       []string
+		URI          string
+		Username     string
+		Usages       []string
+		Node         cloud.NodeID
+		Ok           bool
+	}{
+		{
+			CommonName: "system:node:compute00-gp0", Organization: "system:nodes",
+			Username: "system:node:compute00-gp0",
+			Usages:   []string{"digital signature", "key encipherment", "server auth"},
+			DNSNames: []string{"compute00-gp0"},
+			Ok:       true,
+		},
+		{
+			CommonName: "system:node:compute00-gp0", Organization: "system:nodes",
+			Username: "system:node:compute00-gp0",
+			Usages:   []string{"digital signature", "key encipherment", "client auth"},
+			Ok:       true,
+		},
+		// the node has not consumed a token
+		{
+			CommonName: "system:node:compute01-gp0", Organization: "system:nodes",
+			Username: "system:node:compute01-gp0",
+			Usages:   []string{"digital signature", "key encipherment", "server auth"},
+		},
+		// the node is not a member of the pools
+		{
+			CommonName: "system:node:master0", Organization: "system:nodes",
+			Username: "system:node:master0",
+			Usages:   []string{"digital signature", "key encipherment", "server auth"},
+		},
+		// requesting for another node
+		{
+			CommonName: "system:node:compute00-gp0", Organization: "system:nodes",
+			Username: "system:node:compute01-gp0",
+			Usages:   []string{"digital signature", "key encipherment", "server auth"},
+		},
+		{
+			CommonName: "system:node:compute00-gp0", Organization: "system:masters",
+			Username: "system:node:compute00-gp0",
+			Usages:   []string{"digital signature", "key encipherment", "server auth"},
+		},
+		{
+			CommonName: "system:node:compute00-gp0", Organization: "system:nodes",
+			Username: "system:node:compute00-gp0",
+			Usages:   []string{"digital signature", "key encipherment", "server auth"},
+			DNSNames: []string{"kubernetes.default"},
+		},
+		{
+			CommonName: "system:node:compute00-gp0", Organization: "system:nodes",
+			Username: "system:node:compute00-gp0",
+			Usages:   []string{"digital signature", "cert sign"},
+		},
+		// bootstrap tokens may not request serving certificates
+		{
+			CommonName: "system:node:compute00-gp0", Organization: "system:nodes",
+			Username: "system:bootstrap:abcdef",
+			Usages:   []string{"digital signature", "key encipherment", "server auth"},
+		},
+		// the private address of the instance
+		{
+			CommonName: "system:node:compute00-gp0", Organization: "system:nodes",
+			Username:    "system:node:compute00-gp0",
+			Usages:      []string{"digital signature", "key encipherment", "server auth"},
+			IPAddresses: []net.IP{net.ParseIP("10.0.0.10")},
+			Ok:          true,
+		},
+		// an address belonging to someone else
+		{
+			CommonName: "system:node:compute00-gp0", Organization: "system:nodes",
+			Username:    "system:node:compute00-gp0",
+			Usages:      []string{"digital signature", "key encipherment", "server auth"},
+			IPAddresses: []net.IP{net.ParseIP("10.96.0.1")},
+		},
+		{
+			CommonName: "system:node:compute00-gp0", Organization: "system:nodes",
+			Username: "system:node:compute00-gp0",
+			Usages:   []string{"digital signature", "key encipherment", "server auth"},
+			Emails:   []string{"admin@example.com"},
+		},
+		{
+			CommonName: "system:node:compute00-gp0", Organization: "system:nodes",
+			Username: "system:node:compute00-gp0",
+			Usages:   []string{"digital signature", "key encipherment", "server auth"},
+			URI:      "spiffe://cluster/ns/kube-system",
+		},
+		// the token tag is overridden by the pool
+		{
+			CommonName: "system:node:compute00-gp1", Organization: "system:nodes",
+			Username: "system:node:compute00-gp1",
+			Usages:   []string{"digital signature", "key encipherment", "server auth"},
+			Node:     "compute00-gp1",
+			Ok:       true,
+		},
+		// a renewal once the token has expired is judged on the node identity
+		{
+			CommonName: "system:node:compute01-gp1", Organization: "system:nodes",
+			Username: "system:node:compute01-gp1",
+			Usages:   []string{"digital signature", "key encipherment", "client auth"},
+			Node:     "compute01-gp1",
+			Ok:       true,
+		},
+		// the node has consumed a token, but has since been reset
+		{
+			CommonName: "system:node:compute02-gp1", Organization: "system:nodes",
+			Username: "system:node:compute02-gp1",
+			Usages:   []string{"digital signature", "key encipherment", "client auth"},
+		},
+	}
+	c := newFakeProvider(newFakePools())
+	cfg := newFakeServerConfig()
+	s, err := New(cfg, c, newFakeTokenProvider())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for i, x := range cs {
+		members := csrMembers{
+			"compute00-gp0": {names: []string{"compute00-gp0"}, addresses: []string{"10.0.0.10"}, tagName: cfg.TagName, tags: cloud.NodeTags{cfg.TagName: "Success"}},
+			"compute01-gp0": {names: []string{"compute01-gp0"}, tagName: cfg.TagName},
+			"compute00-gp1": {names: []string{"compute00-gp1"}, tagName: "OtherToken", tags: cloud.NodeTags{cfg.TagName: "Request", "OtherToken": "Success"}},
+			"compute01-gp1": {names: []string{"compute01-gp1"}, tagName: cfg.TagName, tags: cloud.NodeTags{cfg.TagName: "Success"}},
+			"compute02-gp1": {names: []string{"compute02-gp1"}, tagName: cfg.TagName, tags: cloud.NodeTags{cfg.TagName: "Request"}},
+		}
+		csr := csrObject{}
+		csr.Spec.Request = newFakeCSR(t, x.CommonName, x.Organization, x.DNSNames, x.IPAddresses, x.Emails, x.URI)
+		csr.Spec.Username = x.Username
+		csr.Spec.Usages = x.Usages
+		node, err := s.validateCSR(csr, members)
+		if !x.Ok {
+			assert.Error(t, err, "case %d should have thrown an error", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d should not have thrown error", i)
+		expected := x.Node
+		if expected == "" {
+			expected = "compute00-gp0"
+		}
+		assert.Equal(t, expected, node, "case %d", i)
+	}
+}
+
+func TestGetCSRMembers(t *testing.T) {
+	c := newFakeProvider(newFakePools())
+	cfg := newFakeServerConfig()
+	s, err := New(cfg, c, newFakeTokenProvider())
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	c.SetNodeTags(ctx, "compute00-gp0", cloud.NodeTags{cfg.TagName: "Success"})
+	c.SetNodeTags(ctx, "compute01-gp0", cloud.NodeTags{SkipTag: "true"})
+	c.SetNodeTags(ctx, "compute00-gp1", cloud.NodeTags{SkipTag: "maybe"})
+
+	members, err := s.getCSRMembers([]cloud.NodeID{"compute00-gp0"}, []string{"compute01-gp0", "compute00-gp1", "compute01-gp1", "master0", "missing"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// step: only the members named and not opted out are described
+	assert.Len(t, members, 2)
+	if assert.Contains(t, members, cloud.NodeID("compute00-gp0")) {
+		assert.Equal(t, cfg.TagName, members["compute00-gp0"].tagName)
+		assert.Equal(t, "Success", members["compute00-gp0"].tags[cfg.TagName])
+	}
+	assert.Contains(t, members, cloud.NodeID("compute01-gp1"))
+
+	members, err = s.getCSRMembers(nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, members)
+}
+
+func TestCheckSubjectAltNames(t *testing.T) {
+	cs := []struct {
+		DNSNames    []string
+		IPAddresses []net.IP
+		Emails      []string
+		URI         string
+		Ok          bool
+	}{
+		{Ok: true},
+		{DNSNames: []string{"compute00"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.10")}, Ok: true},
+		{Emails: []string{"admin@example.com"}},
+		{URI: "spiffe://cluster/ns/kube-system"},
+	}
+	for i, c := range cs {
+		request, err := parseCSR(newFakeCSR(t, "system:node:compute00", "system:nodes", c.DNSNames, c.IPAddresses, c.Emails, c.URI))
+		if !assert.NoError(t, err, "case %d should not have thrown error", i) {
+			continue
+		}
+		err = checkSubjectAltNames(request)
+		if c.Ok {
+			assert.NoError(t, err, "case %d should not have thrown error", i)
+			continue
+		}
+		assert.Error(t, err, "case %d should have thrown an error", i)
+	}
+}
+
+func TestCSRMembersFindByName(t *testing.T) {
+	members := csrMembers{"i-12345": {names: []string{"i-12345", "ip-10-0-0-10.compute.internal"}}}
+	node, m, found := members.findByName("ip-10-0-0-10.compute.internal")
+	assert.True(t, found)
+	assert.Equal(t, cloud.NodeID("i-12345"), node)
+	assert.NotNil(t, m)
+	_, _, found = members.findByName("ip-10-0-0-11.compute.internal")
+	assert.False(t, found)
+}
+
+func TestGetSecretNode(t *testing.T) {
+	secret := &v1.Secret{}
+	_, err := getSecretNode(secret)
+	assert.Error(t, err)
+	secret.Labels = map[string]string{managedLabel: "true", nodeLabel: "compute00"}
+	node, err := getSecretNode(secret)
+	assert.NoError(t, err)
+	assert.Equal(t, cloud.NodeID("compute00"), node)
+}
+
+func TestParseCSR(t *testing.T) {
+	_, err := parseCSR([]byte("not a request"))
+	assert.Error(t, err)
+	request, err := parseCSR(newFakeCSR(t, "system:node:test", "system:nodes", nil, nil, nil, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "system:node:test", request.Subject.CommonName)
+}
+
+func newFakeCSR(t *testing.T, cn, org string, names []string, ips []net.IP, emails []string, uri string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	template := &x509.CertificateRequest{
+		Subject:        pkix.Name{CommonName: cn, Organization: []string{org}},
+		DNSNames:       names,
+		EmailAddresses: emails,
+		IPAddresses:    ips,
+	}
+	// step: a uri is encoded by hand, the extension being used in place of the names
+	if uri != "" {
+		value, err := asn1.Marshal([]asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte(uri)}})
+		if err != nil {
+			t.Fatalf("unable to encode the uri: %s", err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: oidSubjectAltName, Value: value}}
+	}
+	request, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: request})
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package server
 
 import (
+	"errors"
 	"time"
 
 	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
@@ -28,6 +29,8 @@ import (
 
 // Config is the configuration for the server
 type Config struct {
+	// Profile is the name of the cluster profile, used in the logs and metrics
+	Profile string
 	// MasterAPI is the URL for the Kubernetes API
 	MasterAPI string
 	// KubeToken is a user defined kube token
@@ -38,20 +41,92 @@ type Config struct {
 	TokenTTL time.Duration
 	// TokenNamespace is the namespace to registration token
 	TokenNamespace string
-	// Filters is a collection of filter used to identify the compute nodes
-	Filters cloud.NodeTags
+	// TokenUsages is the default usages applied to the token
+	TokenUsages []string
+	// TokenExtraGroups is the default extra bootstrap groups for the token
+	TokenExtraGroups []string
+	// TokenDescription is the default description placed on the token
+	TokenDescription string
+	// Filters is the selector used to identify the compute node pools
+	Filters cloud.Selector
 	// TagName is the name of the registration token tag
 	TagName string
+	// CAHashTagName is the name of the tag used to publish the cluster ca hash
+	CAHashTagName string
 	// ReconcileInterval is the checking interval for new instances
 	ReconcileInterval time.Duration
 	// AcquireLock indicates we must acquire the lock in kubernetes
 	AcquireLock bool
+	// RecordEvents indicates we record token actions as kubernetes events
+	RecordEvents bool
+	// EventNamespace is an optional namespace for the events, defaults to the token namespace
+	EventNamespace string
+	// AuditLog is an optional path to an append-only json audit log
+	AuditLog string
+	// DryRun indicates we only log the tokens we would issue
+	DryRun bool
+	// SignClusterInfo indicates we sign the cluster-info for the tokens we issue
+	SignClusterInfo bool
+	// ApproveCSRs indicates we approve the kubelet certificate requests of the nodes we bootstrap
+	ApproveCSRs bool
+}
+
+// ReconcileSummary is the outcome of a reconciliation
+type ReconcileSummary struct {
+	// Pools is the number of node pools found
+	Pools int `json:"pools"`
+	// Nodes is the number of nodes seen in the node pools
+	Nodes int `json:"nodes"`
+	// Issued is the number of tokens issued
+	Issued int `json:"issued"`
+	// Planned is the number of tokens which would have been issued in dry-run mode
+	Planned int `json:"planned"`
+	// Skipped is the number of nodes opted out or in a pool with invalid overrides
+	Skipped int `json:"skipped"`
+	// Failed is the number of nodes we failed to check or issue a token to
+	Failed int `json:"failed"`
+	// Abandoned indicates the reconciliation was cut short, leaving nodes unchecked
+	Abandoned bool `json:"abandoned"`
+}
+
+// IsValid checks the configuration is valid
+func (c *Config) IsValid() error {
+	if len(c.TokenUsages) > 0 {
+		if err := validateUsages(c.TokenUsages); err != nil {
+			return err
+		}
+	}
+	if err := validateExtraGroups(c.TokenExtraGroups); err != nil {
+		return err
+	}
+	if c.TagName == "" {
+		return errors.New("no tag name")
+	}
+	if c.ReconcileInterval <= 0 {
+		return errors.New("reconcile interval must be positive")
+	}
+
+	return nil
+}
+
+// TokenOptions are the options used when generating a registration token
+type TokenOptions struct {
+	// TTL is the time-to-live on the token
+	TTL time.Duration
+	// Usages is a collection of usages for the token
+	Usages []string
+	// ExtraGroups is a collection of extra bootstrap groups
+	ExtraGroups []string
+	// Description is a human readable description for the token
+	Description string
+	// Namespace is the namespace the token resides
+	Namespace string
 }
 
 // TokensProvider implements the interactions with the kubeapi and tokens
 type TokensProvider interface {
 	// Create genenates a registration token
-	Create(*kubernetes.Clientset, cloud.NodeID, time.Duration, []string, string) (string, error)
+	Create(*kubernetes.Clientset, cloud.NodeID, TokenOptions) (string, error)
 	// Delete remove a token
 	Delete(*kubernetes.Clientset, string, string) error
 }
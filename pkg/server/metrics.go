@@ -0,0 +1,57 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// skipReasonPool indicates the node pool has opted out
+	skipReasonPool = "pool"
+	// skipReasonInstance indicates the instance has opted out
+	skipReasonInstance = "instance"
+	// skipReasonInvalid indicates the opt-out or overrides on the pool or instance are invalid
+	skipReasonInvalid = "invalid"
+)
+
+var (
+	// skippedNodesMetric is the number of nodes skipped by the last reconciliation
+	skippedNodesMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "keto_tokens",
+			Name:      "skipped_nodes",
+			Help:      "The number of nodes skipped by the last reconciliation, by cluster profile, pool and reason",
+		},
+		[]string{"profile", "pool", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(skippedNodesMetric)
+}
+
+// ServeMetrics exposes the prometheus metrics on the address, returning only on failure
+func ServeMetrics(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return http.ListenAndServe(address, mux)
+}
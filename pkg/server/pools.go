@@ -0,0 +1,135 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+)
+
+const (
+	// PoolTagPrefix is the prefix for node pool tags overriding the server defaults
+	PoolTagPrefix = "keto-tokens/"
+	// PoolTagUsages overrides the token usages for the pool (comma separated)
+	PoolTagUsages = PoolTagPrefix + "usages"
+	// PoolTagExtraGroups overrides the extra bootstrap groups for the pool (comma separated)
+	PoolTagExtraGroups = PoolTagPrefix + "extra-groups"
+	// PoolTagDescription overrides the token description for the pool
+	PoolTagDescription = PoolTagPrefix + "description"
+	// PoolTagTTL overrides the token time-to-live for the pool (a duration i.e. 45m)
+	PoolTagTTL = PoolTagPrefix + "ttl"
+	// PoolTagTagName overrides the name of the instance tag used to pass the token
+	PoolTagTagName = PoolTagPrefix + "tag-name"
+	// SkipTag opts the pool or instance out of token issuance when true
+	SkipTag = PoolTagPrefix + "skip"
+)
+
+// poolOptions are the options used when issuing tokens to nodes in a pool
+type poolOptions struct {
+	// skip indicates the pool has opted out of token issuance
+	skip bool
+	// tagName is the instance tag used to pass the token
+	tagName string
+	// token are the options for the token itself
+	token TokenOptions
+}
+
+// getPoolOptions returns the options for a node pool, taking the server defaults and
+// applying any overrides found in the pool tags
+func (s *Server) getPoolOptions(pool cloud.Pool) (poolOptions, error) {
+	options, err := s.getTokenOptions(pool)
+	if err != nil {
+		return poolOptions{}, err
+	}
+	tagName := s.config.TagName
+	skip, err := isSkipped(pool.Tags)
+	if err != nil {
+		return poolOptions{}, err
+	}
+
+	if v, found := pool.Tags[PoolTagTTL]; found {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return poolOptions{}, fmt.Errorf("ttl: %q is invalid, error: %s", v, err)
+		}
+		if ttl <= 0 {
+			return poolOptions{}, fmt.Errorf("ttl: %q must be positive", v)
+		}
+		options.TTL = ttl
+	}
+	if v, found := pool.Tags[PoolTagTagName]; found {
+		if v = strings.TrimSpace(v); v == "" {
+			return poolOptions{}, fmt.Errorf("tag name cannot be empty")
+		}
+		tagName = v
+	}
+
+	return poolOptions{skip: skip, tagName: tagName, token: options}, nil
+}
+
+// isSkipped checks the pool or instance tags for the opt-out tag
+func isSkipped(tags cloud.NodeTags) (bool, error) {
+	v, found := tags[SkipTag]
+	if !found {
+		return false, nil
+	}
+	skip, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		return false, fmt.Errorf("skip: %q is invalid, must be true or false", v)
+	}
+
+	return skip, nil
+}
+
+// getTokenOptions returns the token options for a node pool, taking the server defaults
+// and applying any overrides found in the pool tags
+func (s *Server) getTokenOptions(pool cloud.Pool) (TokenOptions, error) {
+	options := TokenOptions{
+		Description: s.config.TokenDescription,
+		ExtraGroups: s.config.TokenExtraGroups,
+		Namespace:   s.config.TokenNamespace,
+		TTL:         s.config.TokenTTL,
+		Usages:      s.config.TokenUsages,
+	}
+	if len(options.Usages) <= 0 {
+		options.Usages = defaultTokenUsages
+	}
+
+	if v, found := pool.Tags[PoolTagUsages]; found {
+		usages := splitList(v)
+		if err := validateUsages(usages); err != nil {
+			return options, err
+		}
+		options.Usages = usages
+	}
+	if v, found := pool.Tags[PoolTagExtraGroups]; found {
+		groups := splitList(v)
+		if err := validateExtraGroups(groups); err != nil {
+			return options, err
+		}
+		options.ExtraGroups = groups
+	}
+	if v, found := pool.Tags[PoolTagDescription]; found {
+		options.Description = v
+	}
+
+	return options, nil
+}
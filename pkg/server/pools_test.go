@@ -0,0 +1,139 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetTokenOptions(t *testing.T) {
+	cs := []struct {
+		Tags     cloud.NodeTags
+		Expected TokenOptions
+		Ok       bool
+	}{
+		{
+			Tags: cloud.NodeTags{},
+			Expected: TokenOptions{
+				Description: "test",
+				Namespace:   "kube-system",
+				Usages:      []string{"authentication", "signing"},
+			},
+			Ok: true,
+		},
+		{
+			Tags: cloud.NodeTags{
+				PoolTagUsages:      "authentication",
+				PoolTagExtraGroups: "system:bootstrappers:gpu, system:bootstrappers:spot",
+				PoolTagDescription: "gpu pool",
+			},
+			Expected: TokenOptions{
+				Description: "gpu pool",
+				ExtraGroups: []string{"system:bootstrappers:gpu", "system:bootstrappers:spot"},
+				Namespace:   "kube-system",
+				Usages:      []string{"authentication"},
+			},
+			Ok: true,
+		},
+		{Tags: cloud.NodeTags{PoolTagUsages: "authentication,bad"}},
+		{Tags: cloud.NodeTags{PoolTagUsages: ""}},
+		{Tags: cloud.NodeTags{PoolTagUsages: " , "}},
+		{Tags: cloud.NodeTags{PoolTagExtraGroups: "system:masters"}},
+	}
+	s, err := newFakeServer(newFakeServerConfig())
+	if !assert.NoError(t, err) {
+		return
+	}
+	s.config.TokenDescription = "test"
+	s.config.TokenNamespace = "kube-system"
+	s.config.TokenTTL = 0
+	for i, c := range cs {
+		options, err := s.getTokenOptions(cloud.Pool{Name: "test", Tags: c.Tags})
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have thrown an error", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d should not have thrown error", i)
+		assert.Equal(t, c.Expected, options, "case %d", i)
+	}
+}
+
+func TestGetPoolOptions(t *testing.T) {
+	cs := []struct {
+		Tags    cloud.NodeTags
+		TTL     time.Duration
+		TagName string
+		Skip    bool
+		Ok      bool
+	}{
+		{Tags: cloud.NodeTags{}, TTL: time.Duration(10) * time.Minute, TagName: "KubeletToken", Ok: true},
+		{Tags: cloud.NodeTags{PoolTagTTL: "45m"}, TTL: time.Duration(45) * time.Minute, TagName: "KubeletToken", Ok: true},
+		{Tags: cloud.NodeTags{PoolTagTagName: "GPUToken"}, TTL: time.Duration(10) * time.Minute, TagName: "GPUToken", Ok: true},
+		{Tags: cloud.NodeTags{SkipTag: "true"}, TTL: time.Duration(10) * time.Minute, TagName: "KubeletToken", Skip: true, Ok: true},
+		{Tags: cloud.NodeTags{SkipTag: "false"}, TTL: time.Duration(10) * time.Minute, TagName: "KubeletToken", Ok: true},
+		{Tags: cloud.NodeTags{SkipTag: "maybe"}},
+		{Tags: cloud.NodeTags{PoolTagTTL: "45"}},
+		{Tags: cloud.NodeTags{PoolTagTTL: "-1m"}},
+		{Tags: cloud.NodeTags{PoolTagTagName: " "}},
+		{Tags: cloud.NodeTags{PoolTagUsages: "bad"}},
+	}
+	s, err := newFakeServer(newFakeServerConfig())
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i, c := range cs {
+		options, err := s.getPoolOptions(cloud.Pool{Name: "test", Tags: c.Tags})
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have thrown an error", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d should not have thrown error", i)
+		assert.Equal(t, c.TTL, options.token.TTL, "case %d", i)
+		assert.Equal(t, c.TagName, options.tagName, "case %d", i)
+		assert.Equal(t, c.Skip, options.skip, "case %d", i)
+	}
+}
+
+func TestIsSkipped(t *testing.T) {
+	cs := []struct {
+		Tags     cloud.NodeTags
+		Expected bool
+		Ok       bool
+	}{
+		{Tags: cloud.NodeTags{}, Ok: true},
+		{Tags: cloud.NodeTags{SkipTag: "true"}, Expected: true, Ok: true},
+		{Tags: cloud.NodeTags{SkipTag: " TRUE "}, Expected: true, Ok: true},
+		{Tags: cloud.NodeTags{SkipTag: "1"}, Expected: true, Ok: true},
+		{Tags: cloud.NodeTags{SkipTag: "false"}, Ok: true},
+		{Tags: cloud.NodeTags{SkipTag: ""}},
+		{Tags: cloud.NodeTags{SkipTag: "yes"}},
+	}
+	for i, c := range cs {
+		skip, err := isSkipped(c.Tags)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have thrown an error", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d should not have thrown error", i)
+		assert.Equal(t, c.Expected, skip, "case %d", i)
+	}
+}
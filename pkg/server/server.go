@@ -17,10 +17,16 @@ limitations under the License.
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+	"github.com/UKHomeOffice/keto-tokens/pkg/pubkeypin"
 
 	log "github.com/Sirupsen/logrus"
 	"k8s.io/client-go/kubernetes"
@@ -28,40 +34,133 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+var (
+	// ErrStopped means the service has been stopped
+	ErrStopped = errors.New("service has been stopped")
+	// ErrReconcileFailed means one or more nodes failed, or the reconciliation was abandoned
+	ErrReconcileFailed = errors.New("reconciliation failed")
+)
+
+// nodeRequest is a node in need of a registration token
+type nodeRequest struct {
+	// node is the node requiring the token
+	node cloud.NodeID
+	// pool is the name of the node pool
+	pool string
+	// options are the pool options for the node
+	options poolOptions
+}
+
+// skippedNode is a node excluded from token issuance
+type skippedNode struct {
+	// pool is the name of the node pool
+	pool string
+	// reason is why the node was skipped
+	reason string
+}
+
+// issuedToken is a token issued to a node by us
+type issuedToken struct {
+	// pool is the name of the node pool
+	pool string
+	// tagName is the instance tag the token was written to
+	tagName string
+	// token is the registration token
+	token string
+}
+
 // Server is the service component
 type Server struct {
+	sync.RWMutex
+	caHash string
 	cm     cloud.Provider
 	config Config
-	kube   *kubernetes.Clientset
-	tokens TokensProvider
+	// ctx bounds the calls to the cloud provider, cancelled on Stop
+	ctx      context.Context
+	cancel   context.CancelFunc
+	kube     *kubernetes.Clientset
+	recorder Recorder
+	tokens   TokensProvider
+	// issued is the tokens we have issued and not yet seen consumed
+	issued map[cloud.NodeID]issuedToken
+	// skipped is the nodes excluded from token issuance by the last reconciliation
+	skipped map[cloud.NodeID]skippedNode
+	// reloadCh passes a new configuration to be applied between reconciliations
+	reloadCh chan Config
 }
 
 // New creates a new kubelet registration service
 func New(cfg Config, p cloud.Provider, t TokensProvider) (*Server, error) {
 	log.WithFields(log.Fields{
+		"dry-run":  cfg.DryRun,
 		"filters":  cfg.Filters.String(),
+		"profile":  cfg.Profile,
 		"tag-name": cfg.TagName,
 		"ttl":      cfg.TokenTTL,
 	}).Infof("starting the kubernetes token service")
 
+	return newServer(cfg, p, t)
+}
+
+// newServer creates the service, without starting anything
+func newServer(cfg Config, p cloud.Provider, t TokensProvider) (*Server, error) {
+	if err := cfg.IsValid(); err != nil {
+		return nil, err
+	}
+
 	// step: create a kube client
-	kube, err := getKubeClient(cfg)
+	restConfig, err := getKubeConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	kube, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	// step: compute the ca hash we publish alongside the tokens
+	var caHash string
+	if cfg.CAHashTagName != "" {
+		if caHash, err = getCAHash(restConfig); err != nil {
+			return nil, err
+		}
+		if caHash == "" {
+			log.Warn("unable to find the cluster ca, the ca hash will not be published")
+		}
+		if !cfg.SignClusterInfo {
+			log.Warn("the ca hash is only published with tokens we sign the cluster-info for, enable sign-cluster-info")
+		}
+	}
+
+	// step: create the event recorders
+	recorder, err := newRecorder(cfg, kube)
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Server{
-		cm:     p,
-		config: cfg,
-		kube:   kube,
-		tokens: t,
+		caHash:   caHash,
+		cancel:   cancel,
+		cm:       p,
+		config:   cfg,
+		ctx:      ctx,
+		issued:   make(map[cloud.NodeID]issuedToken, 0),
+		kube:     kube,
+		recorder: recorder,
+		reloadCh: make(chan Config),
+		skipped:  make(map[cloud.NodeID]skippedNode, 0),
+		tokens:   t,
 	}, nil
 }
 
-// Start engages the kubelet registration service
+// Start engages the kubelet registration service, returning once stopped
 func (s *Server) Start() error {
 	firstTime := true
 	checkCh := time.NewTicker(1)
+	defer func() {
+		checkCh.Stop()
+	}()
 	for {
 		select {
 		case <-checkCh.C:
@@ -70,38 +169,158 @@ func (s *Server) Start() error {
 				checkCh = time.NewTicker(s.config.ReconcileInterval)
 			}
 			s.reconcileComputeNodes()
+		case cfg := <-s.reloadCh:
+			s.applyConfig(cfg)
+		case <-s.ctx.Done():
+			log.WithFields(log.Fields{
+				"profile": s.config.Profile,
+			}).Info("stopping the kubernetes token service")
+			return nil
 		}
 	}
 }
 
+// Once runs a single reconciliation, returning an error if it failed on any node
+func (s *Server) Once() (ReconcileSummary, error) {
+	return s.reconcileComputeNodes()
+}
+
+// Stop cancels any in-flight calls to the cloud provider and stops the service
+func (s *Server) Stop() {
+	s.cancel()
+}
+
+// Reload validates the configuration and hands it to the service, which applies it once
+// any reconciliation in progress has completed
+func (s *Server) Reload(cfg Config) error {
+	if err := cfg.IsValid(); err != nil {
+		return err
+	}
+	select {
+	case s.reloadCh <- cfg:
+	case <-s.ctx.Done():
+		return ErrStopped
+	}
+
+	return nil
+}
+
+// applyConfig applies a reloaded configuration. The kubernetes client, ca hash and recorders
+// are created once, so the options used to build them are kept until a restart
+func (s *Server) applyConfig(cfg Config) {
+	if cfg.MasterAPI != s.config.MasterAPI || cfg.KubeToken != s.config.KubeToken || cfg.KubeConfig != s.config.KubeConfig ||
+		cfg.CAHashTagName != s.config.CAHashTagName || cfg.RecordEvents != s.config.RecordEvents ||
+		cfg.EventNamespace != s.config.EventNamespace || cfg.AuditLog != s.config.AuditLog {
+		log.WithFields(log.Fields{
+			"profile": s.config.Profile,
+		}).Warn("changes to the kubernetes api, ca hash and auditing options require a restart, ignoring them")
+	}
+	cfg.AuditLog = s.config.AuditLog
+	cfg.CAHashTagName = s.config.CAHashTagName
+	cfg.EventNamespace = s.config.EventNamespace
+	cfg.KubeConfig = s.config.KubeConfig
+	cfg.KubeToken = s.config.KubeToken
+	cfg.MasterAPI = s.config.MasterAPI
+	cfg.Profile = s.config.Profile
+	cfg.RecordEvents = s.config.RecordEvents
+	s.config = cfg
+
+	log.WithFields(log.Fields{
+		"dry-run":  cfg.DryRun,
+		"filters":  cfg.Filters.String(),
+		"interval": cfg.ReconcileInterval.String(),
+		"profile":  cfg.Profile,
+		"tag-name": cfg.TagName,
+		"ttl":      cfg.TokenTTL,
+	}).Info("reloaded the configuration")
+}
+
 // reconcileComputeNodes is responsible for finding new instance and generating
-// registration tokens for them
-func (s *Server) reconcileComputeNodes() error {
-	pools, err := s.cm.DescribePools(s.config.Filters)
+// registration tokens for them, returning an error if any node failed
+func (s *Server) reconcileComputeNodes() (ReconcileSummary, error) {
+	var summary ReconcileSummary
+	// step: the reconciliation is abandoned if the provider throttles or refuses us
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	pools, err := s.cm.DescribePools(ctx, s.config.Filters)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("failed to get list of node pools")
+		logProviderError(err, log.Fields{}, "failed to get list of node pools")
+		summary.Abandoned = true
 
-		return nil
+		return summary, err
+	}
+	summary.Pools = len(pools)
+	for _, pool := range pools {
+		summary.Nodes += len(pool.Nodes)
 	}
 	log.Debugf("found %d node pools tagged", len(pools))
+	s.pruneIssued(pools)
 
-	usages := []string{"authentication", "signing"}
-	nodesCh := make(chan cloud.NodeID, 10)
+	// step: the producer alone writes the skipped and failed nodes, which are read once the channel is closed
+	skipped := make(map[cloud.NodeID]skippedNode, 0)
+	failed := 0
+	nodesCh := make(chan nodeRequest, 10)
 	go func() {
+		defer close(nodesCh)
 		for _, pool := range pools {
+			options, err := s.getPoolOptions(pool)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+					"pool":  pool.Name,
+				}).Error("invalid overrides on node pool, skipping")
+				for _, node := range pool.Nodes {
+					skipped[node] = skippedNode{pool: pool.Name, reason: skipReasonInvalid}
+				}
+
+				continue
+			}
+			if options.skip {
+				for _, node := range pool.Nodes {
+					skipped[node] = skippedNode{pool: pool.Name, reason: skipReasonPool}
+				}
+
+				continue
+			}
 			for _, node := range pool.Nodes {
-				_, found, err := s.cm.GetNodeTag(node, s.config.TagName)
+				if ctx.Err() != nil {
+					return
+				}
+				tags, err := s.cm.GetNodeTags(ctx, node)
 				if err != nil {
-					log.WithFields(log.Fields{
-						"error": err.Error(),
-						"node":  node,
-						"pool":  pool.Name,
-					}).Error("failed to get instance tag")
+					logProviderError(err, log.Fields{
+						"node": node,
+						"pool": pool.Name,
+					}, "failed to get instance tags")
+					failed++
+					if abandonReconcile(err) {
+						cancel()
+						return
+					}
+
+					continue
+				}
+				// check: has the instance opted out of token issuance
+				if skip, err := isSkipped(tags); err != nil || skip {
+					reason := skipReasonInstance
+					if err != nil {
+						reason = skipReasonInvalid
+						log.WithFields(log.Fields{
+							"error": err.Error(),
+							"node":  node,
+							"pool":  pool.Name,
+						}).Error("invalid opt-out tag on instance, skipping")
+					}
+					skipped[node] = skippedNode{pool: pool.Name, reason: reason}
 
 					continue
 				}
-				// check: if the tags if found move on
-				if found {
+				// check: if the tags if found move on, unless the client is requesting a new token
+				if value, found := tags[options.tagName]; found && value != cloud.RequestTagValue {
+					if value == cloud.CompletedTagValue {
+						s.markConsumed(node)
+					}
 					log.WithFields(log.Fields{
 						"node": node,
 						"pool": pool.Name,
@@ -109,69 +328,287 @@ func (s *Server) reconcileComputeNodes() error {
 
 					continue
 				}
-				nodesCh <- node
+				nodesCh <- nodeRequest{node: node, pool: pool.Name, options: options}
 			}
 		}
-		close(nodesCh)
 	}()
 
-	for node := range nodesCh {
-		err := func(n cloud.NodeID) error {
-			token, err := s.tokens.Create(s.kube, n, s.config.TokenTTL, usages, s.config.TokenNamespace)
-			if err != nil {
-				return fmt.Errorf("failed to create token, error: %s", err)
-			}
-			updateTags := cloud.NodeTags{s.config.TagName: token}
+	for req := range nodesCh {
+		if ctx.Err() != nil {
+			// step: drain the requests, the reconciliation has been abandoned
+			continue
+		}
+		if s.config.DryRun {
+			summary.Planned++
+			log.WithFields(log.Fields{
+				"extra-groups": strings.Join(req.options.token.ExtraGroups, ","),
+				"node":         req.node,
+				"pool":         req.pool,
+				"tag-name":     req.options.tagName,
+				"ttl":          req.options.token.TTL.String(),
+				"usages":       strings.Join(req.options.token.Usages, ","),
+			}).Info("dry-run: would generate token for node")
 
-			if err := s.cm.SetNodeTags(n, updateTags); err != nil {
-				if err = s.tokens.Delete(s.kube, token, s.config.TokenNamespace); err != nil {
-					return fmt.Errorf("failed to delete the create token on failure to update tags, error: %s", err)
-				}
-				return fmt.Errorf("failed to update tags, error: %s", err)
+			continue
+		}
+
+		if _, err := s.issueToken(ctx, req); err != nil {
+			if abandonReconcile(err) {
+				cancel()
 			}
-			return nil
-		}(node)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"node":  node,
-				"error": err.Error(),
-			}).Error("failed to create registration token")
+			logProviderError(err, log.Fields{
+				"node": req.node,
+				"pool": req.pool,
+			}, "failed to create registration token")
+			summary.Failed++
 
 			continue
 		}
+		summary.Issued++
 
 		log.WithFields(log.Fields{
-			"node":    node,
-			"expires": time.Now().Add(s.config.TokenTTL).Format(time.RFC1123Z),
+			"node":    req.node,
+			"pool":    req.pool,
+			"expires": time.Now().Add(req.options.token.TTL).Format(time.RFC1123Z),
 		}).Info("successfully generate token for node")
 	}
+	summary.Failed += failed
+	summary.Skipped = len(skipped)
+	if ctx.Err() == nil {
+		s.reportSkipped(skipped)
+	} else {
+		summary.Abandoned = true
+	}
+	if s.config.DryRun {
+		log.WithFields(log.Fields{
+			"nodes": summary.Planned,
+			"pools": summary.Pools,
+		}).Info("dry-run: reconciliation plan complete, no tokens issued")
+
+		return summary, reconcileError(summary)
+	}
+
+	failure := reconcileError(summary)
+	if s.config.SignClusterInfo {
+		if err := s.syncClusterInfo(); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("failed to sign the cluster-info")
+			if failure == nil {
+				failure = err
+			}
+		}
+	}
+	if s.config.ApproveCSRs {
+		if err := s.reconcileCSRs(); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("failed to reconcile the certificate requests")
+			if failure == nil {
+				failure = err
+			}
+		}
+	}
+
+	return summary, failure
+}
+
+// reconcileError returns an error if the reconciliation failed on any node or was abandoned
+func reconcileError(summary ReconcileSummary) error {
+	if summary.Failed > 0 || summary.Abandoned {
+		return ErrReconcileFailed
+	}
 
 	return nil
 }
 
-// getKubeClient is responsible for creating a kubernetes API client for us
-func getKubeClient(c Config) (*kubernetes.Clientset, error) {
-	var err error
-	var config *rest.Config
+// issueToken creates a token for the node and writes it to the instance tag, deleting the
+// token again if the tag cannot be written
+func (s *Server) issueToken(ctx context.Context, req nodeRequest) (string, error) {
+	n := req.node
+	token, err := s.tokens.Create(s.kube, n, req.options.token)
+	if err != nil {
+		return "", fmt.Errorf("failed to create token, error: %s", err)
+	}
+	s.record(ActionCreated, n, req.pool, token, "created registration token", nil)
+
+	// step: sign the cluster-info before publishing, a client reading the tag straight away
+	// must find the signature for its token
+	signed := s.config.SignClusterInfo && containsString(req.options.token.Usages, "signing")
+	if signed {
+		if err := s.addClusterInfoSignature(token); err != nil {
+			if derr := s.tokens.Delete(s.kube, token, req.options.token.Namespace); derr != nil {
+				s.record(ActionRolledBack, n, req.pool, token, "failed to delete token after signing failure", derr)
+			} else {
+				s.record(ActionRolledBack, n, req.pool, token, "deleted token after signing failure", err)
+			}
+
+			return "", fmt.Errorf("failed to sign the cluster-info, error: %s", err)
+		}
+	}
+
+	updateTags := s.tokenTags(req.options.tagName, token, signed)
+
+	if err := s.cm.SetNodeTags(ctx, n, updateTags); err != nil {
+		if signed {
+			if serr := s.removeClusterInfoSignature(token); serr != nil {
+				log.WithFields(log.Fields{
+					"error": serr.Error(),
+					"node":  n,
+				}).Warn("failed to remove the cluster-info signature, it will be removed on the next sync")
+			}
+		}
+		if derr := s.tokens.Delete(s.kube, token, req.options.token.Namespace); derr != nil {
+			s.record(ActionRolledBack, n, req.pool, token, "failed to delete token after tagging failure", derr)
+			// step: the kind of the tagging failure is kept, so the caller can decide to back off
+			return "", cloud.NewError(cloud.KindOf(err), fmt.Errorf("failed to delete the create token on failure to update tags, error: %s", derr))
+		}
+		s.record(ActionRolledBack, n, req.pool, token, "deleted token after tagging failure", err)
+
+		return "", err
+	}
+	s.record(ActionTagged, n, req.pool, token, fmt.Sprintf("wrote registration token to tag: %s", req.options.tagName), nil)
+
+	s.Lock()
+	defer s.Unlock()
+	s.issued[n] = issuedToken{pool: req.pool, tagName: req.options.tagName, token: token}
+
+	return token, nil
+}
+
+// tokenTags returns the tags written to the node; the ca hash is only published with a token we
+// have signed the cluster-info for, its presence telling the client discovery will succeed, and
+// is otherwise cleared so a hash published with an earlier token is not taken as an advert
+func (s *Server) tokenTags(tagName, token string, signed bool) cloud.NodeTags {
+	tags := cloud.NodeTags{tagName: token}
+	if s.caHash != "" {
+		tags[s.config.CAHashTagName] = ""
+		if signed {
+			tags[s.config.CAHashTagName] = s.caHash
+		}
+	}
+
+	return tags
+}
+
+// abandonReconcile checks if the error means we should stop calling the provider until the
+// next reconciliation; throttling is backed off and permanent failures will not clear by retrying
+func abandonReconcile(err error) bool {
+	return cloud.IsThrottled(err) || cloud.IsPermanent(err)
+}
+
+// logProviderError logs the provider error according to its kind
+func logProviderError(err error, fields log.Fields, message string) {
+	fields["error"] = err.Error()
+	fields["kind"] = cloud.KindOf(err).String()
+	entry := log.WithFields(fields)
+	switch {
+	case cloud.IsThrottled(err):
+		entry.Warn(message + ", provider is throttling, backing off until the next reconcile")
+	case cloud.IsPermanent(err):
+		entry.Error(message + ", check the credentials and configuration")
+	case cloud.IsNotFound(err):
+		entry.Warn(message + ", the instance has gone")
+	default:
+		entry.Error(message)
+	}
+}
+
+// markConsumed records the consumption of a token we have issued
+func (s *Server) markConsumed(node cloud.NodeID) {
+	s.Lock()
+	issued, found := s.issued[node]
+	delete(s.issued, node)
+	s.Unlock()
+
+	if found {
+		s.record(ActionConsumed, node, issued.pool, issued.token, "registration token consumed by node", nil)
+	}
+}
+
+// reportSkipped logs the nodes which have been excluded from, or returned to, token issuance
+// since the last reconciliation and updates the metrics
+func (s *Server) reportSkipped(skipped map[cloud.NodeID]skippedNode) {
+	s.Lock()
+	previous := s.skipped
+	s.skipped = skipped
+	s.Unlock()
+
+	counts := make(map[skippedNode]int, 0)
+	for node, x := range skipped {
+		counts[x]++
+		if p, found := previous[node]; !found || p != x {
+			log.WithFields(log.Fields{
+				"node":    node,
+				"pool":    x.pool,
+				"profile": s.config.Profile,
+				"reason":  x.reason,
+			}).Info("skipping node, excluded from token issuance")
+		}
+	}
+	for node, x := range previous {
+		if _, found := skipped[node]; !found {
+			log.WithFields(log.Fields{
+				"node":    node,
+				"pool":    x.pool,
+				"profile": s.config.Profile,
+			}).Info("node no longer excluded from token issuance")
+		}
+		// step: the metrics are shared with the other profiles, so only our stale series are removed
+		if _, found := counts[x]; !found {
+			skippedNodesMetric.DeleteLabelValues(s.config.Profile, x.pool, x.reason)
+		}
+	}
+	for x, count := range counts {
+		skippedNodesMetric.WithLabelValues(s.config.Profile, x.pool, x.reason).Set(float64(count))
+	}
+}
+
+// pruneIssued forgets any issued tokens for nodes no longer in the pools
+func (s *Server) pruneIssued(pools []cloud.Pool) {
+	members := make(map[cloud.NodeID]bool, 0)
+	for _, p := range pools {
+		for _, n := range p.Nodes {
+			members[n] = true
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	for n := range s.issued {
+		if !members[n] {
+			delete(s.issued, n)
+		}
+	}
+}
+
+// getKubeConfig is responsible for creating a kubernetes API client configuration for us
+func getKubeConfig(c Config) (*rest.Config, error) {
 	if c.MasterAPI != "" && c.KubeToken != "" {
-		config = &rest.Config{
+		return &rest.Config{
 			Host:        c.MasterAPI,
 			BearerToken: c.KubeToken,
 			Insecure:    true,
-		}
-	} else if c.KubeConfig != "" {
-		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		}, nil
+	}
+	if c.KubeConfig != "" {
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
 			&clientcmd.ClientConfigLoadingRules{ExplicitPath: c.KubeConfig},
 			&clientcmd.ConfigOverrides{}).ClientConfig()
+	}
+
+	return rest.InClusterConfig()
+}
+
+// getCAHash computes the pin of the cluster ca from the client configuration, returning
+// an empty hash if the configuration holds no ca
+func getCAHash(config *rest.Config) (string, error) {
+	data := config.TLSClientConfig.CAData
+	if len(data) <= 0 && config.TLSClientConfig.CAFile != "" {
+		content, err := ioutil.ReadFile(config.TLSClientConfig.CAFile)
 		if err != nil {
-			return nil, err
-		}
-	} else {
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			return nil, err
+			return "", err
 		}
+		data = content
+	}
+	if len(data) <= 0 {
+		return "", nil
 	}
 
-	return kubernetes.NewForConfig(config)
+	return pubkeypin.HashPEM(data)
 }
@@ -17,6 +17,8 @@ limitations under the License.
 package server
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"sync"
 	"testing"
@@ -26,6 +28,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/rest"
 )
 
 func TestNewServer(t *testing.T) {
@@ -50,16 +53,313 @@ func TestServerStart(t *testing.T) {
 	}()
 	<-time.After(time.Duration(100) * time.Millisecond)
 	// check nodes are tagged
-	pools, _ := c.DescribePools(cfg.Filters)
+	pools, _ := c.DescribePools(context.Background(), cfg.Filters)
 	for _, p := range pools {
 		for _, i := range p.Nodes {
-			tag, found, _ := c.GetNodeTag(i, cfg.TagName)
+			tag, found, _ := c.GetNodeTag(context.Background(), i, cfg.TagName)
 			assert.True(t, found)
 			assert.NotEmpty(t, tag)
 		}
 	}
 }
 
+func TestServerStop(t *testing.T) {
+	cfg := newFakeServerConfig()
+	cfg.ReconcileInterval = time.Duration(10) * time.Millisecond
+	s, err := newFakeServer(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- s.Start()
+	}()
+	s.Stop()
+	select {
+	case err := <-doneCh:
+		assert.NoError(t, err)
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Error("the server did not stop")
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	c := newFakeProvider(newFakePools())
+	cfg := newFakeServerConfig()
+	cfg.DryRun = true
+	cfg.ReconcileInterval = time.Duration(10) * time.Millisecond
+	s, err := New(cfg, c, newFakeTokenProvider())
+	if !assert.NoError(t, err) {
+		return
+	}
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- s.Start()
+	}()
+
+	// step: an invalid configuration is refused
+	invalid := cfg
+	invalid.TagName = ""
+	assert.Error(t, s.Reload(invalid))
+	invalid = cfg
+	invalid.ReconcileInterval = 0
+	assert.Error(t, s.Reload(invalid))
+
+	// step: the reloaded configuration is used by the next reconciliation
+	updated := cfg
+	updated.DryRun = false
+	updated.MasterAPI = "https://10.0.0.1"
+	updated.TagName = "ReloadedToken"
+	assert.NoError(t, s.Reload(updated))
+	<-time.After(time.Duration(100) * time.Millisecond)
+	s.Stop()
+	assert.NoError(t, <-doneCh)
+
+	assert.Equal(t, "ReloadedToken", s.config.TagName)
+	assert.Equal(t, cfg.MasterAPI, s.config.MasterAPI)
+	_, found, _ := c.GetNodeTag(context.Background(), "compute00-gp0", "ReloadedToken")
+	assert.True(t, found)
+	_, found, _ = c.GetNodeTag(context.Background(), "compute00-gp0", cfg.TagName)
+	assert.False(t, found)
+
+	assert.Equal(t, ErrStopped, s.Reload(updated))
+}
+
+func TestServerDryRun(t *testing.T) {
+	tk := newFakeTokenProvider()
+	c := newFakeProvider(newFakePools())
+	cfg := newFakeServerConfig()
+	cfg.DryRun = true
+	s, err := New(cfg, c, tk)
+	if !assert.NoError(t, err) {
+		return
+	}
+	summary, err := s.reconcileComputeNodes()
+	assert.NoError(t, err)
+	assert.True(t, summary.Planned >= 5)
+	assert.Equal(t, 0, summary.Issued)
+	assert.Empty(t, tk.(*fakeTokenProvider).tokens)
+	pools, _ := c.DescribePools(context.Background(), cfg.Filters)
+	for _, p := range pools {
+		for _, i := range p.Nodes {
+			_, found, _ := c.GetNodeTag(context.Background(), i, cfg.TagName)
+			assert.False(t, found)
+		}
+	}
+}
+
+func TestServerRecordsLifecycle(t *testing.T) {
+	c := newFakeProvider(newFakePools())
+	cfg := newFakeServerConfig()
+	s, err := New(cfg, c, newFakeTokenProvider())
+	if !assert.NoError(t, err) {
+		return
+	}
+	r := &fakeRecorder{}
+	s.recorder = r
+
+	_, err = s.reconcileComputeNodes()
+	assert.NoError(t, err)
+	assert.True(t, len(r.actions()) >= 10)
+	assert.Contains(t, r.actions(), ActionCreated)
+	assert.Contains(t, r.actions(), ActionTagged)
+
+	// step: consume a token and check we see it
+	assert.NoError(t, c.SetNodeTags(context.Background(), "compute00-gp0", cloud.NodeTags{cfg.TagName: "Success"}))
+	_, err = s.reconcileComputeNodes()
+	assert.NoError(t, err)
+	actions := r.actions()
+	assert.Equal(t, ActionConsumed, actions[len(actions)-1])
+
+	// step: we should only see the consumption once
+	_, err = s.reconcileComputeNodes()
+	assert.NoError(t, err)
+	assert.Equal(t, len(actions), len(r.actions()))
+}
+
+func TestGetCAHash(t *testing.T) {
+	hash, err := getCAHash(&rest.Config{})
+	assert.NoError(t, err)
+	assert.Empty(t, hash)
+
+	config := &rest.Config{}
+	config.TLSClientConfig.CAData = []byte(fakeCertificate)
+	hash, err = getCAHash(config)
+	assert.NoError(t, err)
+	assert.Equal(t, fakeCertificatePin, hash)
+
+	config = &rest.Config{}
+	config.TLSClientConfig.CAFile = "/not/there"
+	_, err = getCAHash(config)
+	assert.Error(t, err)
+}
+
+func TestServerPublishesCAHash(t *testing.T) {
+	c := newFakeProvider(newFakePools())
+	cfg := newFakeServerConfig()
+	cfg.CAHashTagName = "KubeletCAHash"
+	s, err := New(cfg, c, newFakeTokenProvider())
+	if !assert.NoError(t, err) {
+		return
+	}
+	s.caHash = fakeCertificatePin
+	assert.Equal(t, cloud.NodeTags{cfg.TagName: "token", cfg.CAHashTagName: fakeCertificatePin}, s.tokenTags(cfg.TagName, "token", true))
+
+	// step: without a signed cluster-info the hash is cleared rather than advertised
+	c.SetNodeTags(context.Background(), "compute00-gp0", cloud.NodeTags{cfg.CAHashTagName: fakeCertificatePin})
+	_, err = s.reconcileComputeNodes()
+	assert.NoError(t, err)
+	hash, found, err := c.GetNodeTag(context.Background(), "compute00-gp0", cfg.CAHashTagName)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "", hash)
+
+	s.caHash = ""
+	assert.Equal(t, cloud.NodeTags{cfg.TagName: "token"}, s.tokenTags(cfg.TagName, "token", true))
+}
+
+func TestServerReissuesRequestedTokens(t *testing.T) {
+	c := newFakeProvider(newFakePools())
+	cfg := newFakeServerConfig()
+	s, err := New(cfg, c, newFakeTokenProvider())
+	if !assert.NoError(t, err) {
+		return
+	}
+	c.SetNodeTags(context.Background(), "compute00-gp0", cloud.NodeTags{cfg.TagName: cloud.RequestTagValue})
+	c.SetNodeTags(context.Background(), "compute01-gp0", cloud.NodeTags{cfg.TagName: cloud.CompletedTagValue})
+	_, err = s.reconcileComputeNodes()
+	assert.NoError(t, err)
+	token, _, _ := c.GetNodeTag(context.Background(), "compute00-gp0", cfg.TagName)
+	assert.NotEqual(t, cloud.RequestTagValue, token)
+	assert.NotEmpty(t, token)
+	token, _, _ = c.GetNodeTag(context.Background(), "compute01-gp0", cfg.TagName)
+	assert.Equal(t, cloud.CompletedTagValue, token)
+}
+
+func TestServerAbandonsReconcile(t *testing.T) {
+	cs := []struct {
+		Err       error
+		Expected  int
+		Abandoned bool
+	}{
+		{Err: cloud.ErrThrottled, Expected: 1, Abandoned: true},
+		{Err: cloud.NewError(cloud.Unauthorized, errors.New("denied")), Expected: 1, Abandoned: true},
+		{Err: cloud.NewError(cloud.Transient, errors.New("timeout")), Expected: 6},
+		{Err: cloud.ErrInstanceNotFound, Expected: 6},
+	}
+	for i, c := range cs {
+		p := &failingProvider{Provider: newFakeProvider(newFakePools()), err: c.Err}
+		cfg := newFakeServerConfig()
+		s, err := New(cfg, p, newFakeTokenProvider())
+		if !assert.NoError(t, err) {
+			return
+		}
+		summary, err := s.reconcileComputeNodes()
+		assert.Equal(t, ErrReconcileFailed, err, "case %d", i)
+		assert.Equal(t, c.Expected, p.calls, "case %d", i)
+		assert.Equal(t, c.Expected, summary.Failed, "case %d", i)
+		assert.Equal(t, c.Abandoned, summary.Abandoned, "case %d", i)
+		assert.Equal(t, 0, summary.Issued, "case %d", i)
+	}
+}
+
+func TestServerOnce(t *testing.T) {
+	c := newFakeProvider(newFakePools())
+	s, err := New(newFakeServerConfig(), c, newFakeTokenProvider())
+	if !assert.NoError(t, err) {
+		return
+	}
+	summary, err := s.Once()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, summary.Pools)
+	assert.Equal(t, 6, summary.Nodes)
+	assert.True(t, summary.Issued >= 5)
+	assert.Equal(t, 0, summary.Failed)
+	assert.False(t, summary.Abandoned)
+
+	// step: the tokens are all issued, so a second pass has nothing to do
+	summary, err = s.Once()
+	assert.NoError(t, err)
+	assert.Equal(t, 6, summary.Nodes)
+	assert.Equal(t, 0, summary.Issued)
+}
+
+func TestServerSkipsOptedOutNodes(t *testing.T) {
+	pools := newFakePools()
+	c := newFakeProvider(pools).(*fakeProvider)
+	// step: opt out the compute0 pool and an instance of compute1
+	pools[1].Tags[SkipTag] = "true"
+	c.nodes["compute00-gp1"][SkipTag] = "true"
+	c.nodes["compute01-gp1"][SkipTag] = "bad"
+	s, err := New(newFakeServerConfig(), c, newFakeTokenProvider())
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = s.reconcileComputeNodes()
+	assert.NoError(t, err)
+
+	expected := map[cloud.NodeID]skippedNode{
+		"compute00-gp0": {pool: "compute0", reason: skipReasonPool},
+		"compute01-gp0": {pool: "compute0", reason: skipReasonPool},
+		"compute00-gp1": {pool: "compute1", reason: skipReasonInstance},
+		"compute01-gp1": {pool: "compute1", reason: skipReasonInvalid},
+	}
+	assert.Equal(t, expected, s.skipped)
+	for node := range expected {
+		_, found, _ := c.GetNodeTag(context.Background(), node, "KubeletToken")
+		assert.False(t, found, "node %s should not have been issued a token", node)
+	}
+	_, found, _ := c.GetNodeTag(context.Background(), "compute02-gp1", "KubeletToken")
+	assert.True(t, found)
+
+	// step: removing the opt-out returns the node to token issuance
+	delete(c.nodes["compute00-gp1"], SkipTag)
+	_, err = s.reconcileComputeNodes()
+	assert.NoError(t, err)
+	assert.NotContains(t, s.skipped, cloud.NodeID("compute00-gp1"))
+	_, found, _ = c.GetNodeTag(context.Background(), "compute00-gp1", "KubeletToken")
+	assert.True(t, found)
+}
+
+func TestServerProfilesShareProvider(t *testing.T) {
+	pools := newFakePools()
+	c := newFakeProvider(pools)
+	masters := newFakeServerConfig()
+	masters.Profile = "masters"
+	masters.Filters = cloud.NewSelector(cloud.NodeTags{"Role": "master"})
+	masters.TagName = "MasterToken"
+	compute := newFakeServerConfig()
+	compute.Profile = "compute"
+
+	var servers []*Server
+	for _, cfg := range []Config{masters, compute} {
+		s, err := New(cfg, c, newFakeTokenProvider())
+		if !assert.NoError(t, err) {
+			return
+		}
+		servers = append(servers, s)
+	}
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *Server) {
+			defer wg.Done()
+			_, err := s.reconcileComputeNodes()
+			assert.NoError(t, err)
+		}(s)
+	}
+	wg.Wait()
+
+	for _, p := range pools {
+		for _, n := range p.Nodes {
+			_, master, _ := c.GetNodeTag(context.Background(), n, "MasterToken")
+			_, compute, _ := c.GetNodeTag(context.Background(), n, "KubeletToken")
+			assert.Equal(t, p.Name == "masters", master, "node %s", n)
+			assert.Equal(t, p.Name != "masters", compute, "node %s", n)
+		}
+	}
+}
+
 func newFakeServer(cfg Config) (*Server, error) {
 	log.SetOutput(ioutil.Discard)
 	t := newFakeTokenProvider()
@@ -99,17 +399,31 @@ func newFakePools() []cloud.Pool {
 
 func newFakeServerConfig() Config {
 	return Config{
-		MasterAPI: "https://127.0.0.1",
-		KubeToken: "token",
-		TagName:   "KubeletToken",
-		TokenTTL:  time.Duration(10) * time.Minute,
-		Filters: cloud.NodeTags{
+		MasterAPI:         "https://127.0.0.1",
+		KubeToken:         "token",
+		ReconcileInterval: time.Minute,
+		TagName:           "KubeletToken",
+		TokenTTL:          time.Duration(10) * time.Minute,
+		Filters: cloud.NewSelector(cloud.NodeTags{
 			"Role": "compute",
 			"Env":  "dev",
-		},
+		}),
 	}
 }
 
+// failingProvider fails every request for an instance tag
+type failingProvider struct {
+	cloud.Provider
+	calls int
+	err   error
+}
+
+func (f *failingProvider) GetNodeTags(ctx context.Context, id cloud.NodeID) (cloud.NodeTags, error) {
+	f.calls++
+
+	return cloud.NodeTags{}, f.err
+}
+
 type fakeProvider struct {
 	sync.RWMutex
 	pools []cloud.Pool
@@ -130,22 +444,14 @@ func newFakeProvider(pools []cloud.Pool) cloud.Provider {
 	return c
 }
 
-func (f *fakeProvider) GetNodeID() (cloud.NodeID, error) {
+func (f *fakeProvider) GetNodeID(ctx context.Context) (cloud.NodeID, error) {
 	return "compute00", nil
 }
 
-func (f *fakeProvider) DescribePools(filters cloud.NodeTags) ([]cloud.Pool, error) {
+func (f *fakeProvider) DescribePools(ctx context.Context, filters cloud.Selector) ([]cloud.Pool, error) {
 	var list []cloud.Pool
 	for _, p := range f.pools {
-		found := true
-		for k, v := range filters {
-			val, exists := p.Tags[k]
-			if !exists || val != v {
-				found = false
-				break
-			}
-		}
-		if found {
+		if filters.Matches(p.Tags) {
 			list = append(list, p)
 		}
 	}
@@ -154,22 +460,22 @@ func (f *fakeProvider) DescribePools(filters cloud.NodeTags) ([]cloud.Pool, erro
 }
 
 // GetNodeTags retrieves a list of node tags
-func (f *fakeProvider) GetNodeTags(id cloud.NodeID) (cloud.NodeTags, error) {
+func (f *fakeProvider) GetNodeTags(ctx context.Context, id cloud.NodeID) (cloud.NodeTags, error) {
 	f.RLock()
 	defer f.RUnlock()
 	if n, found := f.nodes[id]; found {
-		return n, nil
+		return n.Clone(), nil
 	}
 
 	return cloud.NodeTags{}, cloud.ErrInstanceNotFound
 }
 
 // GetNodeTag retrieves a specific node tag
-func (f *fakeProvider) GetNodeTag(id cloud.NodeID, tag string) (string, bool, error) {
+func (f *fakeProvider) GetNodeTag(ctx context.Context, id cloud.NodeID, tag string) (string, bool, error) {
 	f.RLock()
 	defer f.RUnlock()
 
-	n, err := f.GetNodeTags(id)
+	n, err := f.GetNodeTags(ctx, id)
 	if err != nil {
 		return "", false, err
 	}
@@ -179,7 +485,7 @@ func (f *fakeProvider) GetNodeTag(id cloud.NodeID, tag string) (string, bool, er
 }
 
 // SetNodeTags is used to set a series of tags on a node
-func (f *fakeProvider) SetNodeTags(id cloud.NodeID, tags cloud.NodeTags) error {
+func (f *fakeProvider) SetNodeTags(ctx context.Context, id cloud.NodeID, tags cloud.NodeTags) error {
 	f.Lock()
 	defer f.Unlock()
 
@@ -191,3 +497,18 @@ func (f *fakeProvider) SetNodeTags(id cloud.NodeID, tags cloud.NodeTags) error {
 
 	return nil
 }
+
+const fakeCertificatePin = "sha256:fd9be4d5f0034e6910e376b02038603d017e78e31f8f8b6c783e77cec85e78c2"
+
+const fakeCertificate = `-----BEGIN CERTIFICATE-----
+MIIBgDCCASWgAwIBAgIUfC9aSnbsYBb3swsO+PbHlQYvSHswCgYIKoZIzj0EAwIw
+FTETMBEGA1UEAwwKa3ViZXJuZXRlczAeFw0yNjEwMTgxNjEyMzRaFw0zNjEwMTUx
+NjEyMzRaMBUxEzARBgNVBAMMCmt1YmVybmV0ZXMwWTATBgcqhkjOPQIBBggqhkjO
+PQMBBwNCAARGV417SlLT31mqaE+JzHh/LELMLfzJV3CzAp99v728Cc0hqsMnbgkN
+OEE7eeN5zTWGAKXucTe6Bd9scBgOvVtYo1MwUTAdBgNVHQ4EFgQU9VpBPswmFYpO
+03XwgSfPh6T9dGcwHwYDVR0jBBgwFoAU9VpBPswmFYpO03XwgSfPh6T9dGcwDwYD
+VR0TAQH/BAUwAwEB/zAKBggqhkjOPQQDAgNJADBGAiEA4hYyvVlyE3PAjIEtgm+F
+repuuJScmfpboEr6wZAfTPECIQDOOLXRBPTvmEtzTD1w4APZXRRFwhr7Af79OgPa
+xqkx8Q==
+-----END CERTIFICATE-----
+`
@@ -0,0 +1,228 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+// Note: this performs the job of the controller-manager bootstrapsigner for the tokens we
+// issue, for clusters which do not have it enabled
+// https://github.com/kubernetes/kubernetes/tree/master/pkg/controller/bootstrap
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/jws"
+
+	log "github.com/Sirupsen/logrus"
+	"k8s.io/client-go/pkg/api/v1"
+	bootstrapapi "k8s.io/kubernetes/pkg/bootstrap/api"
+)
+
+const (
+	// publicNamespace is the namespace holding the cluster-info
+	publicNamespace = "kube-public"
+	// signedAnnotation records the token ids we have signed the cluster-info for
+	signedAnnotation = "keto-tokens/signed-tokens"
+)
+
+// syncClusterInfo ensures the cluster-info carries a signature for each of the signing
+// tokens we have issued and removes the signatures of those deleted or expired
+func (s *Server) syncClusterInfo() error {
+	secrets, err := s.kube.Secrets(s.config.TokenNamespace).List(v1.ListOptions{
+		LabelSelector: managedLabel + "=true",
+	})
+	if err != nil {
+		return err
+	}
+	info, err := s.kube.ConfigMaps(publicNamespace).Get(bootstrapapi.ConfigMapClusterInfo)
+	if err != nil {
+		return err
+	}
+	if !signClusterInfo(info, secrets.Items, time.Now()) {
+		return nil
+	}
+	if _, err := s.kube.ConfigMaps(publicNamespace).Update(info); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"tokens": info.Annotations[signedAnnotation],
+	}).Info("updated the cluster-info token signatures")
+
+	return nil
+}
+
+// addClusterInfoSignature signs the cluster-info for a token we are about to publish, so a
+// client reading the tag straight away finds its signature
+func (s *Server) addClusterInfoSignature(token string) error {
+	tokenID, tokenSecret, err := parseToken(token)
+	if err != nil {
+		return err
+	}
+	info, err := s.kube.ConfigMaps(publicNamespace).Get(bootstrapapi.ConfigMapClusterInfo)
+	if err != nil {
+		return err
+	}
+	changed, err := addSignature(info, tokenID, tokenSecret)
+	if err != nil || !changed {
+		return err
+	}
+	_, err = s.kube.ConfigMaps(publicNamespace).Update(info)
+
+	return err
+}
+
+// removeClusterInfoSignature removes the signature of a token we failed to publish
+func (s *Server) removeClusterInfoSignature(token string) error {
+	tokenID, _, err := parseToken(token)
+	if err != nil {
+		return err
+	}
+	info, err := s.kube.ConfigMaps(publicNamespace).Get(bootstrapapi.ConfigMapClusterInfo)
+	if err != nil {
+		return err
+	}
+	if !removeSignature(info, tokenID) {
+		return nil
+	}
+	_, err = s.kube.ConfigMaps(publicNamespace).Update(info)
+
+	return err
+}
+
+// addSignature adds the signature of the token to the cluster-info, returning true if the
+// configmap was changed
+func addSignature(info *v1.ConfigMap, tokenID, tokenSecret string) (bool, error) {
+	content, found := info.Data[bootstrapapi.KubeConfigKey]
+	if !found {
+		return false, errors.New("cluster-info has no kubeconfig")
+	}
+	signature, err := jws.ComputeDetachedSignature(content, tokenID, tokenSecret)
+	if err != nil {
+		return false, err
+	}
+	if info.Annotations == nil {
+		info.Annotations = make(map[string]string, 0)
+	}
+	ids := splitList(info.Annotations[signedAnnotation])
+	key := bootstrapapi.JWSSignatureKeyPrefix + tokenID
+	if info.Data[key] == signature && containsString(ids, tokenID) {
+		return false, nil
+	}
+	info.Data[key] = signature
+	if !containsString(ids, tokenID) {
+		ids = append(ids, tokenID)
+		sort.Strings(ids)
+		info.Annotations[signedAnnotation] = strings.Join(ids, ",")
+	}
+
+	return true, nil
+}
+
+// removeSignature removes the signature we added for the token, returning true if the
+// configmap was changed
+func removeSignature(info *v1.ConfigMap, tokenID string) bool {
+	ids := splitList(info.Annotations[signedAnnotation])
+	if !containsString(ids, tokenID) {
+		return false
+	}
+	delete(info.Data, bootstrapapi.JWSSignatureKeyPrefix+tokenID)
+	var list []string
+	for _, x := range ids {
+		if x != tokenID {
+			list = append(list, x)
+		}
+	}
+	info.Annotations[signedAnnotation] = strings.Join(list, ",")
+
+	return true
+}
+
+// signClusterInfo updates the signatures in the cluster-info for the token secrets,
+// returning true if the configmap was changed
+func signClusterInfo(info *v1.ConfigMap, secrets []v1.Secret, now time.Time) bool {
+	content, found := info.Data[bootstrapapi.KubeConfigKey]
+	if !found {
+		return false
+	}
+	if info.Annotations == nil {
+		info.Annotations = make(map[string]string, 0)
+	}
+
+	changed := false
+	signed := make(map[string]bool, 0)
+	for _, x := range secrets {
+		tokenID, tokenSecret, ok := getSigningToken(x, now)
+		if !ok {
+			continue
+		}
+		signature, err := jws.ComputeDetachedSignature(content, tokenID, tokenSecret)
+		if err != nil {
+			continue
+		}
+		signed[tokenID] = true
+		if key := bootstrapapi.JWSSignatureKeyPrefix + tokenID; info.Data[key] != signature {
+			info.Data[key] = signature
+			changed = true
+		}
+	}
+	// step: remove the signatures we previously added for tokens now gone
+	for _, id := range splitList(info.Annotations[signedAnnotation]) {
+		if signed[id] {
+			continue
+		}
+		if key := bootstrapapi.JWSSignatureKeyPrefix + id; info.Data[key] != "" {
+			delete(info.Data, key)
+			changed = true
+		}
+	}
+
+	var ids []string
+	for id := range signed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if annotation := strings.Join(ids, ","); info.Annotations[signedAnnotation] != annotation {
+		info.Annotations[signedAnnotation] = annotation
+		changed = true
+	}
+
+	return changed
+}
+
+// getSigningToken returns the token from the secret if it is valid for signing
+func getSigningToken(secret v1.Secret, now time.Time) (string, string, bool) {
+	if secret.Type != v1.SecretType(bootstrapapi.SecretTypeBootstrapToken) {
+		return "", "", false
+	}
+	if string(secret.Data[bootstrapapi.BootstrapTokenUsagePrefix+"signing"]) != "true" {
+		return "", "", false
+	}
+	if expires, found := secret.Data[bootstrapapi.BootstrapTokenExpirationKey]; found {
+		t, err := time.Parse(time.RFC3339, string(expires))
+		if err != nil || now.After(t) {
+			return "", "", false
+		}
+	}
+	tokenID := string(secret.Data[bootstrapapi.BootstrapTokenIDKey])
+	tokenSecret := string(secret.Data[bootstrapapi.BootstrapTokenSecretKey])
+	if parseTokenID(tokenID) != nil || tokenSecret == "" {
+		return "", "", false
+	}
+
+	return tokenID, tokenSecret, true
+}
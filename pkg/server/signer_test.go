@@ -0,0 +1,115 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/UKHomeOffice/keto-tokens/pkg/jws"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestSignClusterInfo(t *testing.T) {
+	now := time.Now()
+	info := newFakeClusterInfo()
+	secrets := []v1.Secret{
+		newFakeTokenSecret("abcdef", "0123456789abcdef", []string{"authentication", "signing"}, now.Add(time.Hour)),
+		newFakeTokenSecret("bcdefa", "0123456789abcdef", []string{"authentication"}, now.Add(time.Hour)),
+		newFakeTokenSecret("cdefab", "0123456789abcdef", []string{"signing"}, now.Add(-time.Hour)),
+	}
+	assert.True(t, signClusterInfo(info, secrets, now))
+	assert.Equal(t, "abcdef", info.Annotations[signedAnnotation])
+	assert.NoError(t, jws.VerifyDetachedSignature("kubeconfig", info.Data["jws-kubeconfig-abcdef"], "abcdef", "0123456789abcdef"))
+	assert.NotContains(t, info.Data, "jws-kubeconfig-bcdefa")
+	assert.NotContains(t, info.Data, "jws-kubeconfig-cdefab")
+	assert.Equal(t, "other", info.Data["jws-kubeconfig-zzzzzz"])
+
+	// step: nothing should change on a second pass
+	assert.False(t, signClusterInfo(info, secrets, now))
+
+	// step: the token is deleted and we should remove only our signature
+	assert.True(t, signClusterInfo(info, secrets[1:], now))
+	assert.NotContains(t, info.Data, "jws-kubeconfig-abcdef")
+	assert.Equal(t, "other", info.Data["jws-kubeconfig-zzzzzz"])
+	assert.Empty(t, info.Annotations[signedAnnotation])
+
+	// step: an expired token should have its signature removed
+	assert.True(t, signClusterInfo(info, secrets[:1], now))
+	assert.True(t, signClusterInfo(info, secrets[:1], now.Add(2*time.Hour)))
+	assert.NotContains(t, info.Data, "jws-kubeconfig-abcdef")
+}
+
+func TestAddSignature(t *testing.T) {
+	info := newFakeClusterInfo()
+	info.Annotations = map[string]string{signedAnnotation: "bcdefa"}
+	changed, err := addSignature(info, "abcdef", "0123456789abcdef")
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "abcdef,bcdefa", info.Annotations[signedAnnotation])
+	assert.NoError(t, jws.VerifyDetachedSignature("kubeconfig", info.Data["jws-kubeconfig-abcdef"], "abcdef", "0123456789abcdef"))
+
+	// step: signing again changes nothing
+	changed, err = addSignature(info, "abcdef", "0123456789abcdef")
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// step: the signature of a token we failed to publish is removed
+	assert.True(t, removeSignature(info, "abcdef"))
+	assert.NotContains(t, info.Data, "jws-kubeconfig-abcdef")
+	assert.Equal(t, "bcdefa", info.Annotations[signedAnnotation])
+	assert.Equal(t, "other", info.Data["jws-kubeconfig-zzzzzz"])
+	assert.False(t, removeSignature(info, "abcdef"))
+	// step: we never remove signatures we did not add
+	assert.False(t, removeSignature(info, "zzzzzz"))
+	assert.Equal(t, "other", info.Data["jws-kubeconfig-zzzzzz"])
+
+	_, err = addSignature(&v1.ConfigMap{}, "abcdef", "0123456789abcdef")
+	assert.Error(t, err)
+}
+
+func TestSignClusterInfoNoKubeconfig(t *testing.T) {
+	info := &v1.ConfigMap{}
+	secrets := []v1.Secret{
+		newFakeTokenSecret("abcdef", "0123456789abcdef", []string{"signing"}, time.Now().Add(time.Hour)),
+	}
+	assert.False(t, signClusterInfo(info, secrets, time.Now()))
+}
+
+func newFakeClusterInfo() *v1.ConfigMap {
+	info := &v1.ConfigMap{
+		Data: map[string]string{
+			"kubeconfig":            "kubeconfig",
+			"jws-kubeconfig-zzzzzz": "other",
+		},
+	}
+	info.Name = "cluster-info"
+
+	return info
+}
+
+func newFakeTokenSecret(id, secret string, usages []string, expires time.Time) v1.Secret {
+	s := v1.Secret{
+		Type: v1.SecretType("bootstrap.kubernetes.io/token"),
+		Data: encodeTokenSecretData(id, secret, TokenOptions{Usages: usages}),
+	}
+	s.Data["expiration"] = []byte(expires.Format(time.RFC3339))
+
+	return s
+}
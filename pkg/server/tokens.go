@@ -24,7 +24,6 @@ package server
 import (
 	"errors"
 	"fmt"
-	"time"
 
 	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
 
@@ -43,10 +42,14 @@ func NewTokenProvider() (TokensProvider, error) {
 
 const (
 	tokenNamespace = "kube-system"
+	// managedLabel is the label applied to the token secrets we create
+	managedLabel = "keto-tokens/managed"
+	// nodeLabel is the label holding the node the token was issued to
+	nodeLabel = "keto-tokens/node"
 )
 
 // Create generates a token for the instance
-func (c *kubeTokensProvider) Create(client *kubernetes.Clientset, id cloud.NodeID, ttl time.Duration, usages []string, namespace string) (string, error) {
+func (c *kubeTokensProvider) Create(client *kubernetes.Clientset, id cloud.NodeID, options TokenOptions) (string, error) {
 	newToken, err := generateToken()
 	if err != nil {
 		return "", err
@@ -58,7 +61,7 @@ func (c *kubeTokensProvider) Create(client *kubernetes.Clientset, id cloud.NodeI
 
 	name := fmt.Sprintf("%s%s", bootstrapapi.BootstrapTokenSecretPrefix, tokenID)
 	for i := 0; i < 5; i++ {
-		if found, err := c.hasToken(client, name, namespace); err != nil {
+		if found, err := c.hasToken(client, name, options.Namespace); err != nil {
 			continue
 		} else if found {
 			return newToken, nil
@@ -68,12 +71,16 @@ func (c *kubeTokensProvider) Create(client *kubernetes.Clientset, id cloud.NodeI
 		secret := &v1.Secret{
 			ObjectMeta: v1.ObjectMeta{
 				Name: name,
+				Labels: map[string]string{
+					managedLabel: "true",
+					nodeLabel:    string(id),
+				},
 			},
 			Type: v1.SecretType(bootstrapapi.SecretTypeBootstrapToken),
-			Data: encodeTokenSecretData(tokenID, tokenSecret, usages, ttl),
+			Data: encodeTokenSecretData(tokenID, tokenSecret, options),
 		}
 
-		if _, err := client.Secrets(namespace).Create(secret); err == nil {
+		if _, err := client.Secrets(options.Namespace).Create(secret); err == nil {
 			return newToken, nil
 		}
 	}
@@ -96,7 +103,7 @@ func (c *kubeTokensProvider) Delete(client *kubernetes.Clientset, token, namespa
 		return nil
 	}
 
-	return client.Secrets(tokenNamespace).Delete(name, &v1.DeleteOptions{})
+	return client.Secrets(namespace).Delete(name, &v1.DeleteOptions{})
 }
 
 // hasToken checks if a secret exists in the namespace
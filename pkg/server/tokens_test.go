@@ -17,8 +17,6 @@ limitations under the License.
 package server
 
 import (
-	"time"
-
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
@@ -32,8 +30,7 @@ func newFakeTokenProvider() TokensProvider {
 	return &fakeTokenProvider{tokens: make(map[string]cloud.NodeID, 0)}
 }
 
-func (f *fakeTokenProvider) Create(client *kubernetes.Clientset, id cloud.NodeID,
-	ttl time.Duration, usages []string, namespace string) (string, error) {
+func (f *fakeTokenProvider) Create(client *kubernetes.Clientset, id cloud.NodeID, options TokenOptions) (string, error) {
 	newTokens, err := generateToken()
 	if err != nil {
 		return "", err
@@ -19,8 +19,10 @@ package server
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 
 	bootstrapapi "k8s.io/kubernetes/pkg/bootstrap/api"
@@ -29,6 +31,19 @@ import (
 const (
 	tokenIDBytes     = 3
 	tokenSecretBytes = 8
+	// tokenExtraGroupsKey is the secret key holding the extra bootstrap groups
+	tokenExtraGroupsKey = "auth-extra-groups"
+	// tokenDescriptionKey is the secret key holding the token description
+	tokenDescriptionKey = "description"
+	// tokenGroupPrefix is the prefix all extra bootstrap groups must carry
+	tokenGroupPrefix = "system:bootstrappers:"
+)
+
+var (
+	// defaultTokenUsages are the usages applied when none are configured
+	defaultTokenUsages = []string{"authentication", "signing"}
+	// validTokenUsages is the collection of usages a token may carry
+	validTokenUsages = map[string]bool{"authentication": true, "signing": true}
 )
 
 var (
@@ -80,19 +95,62 @@ func parseToken(s string) (string, string, error) {
 	return split[1], split[2], nil
 }
 
-// encodeTokenSecretData takes the token discovery object and an optional duration and returns the .Data for the Secret
-func encodeTokenSecretData(token, secret string, usages []string, ttl time.Duration) map[string][]byte {
+// encodeTokenSecretData takes the token discovery object and the token options and returns the .Data for the Secret
+func encodeTokenSecretData(token, secret string, options TokenOptions) map[string][]byte {
 	data := map[string][]byte{
 		bootstrapapi.BootstrapTokenIDKey:     []byte(token),
 		bootstrapapi.BootstrapTokenSecretKey: []byte(secret),
 	}
-	if ttl > 0 {
-		expire := time.Now().Add(ttl).Format(time.RFC3339)
+	if options.TTL > 0 {
+		expire := time.Now().Add(options.TTL).Format(time.RFC3339)
 		data[bootstrapapi.BootstrapTokenExpirationKey] = []byte(expire)
 	}
-	for _, usage := range usages {
+	for _, usage := range options.Usages {
 		data[bootstrapapi.BootstrapTokenUsagePrefix+usage] = []byte("true")
 	}
+	if len(options.ExtraGroups) > 0 {
+		data[tokenExtraGroupsKey] = []byte(strings.Join(options.ExtraGroups, ","))
+	}
+	if options.Description != "" {
+		data[tokenDescriptionKey] = []byte(options.Description)
+	}
 
 	return data
 }
+
+// validateUsages checks there is at least one token usage and all are known
+func validateUsages(usages []string) error {
+	if len(usages) <= 0 {
+		return errors.New("token usages cannot be empty")
+	}
+	for _, x := range usages {
+		if !validTokenUsages[x] {
+			return fmt.Errorf("token usage: %q is invalid", x)
+		}
+	}
+
+	return nil
+}
+
+// validateExtraGroups checks the extra groups are all bootstrap groups
+func validateExtraGroups(groups []string) error {
+	for _, x := range groups {
+		if !strings.HasPrefix(x, tokenGroupPrefix) || len(x) == len(tokenGroupPrefix) {
+			return fmt.Errorf("extra group: %q must be prefixed with %q", x, tokenGroupPrefix)
+		}
+	}
+
+	return nil
+}
+
+// splitList splits a comma separated list, dropping any empty elements
+func splitList(v string) []string {
+	var list []string
+	for _, x := range strings.Split(v, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			list = append(list, x)
+		}
+	}
+
+	return list
+}
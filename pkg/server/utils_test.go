@@ -0,0 +1,52 @@
+/*
+Copyright 2017 The Keto Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeTokenSecretData(t *testing.T) {
+	data := encodeTokenSecretData("abcdef", "0123456789abcdef", TokenOptions{
+		Description: "test",
+		ExtraGroups: []string{"system:bootstrappers:gpu", "system:bootstrappers:spot"},
+		TTL:         time.Duration(10) * time.Minute,
+		Usages:      []string{"authentication"},
+	})
+	assert.Equal(t, "abcdef", string(data["token-id"]))
+	assert.Equal(t, "0123456789abcdef", string(data["token-secret"]))
+	assert.Equal(t, "true", string(data["usage-bootstrap-authentication"]))
+	assert.NotContains(t, data, "usage-bootstrap-signing")
+	assert.Equal(t, "system:bootstrappers:gpu,system:bootstrappers:spot", string(data["auth-extra-groups"]))
+	assert.Equal(t, "test", string(data["description"]))
+	assert.NotEmpty(t, data["expiration"])
+}
+
+func TestValidateExtraGroups(t *testing.T) {
+	assert.NoError(t, validateExtraGroups(nil))
+	assert.NoError(t, validateExtraGroups([]string{"system:bootstrappers:gpu"}))
+	assert.Error(t, validateExtraGroups([]string{"system:bootstrappers:"}))
+	assert.Error(t, validateExtraGroups([]string{"system:masters"}))
+}
+
+func TestSplitList(t *testing.T) {
+	assert.Empty(t, splitList(""))
+	assert.Equal(t, []string{"a", "b"}, splitList(" a, ,b,"))
+}
@@ -17,13 +17,19 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud/middleware"
 	"github.com/UKHomeOffice/keto-tokens/pkg/server"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
@@ -33,6 +39,11 @@ func newServiceCommand() cli.Command {
 		Name:  "server",
 		Usage: "starts the service, generating the registration tokens for kubelets",
 		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "config",
+				Usage:  "optional yaml or json configuration file, the command line taking precedence, reloaded on a SIGHUP `PATH`",
+				EnvVar: "CONFIG_FILE",
+			},
 			cli.StringFlag{
 				Name:   "master",
 				Usage:  "url for the kubernetes api",
@@ -54,9 +65,14 @@ func newServiceCommand() cli.Command {
 				Value:  "KubeletToken",
 				EnvVar: "TAG_NAME",
 			},
+			cli.StringFlag{
+				Name:   "ca-hash-tag-name",
+				Usage:  "tag used to publish the cluster ca hash alongside the tokens whose cluster-info we sign, disabled if empty `NAME`",
+				EnvVar: "CA_HASH_TAG_NAME",
+			},
 			cli.StringSliceFlag{
 				Name:   "filter",
-				Usage:  "collection of filter tags used to identity compute nodes (key=value)",
+				Usage:  "selector used to identify the compute node pools i.e. key=value, key!=value, key in (a,b), key, !key, key=glob* or key=~regex",
 				EnvVar: "NODE_FILTER",
 			},
 			cli.StringFlag{
@@ -65,18 +81,90 @@ func newServiceCommand() cli.Command {
 				Value:  "kube-system",
 				EnvVar: "TOKEN_NAMESPACE",
 			},
+			cli.StringSliceFlag{
+				Name:   "token-usage",
+				Usage:  "the default usages applied to the registration token (authentication, signing) `USAGE`",
+				EnvVar: "TOKEN_USAGES",
+			},
+			cli.StringSliceFlag{
+				Name:   "token-extra-group",
+				Usage:  "the default extra bootstrap groups (system:bootstrappers:*) applied to the token `GROUP`",
+				EnvVar: "TOKEN_EXTRA_GROUPS",
+			},
+			cli.StringFlag{
+				Name:   "token-description",
+				Usage:  "the default description placed on the registration token `DESCRIPTION`",
+				Value:  "kubelet registration token generated by keto-tokens",
+				EnvVar: "TOKEN_DESCRIPTION",
+			},
 			cli.DurationFlag{
 				Name:   "token-ttl",
 				Usage:  "the time-to-live on generate registration token",
 				EnvVar: "TOKEN_TTL",
 				Value:  time.Duration(30) * time.Minute,
 			},
+			cli.BoolFlag{
+				Name:   "record-events",
+				Usage:  "record the token lifecycle as kubernetes events on the token secret",
+				EnvVar: "RECORD_EVENTS",
+			},
+			cli.StringFlag{
+				Name:   "event-namespace",
+				Usage:  "optional namespace to record the events in, defaults to the token namespace `NAMESPACE`",
+				EnvVar: "EVENT_NAMESPACE",
+			},
+			cli.StringFlag{
+				Name:   "audit-log",
+				Usage:  "optional path to an append-only json audit log of token actions `PATH`",
+				EnvVar: "AUDIT_LOG",
+			},
+			cli.BoolFlag{
+				Name:   "sign-cluster-info",
+				Usage:  "maintain the jws signatures in kube-public/cluster-info for the tokens we issue",
+				EnvVar: "SIGN_CLUSTER_INFO",
+			},
+			cli.BoolFlag{
+				Name:   "approve-csrs",
+				Usage:  "approve kubelet certificate requests from the live instances we have issued tokens to",
+				EnvVar: "APPROVE_CSRS",
+			},
+			cli.BoolFlag{
+				Name:   "dry-run",
+				Usage:  "log the nodes which would be issued tokens without creating any secrets or tags",
+				EnvVar: "DRY_RUN",
+			},
 			cli.DurationFlag{
 				Name:   "interval",
 				Usage:  "reconcilation interval to check for compute nodes",
 				Value:  time.Duration(10) * time.Second,
 				EnvVar: "INTERVAL",
 			},
+			cli.BoolFlag{
+				Name:   "once",
+				Usage:  "run a single reconciliation and exit, non-zero if it failed on any node",
+				EnvVar: "RECONCILE_ONCE",
+			},
+			cli.StringFlag{
+				Name:   "metrics-listen",
+				Usage:  "optional address to expose the prometheus metrics on i.e. :9090 `ADDRESS`",
+				EnvVar: "METRICS_LISTEN",
+			},
+			cli.DurationFlag{
+				Name:   "cache-pools-ttl",
+				Usage:  "the time to cache the node pools for, zero to disable `DURATION`",
+				EnvVar: "CACHE_POOLS_TTL",
+			},
+			cli.DurationFlag{
+				Name:   "cache-tags-ttl",
+				Usage:  "the time to cache the instance tags for, zero (the default) to disable `DURATION`",
+				EnvVar: "CACHE_TAGS_TTL",
+			},
+			cli.DurationFlag{
+				Name:   "cache-negative-ttl",
+				Usage:  "the time to cache missing tags and instances for, zero to disable `DURATION`",
+				Value:  time.Duration(30) * time.Second,
+				EnvVar: "CACHE_NEGATIVE_TTL",
+			},
 		},
 		Action: func(cx *cli.Context) error {
 			return handleCommand(cx, runServiceCommand)
@@ -86,9 +174,16 @@ func newServiceCommand() cli.Command {
 
 // runServiceCommand is the entrypoint for starting in server mode
 func runServiceCommand(cx *cli.Context) error {
-	p := handleCloudProvider(cx)
-	// step: parse the filter tags
-	tags, err := convertToTags(cx.StringSlice("filter"))
+	values, err := loadConfigValues(cx, "server")
+	if err != nil {
+		return err
+	}
+	// step: the cloud provider and its caches are shared by the cluster profiles
+	p, err := middleware.NewCache(handleCloudProvider(cx), middleware.CacheOptions{
+		NegativeTTL: values.Duration("cache-negative-ttl"),
+		PoolsTTL:    values.Duration("cache-pools-ttl"),
+		TagsTTL:     values.Duration("cache-tags-ttl"),
+	})
 	if err != nil {
 		return err
 	}
@@ -97,39 +192,240 @@ func runServiceCommand(cx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	servers, err := newProfileServers(values, p, tp)
+	if err != nil {
+		return err
+	}
+	if values.Bool("once") {
+		return runServerOnce(servers)
+	}
+
+	// step: expose the metrics if required
+	if address := values.String("metrics-listen"); address != "" {
+		go func() {
+			if err := server.ServeMetrics(address); err != nil {
+				printError("failed to serve the metrics, error: %s", err)
+			}
+		}()
+	}
+
+	// step: reload the configuration file on a hangup
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	go func() {
+		for range reloadCh {
+			if err := reloadServerConfig(cx, servers); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Error("failed to reload the configuration, keeping the current one")
+			}
+		}
+	}()
 
-	cfg := server.Config{
-		Filters:           tags,
-		KubeConfig:        cx.String("kubeconfig"),
-		KubeToken:         cx.String("kube-token"),
-		MasterAPI:         cx.String("master"),
-		ReconcileInterval: cx.Duration("interval"),
-		TagName:           cx.String("tag-name"),
-		TokenNamespace:    cx.String("token-namespace"),
-		TokenTTL:          cx.Duration("token-ttl"),
+	// step: stop the services, cancelling any in-flight calls, on a signal
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signalCh
+		for _, x := range servers {
+			x.server.Stop()
+		}
+	}()
+
+	// step: each profile runs its own reconcile loop, all being stopped if one fails
+	errCh := make(chan error, len(servers))
+	for _, x := range servers {
+		go func(c *server.Server) {
+			errCh <- c.Start()
+		}(x.server)
+	}
+	var failed error
+	for range servers {
+		if err := <-errCh; err != nil && failed == nil {
+			failed = err
+			for _, x := range servers {
+				x.server.Stop()
+			}
+		}
 	}
 
-	c, err := server.New(cfg, p, tp)
+	return failed
+}
+
+// runServerOnce runs a single reconciliation of each cluster profile, logging a summary of
+// each and returning an error if any of them failed
+func runServerOnce(servers []profileServer) error {
+	// step: cancel any in-flight calls on a signal
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signalCh
+		for _, x := range servers {
+			x.server.Stop()
+		}
+	}()
+
+	var failed []string
+	for _, x := range servers {
+		summary, err := x.server.Once()
+		fields := log.Fields{
+			"abandoned": summary.Abandoned,
+			"failed":    summary.Failed,
+			"issued":    summary.Issued,
+			"nodes":     summary.Nodes,
+			"planned":   summary.Planned,
+			"pools":     summary.Pools,
+			"profile":   x.name,
+			"skipped":   summary.Skipped,
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+			log.WithFields(fields).Error("reconciliation failed")
+			failed = append(failed, x.name)
+
+			continue
+		}
+		log.WithFields(fields).Info("reconciliation complete")
+	}
+	if len(failed) > 0 {
+		if len(servers) == 1 && failed[0] == "" {
+			return server.ErrReconcileFailed
+		}
+
+		return fmt.Errorf("reconciliation failed for profiles: %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// profileServer is the server for a cluster profile
+type profileServer struct {
+	name   string
+	server *server.Server
+}
+
+// newProfileServers creates a server for each of the cluster profiles in the configuration
+// file, or a single server when there are none
+func newProfileServers(values *configValues, p cloud.Provider, tp server.TokensProvider) ([]profileServer, error) {
+	names := values.Profiles()
+	if len(names) <= 0 {
+		names = []string{""}
+	}
+	var list []profileServer
+	for _, name := range names {
+		cfg, err := getProfileConfig(values, name)
+		if err != nil {
+			return nil, err
+		}
+		c, err := server.New(cfg, p, tp)
+		if err != nil {
+			return nil, profileError(name, err)
+		}
+		list = append(list, profileServer{name: name, server: c})
+	}
+
+	return list, nil
+}
+
+// reloadServerConfig reads the configuration file again and hands each profile to its server;
+// adding or removing profiles requires a restart
+func reloadServerConfig(cx *cli.Context, servers []profileServer) error {
+	if cx.String("config") == "" {
+		return errors.New("no configuration file to reload, use --config")
+	}
+	log.Infof("reloading the configuration file: %s", cx.String("config"))
+	values, err := loadConfigValues(cx, "server")
 	if err != nil {
 		return err
 	}
+	names := values.Profiles()
+	if len(names) <= 0 {
+		names = []string{""}
+	}
+	if len(names) != len(servers) {
+		log.Warn("adding or removing cluster profiles requires a restart, reloading the existing profiles")
+	}
 
-	return c.Start()
+	for _, x := range servers {
+		if !containedIn(x.name, names) {
+			log.WithFields(log.Fields{
+				"profile": x.name,
+			}).Warn("cluster profile is no longer in the configuration, keeping the current one")
+			continue
+		}
+		cfg, err := getProfileConfig(values, x.name)
+		if err == nil {
+			err = x.server.Reload(cfg)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":   err.Error(),
+				"profile": x.name,
+			}).Error("failed to reload the cluster profile, keeping the current one")
+		}
+	}
+
+	return nil
 }
 
-// convertToTags converts a collection of key=value to tags
-func convertToTags(filters []string) (cloud.NodeTags, error) {
-	tags := make(cloud.NodeTags, 0)
-	for _, x := range filters {
-		e := strings.Split(x, "=")
-		if len(e) != 2 {
-			return tags, fmt.Errorf("filter: %s is invalid", x)
+// getProfileConfig returns the server configuration of the cluster profile, the empty name
+// being the server section itself
+func getProfileConfig(values *configValues, name string) (server.Config, error) {
+	options := optionValues(values)
+	if name != "" {
+		v, found := values.Profile(name)
+		if !found {
+			return server.Config{}, fmt.Errorf("profile: %s not found", name)
 		}
-		if len(e[0]) == 0 || len(e[1]) == 0 {
-			return tags, fmt.Errorf("filter: %s is invalid length", x)
+		if err := v.checkProfile(); err != nil {
+			return server.Config{}, profileError(name, err)
 		}
-		tags[e[0]] = e[1]
+		options = v
+	}
+	cfg, err := getServerConfig(options)
+	if err != nil {
+		return server.Config{}, profileError(name, err)
+	}
+	cfg.Profile = name
+
+	return cfg, nil
+}
+
+// profileError adds the name of the cluster profile to the error
+func profileError(name string, err error) error {
+	if name == "" {
+		return err
+	}
+
+	return fmt.Errorf("profile: %s, error: %s", name, err)
+}
+
+// getServerConfig builds the server configuration from the options
+func getServerConfig(values optionValues) (server.Config, error) {
+	// step: parse the node pool selector
+	selector, err := cloud.ParseSelector(values.StringSlice("filter"))
+	if err != nil {
+		return server.Config{}, err
 	}
 
-	return tags, nil
+	return server.Config{
+		ApproveCSRs:       values.Bool("approve-csrs"),
+		AuditLog:          values.String("audit-log"),
+		CAHashTagName:     values.String("ca-hash-tag-name"),
+		DryRun:            values.Bool("dry-run"),
+		EventNamespace:    values.String("event-namespace"),
+		Filters:           selector,
+		KubeConfig:        values.String("kubeconfig"),
+		KubeToken:         values.String("kube-token"),
+		MasterAPI:         values.String("master"),
+		ReconcileInterval: values.Duration("interval"),
+		RecordEvents:      values.Bool("record-events"),
+		SignClusterInfo:   values.Bool("sign-cluster-info"),
+		TagName:           values.String("tag-name"),
+		TokenDescription:  values.String("token-description"),
+		TokenExtraGroups:  values.StringSlice("token-extra-group"),
+		TokenNamespace:    values.String("token-namespace"),
+		TokenTTL:          values.Duration("token-ttl"),
+		TokenUsages:       values.StringSlice("token-usage"),
+	}, nil
 }
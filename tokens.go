@@ -19,9 +19,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/UKHomeOffice/keto-tokens/pkg/cloud"
 	_ "github.com/UKHomeOffice/keto-tokens/pkg/cloud/aws"
+	"github.com/UKHomeOffice/keto-tokens/pkg/cloud/middleware"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -41,6 +43,54 @@ func newKetoTokens() *cli.App {
 			Usage:  "specify the cloud provider (aws, gce) `NAME`",
 			Value:  "aws",
 		},
+		cli.IntFlag{
+			Name:   "cloud-retries",
+			Usage:  "the number of times a failed cloud api call is retried `COUNT`",
+			Value:  3,
+			EnvVar: "CLOUD_RETRIES",
+		},
+		cli.DurationFlag{
+			Name:   "cloud-retry-backoff",
+			Usage:  "the initial wait between retries of a cloud api call, doubling each attempt `DURATION`",
+			Value:  time.Duration(200) * time.Millisecond,
+			EnvVar: "CLOUD_RETRY_BACKOFF",
+		},
+		cli.DurationFlag{
+			Name:   "cloud-retry-max-backoff",
+			Usage:  "the maximum wait between retries of a cloud api call `DURATION`",
+			Value:  time.Duration(5) * time.Second,
+			EnvVar: "CLOUD_RETRY_MAX_BACKOFF",
+		},
+		cli.DurationFlag{
+			Name:   "cloud-timeout",
+			Usage:  "the timeout on each cloud api call `DURATION`",
+			Value:  time.Duration(30) * time.Second,
+			EnvVar: "CLOUD_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "cloud-describe-timeout",
+			Usage:  "the timeout on the cloud api calls describing pools and instances, zero for the cloud-timeout `DURATION`",
+			Value:  time.Duration(60) * time.Second,
+			EnvVar: "CLOUD_DESCRIBE_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "cloud-tag-timeout",
+			Usage:  "the timeout on the cloud api calls reading and writing instance tags, zero for the cloud-timeout `DURATION`",
+			Value:  time.Duration(10) * time.Second,
+			EnvVar: "CLOUD_TAG_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "cloud-breaker-threshold",
+			Usage:  "the consecutive cloud api failures which suspend calls, zero to disable `COUNT`",
+			Value:  5,
+			EnvVar: "CLOUD_BREAKER_THRESHOLD",
+		},
+		cli.DurationFlag{
+			Name:   "cloud-breaker-cooldown",
+			Usage:  "how long cloud api calls are suspended for `DURATION`",
+			Value:  time.Duration(30) * time.Second,
+			EnvVar: "CLOUD_BREAKER_COOLDOWN",
+		},
 		cli.BoolFlag{
 			Name:   "verbose",
 			Usage:  "switch on verbose logging mode `BOOL`",
@@ -58,6 +108,7 @@ func newKetoTokens() *cli.App {
 	app.Commands = []cli.Command{
 		newServiceCommand(),
 		newClientCommand(),
+		newTokensCommand(),
 	}
 
 	return app
@@ -80,16 +131,45 @@ func handleCommand(cx *cli.Context, cmd func(*cli.Context) error) error {
 	return nil
 }
 
-// handleCloudProvider retrieves a cloud provider for us
+// handleCloudProvider retrieves a cloud provider for us, wrapped in the retry middleware
 func handleCloudProvider(cx *cli.Context) cloud.Provider {
 	p, err := cloud.Get(cx.GlobalString("cloud"))
 	if err != nil {
 		panic(err)
 	}
+	p, err = middleware.New(p, middleware.Options{
+		Backoff:          cx.GlobalDuration("cloud-retry-backoff"),
+		BreakerCooldown:  cx.GlobalDuration("cloud-breaker-cooldown"),
+		BreakerThreshold: cx.GlobalInt("cloud-breaker-threshold"),
+		MaxBackoff:       cx.GlobalDuration("cloud-retry-max-backoff"),
+		Retries:          cx.GlobalInt("cloud-retries"),
+		Timeout:          cx.GlobalDuration("cloud-timeout"),
+		Timeouts:         getMethodTimeouts(cx),
+	})
+	if err != nil {
+		panic(err)
+	}
 
 	return p
 }
 
+// getMethodTimeouts returns the timeouts of the describe and tag methods, where given
+func getMethodTimeouts(cx *cli.Context) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration, 0)
+	if timeout := cx.GlobalDuration("cloud-describe-timeout"); timeout > 0 {
+		for _, x := range middleware.DescribeMethods {
+			timeouts[x] = timeout
+		}
+	}
+	if timeout := cx.GlobalDuration("cloud-tag-timeout"); timeout > 0 {
+		for _, x := range middleware.TagMethods {
+			timeouts[x] = timeout
+		}
+	}
+
+	return timeouts
+}
+
 func printError(message string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, "[error] "+message+"\n", args...)
 	os.Exit(1)